@@ -7,6 +7,7 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
@@ -17,6 +18,7 @@ import (
 	"github.com/shohag/piperelay/internal/config"
 	"github.com/shohag/piperelay/internal/delivery"
 	"github.com/shohag/piperelay/internal/models"
+	"github.com/shohag/piperelay/internal/retention"
 	"github.com/shohag/piperelay/internal/storage"
 )
 
@@ -35,6 +37,8 @@ func main() {
 	rootCmd.AddCommand(migrateCmd(&configPath))
 	rootCmd.AddCommand(appCmd(&configPath))
 	rootCmd.AddCommand(statsCmd(&configPath))
+	rootCmd.AddCommand(purgeCmd(&configPath))
+	rootCmd.AddCommand(importCmd(&configPath))
 	rootCmd.AddCommand(versionCmd())
 
 	if err := rootCmd.Execute(); err != nil {
@@ -52,6 +56,16 @@ func serveCmd(configPath *string) *cobra.Command {
 				return fmt.Errorf("failed to load config: %w", err)
 			}
 
+			if err := cfg.Admin.Validate(); err != nil {
+				return err
+			}
+			if err := cfg.Delivery.Egress.Validate(); err != nil {
+				return err
+			}
+			if p := models.RedirectPolicy(cfg.Delivery.Redirects.Policy); !p.Valid() {
+				return fmt.Errorf("delivery.redirects.policy: %q is not follow, no-follow or same-host", p)
+			}
+
 			log := setupLogger(cfg.Logging)
 
 			store, err := setupStorage(cfg.Storage, log)
@@ -70,7 +84,10 @@ func serveCmd(configPath *string) *cobra.Command {
 			defer cancel()
 			pool.Start(ctx)
 
-			server := api.NewServer(cfg.Server, store, log)
+			janitor := retention.NewJanitor(cfg.Retention, cfg.Messages.IdempotencyWindow, store, log)
+			janitor.Start(ctx)
+
+			server := api.NewServer(cfg, store, pool, log)
 			go func() {
 				if err := server.Start(); err != nil && err != http.ErrServerClosed {
 					log.Fatal().Err(err).Msg("server error")
@@ -95,6 +112,7 @@ func serveCmd(configPath *string) *cobra.Command {
 			}
 
 			pool.Stop()
+			janitor.Stop()
 
 			log.Info().Msg("PipeRelay stopped")
 			return nil
@@ -103,31 +121,121 @@ func serveCmd(configPath *string) *cobra.Command {
 }
 
 func migrateCmd(configPath *string) *cobra.Command {
-	return &cobra.Command{
+	var dryRun bool
+
+	up := func(cmd *cobra.Command, args []string) error {
+		store, cleanup, err := migratorStore(*configPath)
+		if err != nil {
+			return err
+		}
+		defer cleanup()
+
+		applied, err := store.Migrator().Up(context.Background(), dryRun)
+		printMigrations("applied", "would apply", applied, dryRun, func(m storage.Migration) string { return m.Up })
+		if err != nil {
+			return fmt.Errorf("migration failed: %w", err)
+		}
+		if len(applied) == 0 {
+			fmt.Println("Database is up to date.")
+		}
+		return nil
+	}
+
+	cmd := &cobra.Command{
 		Use:   "migrate",
 		Short: "Run database migrations",
+		RunE:  up,
+	}
+	cmd.PersistentFlags().BoolVar(&dryRun, "dry-run", false, "print the migrations that would run without applying them")
+
+	upCmd := &cobra.Command{
+		Use:   "up",
+		Short: "Apply all pending migrations",
+		RunE:  up,
+	}
+
+	downCmd := &cobra.Command{
+		Use:   "down",
+		Short: "Roll back migrations newer than --to",
 		RunE: func(cmd *cobra.Command, args []string) error {
-			cfg, err := config.Load(*configPath)
+			if !cmd.Flags().Changed("to") {
+				return fmt.Errorf("--to is required (use --to 0 to roll back everything)")
+			}
+			to, _ := cmd.Flags().GetInt("to")
+
+			store, cleanup, err := migratorStore(*configPath)
 			if err != nil {
-				return fmt.Errorf("failed to load config: %w", err)
+				return err
 			}
+			defer cleanup()
 
-			log := setupLogger(cfg.Logging)
+			rolledBack, err := store.Migrator().Down(context.Background(), to, dryRun)
+			printMigrations("rolled back", "would roll back", rolledBack, dryRun, func(m storage.Migration) string { return m.Down })
+			if err != nil {
+				return fmt.Errorf("rollback failed: %w", err)
+			}
+			if len(rolledBack) == 0 {
+				fmt.Printf("Nothing to roll back above version %d.\n", to)
+			}
+			return nil
+		},
+	}
+	downCmd.Flags().Int("to", 0, "target schema version to keep")
 
-			store, err := setupStorage(cfg.Storage, log)
+	statusCmd := &cobra.Command{
+		Use:   "status",
+		Short: "Show applied and pending migrations",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			store, cleanup, err := migratorStore(*configPath)
 			if err != nil {
-				return fmt.Errorf("failed to setup storage: %w", err)
+				return err
 			}
-			defer store.Close()
+			defer cleanup()
 
-			if err := store.Migrate(context.Background()); err != nil {
-				return fmt.Errorf("migration failed: %w", err)
+			statuses, err := store.Migrator().Status(context.Background())
+			if err != nil {
+				return fmt.Errorf("failed to read migration status: %w", err)
 			}
 
-			log.Info().Msg("migrations completed successfully")
+			for _, st := range statuses {
+				state := "pending"
+				if st.Applied {
+					state = "applied " + st.AppliedAt.Format(time.RFC3339)
+				}
+				fmt.Printf("  %4d  %-32s %s\n", st.Version, st.Name, state)
+			}
 			return nil
 		},
 	}
+
+	cmd.AddCommand(upCmd, downCmd, statusCmd)
+	return cmd
+}
+
+func printMigrations(done, would string, migrations []storage.Migration, dryRun bool, sql func(storage.Migration) string) {
+	for _, m := range migrations {
+		if dryRun {
+			fmt.Printf("-- %s %d %s\n%s\n\n", would, m.Version, m.Name, strings.TrimSpace(sql(m)))
+		} else {
+			fmt.Printf("%s %d %s\n", done, m.Version, m.Name)
+		}
+	}
+}
+
+// migratorStore opens storage without applying migrations, unlike
+// storeFromConfig, so the migrate subcommands control what runs.
+func migratorStore(configPath string) (storage.Storage, func(), error) {
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load config: %w", err)
+	}
+
+	log := setupLogger(cfg.Logging)
+	store, err := setupStorage(cfg.Storage, log)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to setup storage: %w", err)
+	}
+	return store, func() { store.Close() }, nil
 }
 
 func appCmd(configPath *string) *cobra.Command {
@@ -231,6 +339,110 @@ func statsCmd(configPath *string) *cobra.Command {
 	}
 }
 
+func purgeCmd(configPath *string) *cobra.Command {
+	var dryRun bool
+
+	cmd := &cobra.Command{
+		Use:   "purge",
+		Short: "Delete messages and attempts older than the retention settings",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, err := config.Load(*configPath)
+			if err != nil {
+				return fmt.Errorf("failed to load config: %w", err)
+			}
+
+			store, cleanup, err := storeFromConfig(*configPath)
+			if err != nil {
+				return err
+			}
+			defer cleanup()
+
+			janitor := retention.NewJanitor(cfg.Retention, cfg.Messages.IdempotencyWindow, store, setupLogger(cfg.Logging))
+			res, err := janitor.Run(context.Background(), dryRun)
+			if err != nil {
+				return fmt.Errorf("purge failed: %w", err)
+			}
+
+			if dryRun {
+				fmt.Printf("Would delete %d attempts and %d messages.\n", res.Attempts, res.Messages)
+			} else {
+				fmt.Printf("Deleted %d attempts, %d messages and %d idempotency keys.\n", res.Attempts, res.Messages, res.IdempotencyKeys)
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().BoolVar(&dryRun, "dry-run", false, "report what would be deleted without deleting it")
+	return cmd
+}
+
+func importCmd(configPath *string) *cobra.Command {
+	var server, apiKey string
+
+	cmd := &cobra.Command{
+		Use:   "import <file.ndjson>",
+		Short: "Stream newline-delimited JSON messages into a running server",
+		Long: "Uploads a file of {\"event_type\", \"payload\"} records, one per line, to\n" +
+			"POST /api/v1/messages/import. Use - to read from stdin.",
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if apiKey == "" {
+				apiKey = os.Getenv("PIPERELAY_API_KEY")
+			}
+			if apiKey == "" {
+				return fmt.Errorf("an application API key is required (--api-key or PIPERELAY_API_KEY)")
+			}
+			if server == "" {
+				cfg, err := config.Load(*configPath)
+				if err != nil {
+					return fmt.Errorf("failed to load config: %w", err)
+				}
+				server = fmt.Sprintf("http://localhost:%d", cfg.Server.Port)
+			}
+
+			body := os.Stdin
+			if args[0] != "-" {
+				f, err := os.Open(args[0])
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+				body = f
+			}
+
+			req, err := http.NewRequestWithContext(cmd.Context(), http.MethodPost,
+				strings.TrimRight(server, "/")+"/api/v1/messages/import", body)
+			if err != nil {
+				return err
+			}
+			req.Header.Set("Authorization", "Bearer "+apiKey)
+			req.Header.Set("Content-Type", "application/x-ndjson")
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				return fmt.Errorf("import request failed: %w", err)
+			}
+			defer resp.Body.Close()
+
+			var summary map[string]interface{}
+			if err := json.NewDecoder(resp.Body).Decode(&summary); err != nil {
+				return fmt.Errorf("unexpected response (%s): %w", resp.Status, err)
+			}
+			out, _ := json.MarshalIndent(summary, "", "  ")
+			fmt.Println(string(out))
+
+			if resp.StatusCode != http.StatusOK {
+				return fmt.Errorf("import failed: %s", resp.Status)
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&server, "server", "", "PipeRelay base URL (default http://localhost:<server.port>)")
+	cmd.Flags().StringVar(&apiKey, "api-key", "", "application API key (default $PIPERELAY_API_KEY)")
+	return cmd
+}
+
 func versionCmd() *cobra.Command {
 	return &cobra.Command{
 		Use:   "version",
@@ -260,6 +472,9 @@ func setupStorage(cfg config.StorageConfig, log zerolog.Logger) (storage.Storage
 	case "sqlite":
 		log.Info().Str("path", cfg.SQLite.Path).Msg("using SQLite storage")
 		return storage.NewSQLite(cfg.SQLite.Path)
+	case "postgres":
+		log.Info().Msg("using PostgreSQL storage")
+		return storage.NewPostgres(cfg.Postgres)
 	default:
 		return nil, fmt.Errorf("unsupported storage driver: %s", cfg.Driver)
 	}
@@ -2,6 +2,7 @@ package api
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"time"
 
@@ -19,7 +20,35 @@ func NewApplicationHandler(store storage.Storage) *ApplicationHandler {
 }
 
 type createAppRequest struct {
-	Name string `json:"name"`
+	Name              string                     `json:"name"`
+	RetryPolicy       *models.RetryPolicy        `json:"retry_policy"`
+	Weight            int                        `json:"weight"`
+	EventPriorities   map[string]models.Priority `json:"event_priorities"`
+	ResponseBodyLimit int                        `json:"response_body_limit"`
+}
+
+// maxAppWeight bounds an application's share of the delivery workers
+// relative to the default weight of 1.
+const maxAppWeight = 100
+
+// maxResponseBodyLimit bounds how much of each response body an
+// application may have attempts keep.
+const maxResponseBodyLimit = 64 * 1024
+
+// maxEventPriorities bounds how many event_priorities an application sets.
+const maxEventPriorities = 100
+
+// validateEventPriorities returns why m is unusable, or "" if it is fine.
+func validateEventPriorities(m map[string]models.Priority) string {
+	if len(m) > maxEventPriorities {
+		return fmt.Sprintf("event_priorities must have at most %d entries", maxEventPriorities)
+	}
+	for pattern := range m {
+		if pattern == "" || pattern == ".*" {
+			return "event_priorities keys must be event types or patterns such as \"payment.*\""
+		}
+	}
+	return ""
 }
 
 func (h *ApplicationHandler) Create(w http.ResponseWriter, r *http.Request) {
@@ -32,14 +61,38 @@ func (h *ApplicationHandler) Create(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusBadRequest, "name is required")
 		return
 	}
+	if reason := validateRetryPolicy(req.RetryPolicy); reason != "" {
+		writeError(w, http.StatusBadRequest, reason)
+		return
+	}
+	if req.Weight < 0 || req.Weight > maxAppWeight {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("weight must be between 1 and %d", maxAppWeight))
+		return
+	}
+	if reason := validateEventPriorities(req.EventPriorities); reason != "" {
+		writeError(w, http.StatusBadRequest, reason)
+		return
+	}
+	if req.ResponseBodyLimit < 0 || req.ResponseBodyLimit > maxResponseBodyLimit {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("response_body_limit must be between 0 and %d", maxResponseBodyLimit))
+		return
+	}
+
+	if req.Weight == 0 {
+		req.Weight = 1
+	}
 
 	now := time.Now().UTC()
 	app := &models.Application{
-		ID:        models.NewID("app"),
-		Name:      req.Name,
-		APIKey:    models.NewAPIKey(),
-		CreatedAt: now,
-		UpdatedAt: now,
+		ID:                models.NewID("app"),
+		Name:              req.Name,
+		APIKey:            models.NewAPIKey(),
+		RetryPolicy:       req.RetryPolicy,
+		Weight:            req.Weight,
+		EventPriorities:   req.EventPriorities,
+		ResponseBodyLimit: req.ResponseBodyLimit,
+		CreatedAt:         now,
+		UpdatedAt:         now,
 	}
 
 	if err := h.store.CreateApplication(r.Context(), app); err != nil {
@@ -80,6 +133,69 @@ func (h *ApplicationHandler) List(w http.ResponseWriter, r *http.Request) {
 	writeJSON(w, http.StatusOK, apps)
 }
 
+type updateAppRequest struct {
+	Name              string                     `json:"name"`
+	RetryPolicy       *models.RetryPolicy        `json:"retry_policy"`
+	Weight            int                        `json:"weight"`
+	EventPriorities   map[string]models.Priority `json:"event_priorities"`
+	ResponseBodyLimit int                        `json:"response_body_limit"`
+}
+
+func (h *ApplicationHandler) Update(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	app, err := h.store.GetApplication(r.Context(), id)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to get application")
+		return
+	}
+	if app == nil {
+		writeError(w, http.StatusNotFound, "application not found")
+		return
+	}
+
+	var req updateAppRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	if reason := validateRetryPolicy(req.RetryPolicy); reason != "" {
+		writeError(w, http.StatusBadRequest, reason)
+		return
+	}
+	if req.Weight < 0 || req.Weight > maxAppWeight {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("weight must be between 1 and %d", maxAppWeight))
+		return
+	}
+	if reason := validateEventPriorities(req.EventPriorities); reason != "" {
+		writeError(w, http.StatusBadRequest, reason)
+		return
+	}
+	if req.ResponseBodyLimit < 0 || req.ResponseBodyLimit > maxResponseBodyLimit {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("response_body_limit must be between 0 and %d", maxResponseBodyLimit))
+		return
+	}
+
+	if req.Name != "" {
+		app.Name = req.Name
+	}
+	app.RetryPolicy = req.RetryPolicy
+	if req.Weight != 0 {
+		app.Weight = req.Weight
+	}
+	if req.EventPriorities != nil {
+		app.EventPriorities = req.EventPriorities
+	}
+	app.ResponseBodyLimit = req.ResponseBodyLimit
+
+	if err := h.store.UpdateApplication(r.Context(), app); err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to update application")
+		return
+	}
+
+	app.APIKey = "" // don't expose
+	writeJSON(w, http.StatusOK, app)
+}
+
 func (h *ApplicationHandler) Delete(w http.ResponseWriter, r *http.Request) {
 	id := chi.URLParam(r, "id")
 	app, err := h.store.GetApplication(r.Context(), id)
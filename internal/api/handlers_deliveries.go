@@ -17,22 +17,20 @@ func NewDeliveryHandler(store storage.Storage) *DeliveryHandler {
 }
 
 func (h *DeliveryHandler) Get(w http.ResponseWriter, r *http.Request) {
-	id := chi.URLParam(r, "id")
-	d, err := h.store.GetDelivery(r.Context(), id)
-	if err != nil {
-		writeError(w, http.StatusInternalServerError, "failed to get delivery")
-		return
-	}
-	if d == nil {
-		writeError(w, http.StatusNotFound, "delivery not found")
+	d, ok := h.ownedDelivery(w, r)
+	if !ok {
 		return
 	}
 	writeJSON(w, http.StatusOK, d)
 }
 
 func (h *DeliveryHandler) ListAttempts(w http.ResponseWriter, r *http.Request) {
-	id := chi.URLParam(r, "id")
-	attempts, err := h.store.GetAttemptsByDelivery(r.Context(), id)
+	d, ok := h.ownedDelivery(w, r)
+	if !ok {
+		return
+	}
+
+	attempts, err := h.store.GetAttemptsByDelivery(r.Context(), d.ID)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, "failed to get attempts")
 		return
@@ -42,3 +40,36 @@ func (h *DeliveryHandler) ListAttempts(w http.ResponseWriter, r *http.Request) {
 	}
 	writeJSON(w, http.StatusOK, attempts)
 }
+
+// ownedDelivery loads the delivery named in the URL and checks, through its
+// message, that it belongs to the authenticated application. Another
+// application's delivery is reported as not found. When ok is false the
+// error response has already been written.
+func (h *DeliveryHandler) ownedDelivery(w http.ResponseWriter, r *http.Request) (*models.Delivery, bool) {
+	app := AppFromContext(r.Context())
+	if app == nil {
+		writeError(w, http.StatusUnauthorized, "unauthorized")
+		return nil, false
+	}
+
+	d, err := h.store.GetDelivery(r.Context(), chi.URLParam(r, "id"))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to get delivery")
+		return nil, false
+	}
+	if d == nil {
+		writeError(w, http.StatusNotFound, "delivery not found")
+		return nil, false
+	}
+
+	msg, err := h.store.GetMessage(r.Context(), d.MessageID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to get delivery")
+		return nil, false
+	}
+	if msg == nil || msg.AppID != app.ID {
+		writeError(w, http.StatusNotFound, "delivery not found")
+		return nil, false
+	}
+	return d, true
+}
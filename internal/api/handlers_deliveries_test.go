@@ -0,0 +1,40 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/shohag/piperelay/internal/storage"
+)
+
+func TestDeliveryHidesLease(t *testing.T) {
+	s := newTestServer(t)
+	tn := s.createTenant("alice")
+
+	// The tenant's own message is scheduled an hour out; send one that is
+	// due now and lease it.
+	msg := map[string]interface{}{"event_type": "order.created", "payload": map[string]string{}}
+	if code := s.do(http.MethodPost, "/api/v1/messages", tn.app.APIKey, msg, nil); code != http.StatusAccepted {
+		t.Fatalf("sending message: status %d", code)
+	}
+	claimed, err := s.store.ClaimDeliveries(context.Background(), storage.ClaimOptions{
+		WorkerID:    "worker-host-1234",
+		Lease:       time.Minute,
+		PerEndpoint: map[string]int{tn.endpointID: 1},
+	})
+	if err != nil || len(claimed) != 1 {
+		t.Fatalf("claim = %d, %v", len(claimed), err)
+	}
+
+	var got map[string]interface{}
+	if code := s.do(http.MethodGet, "/api/v1/deliveries/"+claimed[0].ID, tn.app.APIKey, nil, &got); code != http.StatusOK {
+		t.Fatalf("status %d", code)
+	}
+	for _, field := range []string{"locked_by", "locked_until", "lease_token"} {
+		if v, ok := got[field]; ok {
+			t.Errorf("delivery exposes %s = %v", field, v)
+		}
+	}
+}
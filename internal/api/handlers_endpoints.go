@@ -2,29 +2,46 @@ package api
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/url"
 	"time"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/shohag/piperelay/internal/delivery"
 	"github.com/shohag/piperelay/internal/models"
 	"github.com/shohag/piperelay/internal/storage"
 )
 
 type EndpointHandler struct {
-	store storage.Storage
+	store    storage.Storage
+	circuits *delivery.CircuitBreaker
+	bulkhead *delivery.Bulkhead
+	guard    *delivery.Guard
 }
 
-func NewEndpointHandler(store storage.Storage) *EndpointHandler {
-	return &EndpointHandler{store: store}
+func NewEndpointHandler(store storage.Storage, circuits *delivery.CircuitBreaker, bulkhead *delivery.Bulkhead, guard *delivery.Guard) *EndpointHandler {
+	return &EndpointHandler{store: store, circuits: circuits, bulkhead: bulkhead, guard: guard}
+}
+
+type endpointResponse struct {
+	*models.Endpoint
+	Circuit delivery.CircuitStatus  `json:"circuit"`
+	Health  delivery.EndpointHealth `json:"health"`
 }
 
 type createEndpointRequest struct {
-	URL         string            `json:"url"`
-	Description string            `json:"description"`
-	EventTypes  []string          `json:"event_types"`
-	RateLimit   int               `json:"rate_limit"`
-	Metadata    map[string]string `json:"metadata"`
+	URL            string              `json:"url"`
+	Description    string              `json:"description"`
+	EventTypes     []string            `json:"event_types"`
+	RateLimit      int                 `json:"rate_limit"`
+	MessageTTL     models.Duration     `json:"message_ttl"`
+	RetryPolicy    *models.RetryPolicy `json:"retry_policy"`
+	MaxConcurrency int                 `json:"max_concurrency"`
+	FIFO           bool                `json:"fifo"`
+	Batch          *models.BatchPolicy `json:"batch"`
+	RedirectPolicy string              `json:"redirect_policy"`
+	Metadata       map[string]string   `json:"metadata"`
 }
 
 func (h *EndpointHandler) Create(w http.ResponseWriter, r *http.Request) {
@@ -48,20 +65,54 @@ func (h *EndpointHandler) Create(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusBadRequest, "url must be a valid HTTP or HTTPS URL")
 		return
 	}
+	if err := h.guard.CheckHost(u.Hostname()); err != nil {
+		writeError(w, http.StatusBadRequest, "url "+err.Error())
+		return
+	}
+	if req.RateLimit < 0 {
+		writeError(w, http.StatusBadRequest, "rate_limit must not be negative")
+		return
+	}
+	if req.MessageTTL < 0 {
+		writeError(w, http.StatusBadRequest, "message_ttl must not be negative")
+		return
+	}
+	if reason := validateRetryPolicy(req.RetryPolicy); reason != "" {
+		writeError(w, http.StatusBadRequest, reason)
+		return
+	}
+	if req.MaxConcurrency < 0 {
+		writeError(w, http.StatusBadRequest, "max_concurrency must not be negative")
+		return
+	}
+	if reason := validateBatch(req.Batch); reason != "" {
+		writeError(w, http.StatusBadRequest, reason)
+		return
+	}
+	if !models.RedirectPolicy(req.RedirectPolicy).Valid() {
+		writeError(w, http.StatusBadRequest, "redirect_policy must be follow, no-follow or same-host")
+		return
+	}
 
 	now := time.Now().UTC()
 	ep := &models.Endpoint{
-		ID:          models.NewID("ep"),
-		AppID:       app.ID,
-		URL:         req.URL,
-		Description: req.Description,
-		Secret:      models.NewSecret(),
-		EventTypes:  req.EventTypes,
-		RateLimit:   req.RateLimit,
-		Metadata:    req.Metadata,
-		Active:      true,
-		CreatedAt:   now,
-		UpdatedAt:   now,
+		ID:             models.NewID("ep"),
+		AppID:          app.ID,
+		URL:            req.URL,
+		Description:    req.Description,
+		Secret:         models.NewSecret(),
+		EventTypes:     req.EventTypes,
+		RateLimit:      req.RateLimit,
+		MessageTTL:     req.MessageTTL,
+		RetryPolicy:    req.RetryPolicy,
+		MaxConcurrency: req.MaxConcurrency,
+		FIFO:           req.FIFO,
+		Batch:          req.Batch,
+		RedirectPolicy: models.RedirectPolicy(req.RedirectPolicy),
+		Metadata:       req.Metadata,
+		Active:         true,
+		CreatedAt:      now,
+		UpdatedAt:      now,
 	}
 	if ep.EventTypes == nil {
 		ep.EventTypes = []string{}
@@ -79,17 +130,15 @@ func (h *EndpointHandler) Create(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *EndpointHandler) Get(w http.ResponseWriter, r *http.Request) {
-	id := chi.URLParam(r, "id")
-	ep, err := h.store.GetEndpoint(r.Context(), id)
-	if err != nil {
-		writeError(w, http.StatusInternalServerError, "failed to get endpoint")
-		return
-	}
-	if ep == nil {
-		writeError(w, http.StatusNotFound, "endpoint not found")
+	ep, ok := h.ownedEndpoint(w, r)
+	if !ok {
 		return
 	}
-	writeJSON(w, http.StatusOK, ep)
+	writeJSON(w, http.StatusOK, endpointResponse{
+		Endpoint: ep,
+		Circuit:  h.circuits.Status(ep.ID),
+		Health:   h.bulkhead.Status(ep.ID),
+	})
 }
 
 func (h *EndpointHandler) List(w http.ResponseWriter, r *http.Request) {
@@ -111,22 +160,22 @@ func (h *EndpointHandler) List(w http.ResponseWriter, r *http.Request) {
 }
 
 type updateEndpointRequest struct {
-	URL         string            `json:"url"`
-	Description string            `json:"description"`
-	EventTypes  []string          `json:"event_types"`
-	RateLimit   int               `json:"rate_limit"`
-	Metadata    map[string]string `json:"metadata"`
+	URL            string              `json:"url"`
+	Description    string              `json:"description"`
+	EventTypes     []string            `json:"event_types"`
+	RateLimit      int                 `json:"rate_limit"`
+	MessageTTL     models.Duration     `json:"message_ttl"`
+	RetryPolicy    *models.RetryPolicy `json:"retry_policy"`
+	MaxConcurrency int                 `json:"max_concurrency"`
+	FIFO           bool                `json:"fifo"`
+	Batch          *models.BatchPolicy `json:"batch"`
+	RedirectPolicy string              `json:"redirect_policy"`
+	Metadata       map[string]string   `json:"metadata"`
 }
 
 func (h *EndpointHandler) Update(w http.ResponseWriter, r *http.Request) {
-	id := chi.URLParam(r, "id")
-	ep, err := h.store.GetEndpoint(r.Context(), id)
-	if err != nil {
-		writeError(w, http.StatusInternalServerError, "failed to get endpoint")
-		return
-	}
-	if ep == nil {
-		writeError(w, http.StatusNotFound, "endpoint not found")
+	ep, ok := h.ownedEndpoint(w, r)
+	if !ok {
 		return
 	}
 
@@ -142,13 +191,50 @@ func (h *EndpointHandler) Update(w http.ResponseWriter, r *http.Request) {
 			writeError(w, http.StatusBadRequest, "url must be a valid HTTP or HTTPS URL")
 			return
 		}
+		if err := h.guard.CheckHost(u.Hostname()); err != nil {
+			writeError(w, http.StatusBadRequest, "url "+err.Error())
+			return
+		}
+		if req.URL != ep.URL {
+			ep.SuggestedURL = ""
+		}
 		ep.URL = req.URL
 	}
+	if req.RateLimit < 0 {
+		writeError(w, http.StatusBadRequest, "rate_limit must not be negative")
+		return
+	}
+	if req.MessageTTL < 0 {
+		writeError(w, http.StatusBadRequest, "message_ttl must not be negative")
+		return
+	}
+	if reason := validateRetryPolicy(req.RetryPolicy); reason != "" {
+		writeError(w, http.StatusBadRequest, reason)
+		return
+	}
+	if req.MaxConcurrency < 0 {
+		writeError(w, http.StatusBadRequest, "max_concurrency must not be negative")
+		return
+	}
+	if reason := validateBatch(req.Batch); reason != "" {
+		writeError(w, http.StatusBadRequest, reason)
+		return
+	}
+	if !models.RedirectPolicy(req.RedirectPolicy).Valid() {
+		writeError(w, http.StatusBadRequest, "redirect_policy must be follow, no-follow or same-host")
+		return
+	}
 	ep.Description = req.Description
 	if req.EventTypes != nil {
 		ep.EventTypes = req.EventTypes
 	}
 	ep.RateLimit = req.RateLimit
+	ep.MessageTTL = req.MessageTTL
+	ep.RetryPolicy = req.RetryPolicy
+	ep.MaxConcurrency = req.MaxConcurrency
+	ep.FIFO = req.FIFO
+	ep.Batch = req.Batch
+	ep.RedirectPolicy = models.RedirectPolicy(req.RedirectPolicy)
 	if req.Metadata != nil {
 		ep.Metadata = req.Metadata
 	}
@@ -162,18 +248,12 @@ func (h *EndpointHandler) Update(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *EndpointHandler) Delete(w http.ResponseWriter, r *http.Request) {
-	id := chi.URLParam(r, "id")
-	ep, err := h.store.GetEndpoint(r.Context(), id)
-	if err != nil {
-		writeError(w, http.StatusInternalServerError, "failed to get endpoint")
-		return
-	}
-	if ep == nil {
-		writeError(w, http.StatusNotFound, "endpoint not found")
+	ep, ok := h.ownedEndpoint(w, r)
+	if !ok {
 		return
 	}
 
-	if err := h.store.DeleteEndpoint(r.Context(), id); err != nil {
+	if err := h.store.DeleteEndpoint(r.Context(), ep.ID); err != nil {
 		writeError(w, http.StatusInternalServerError, "failed to delete endpoint")
 		return
 	}
@@ -181,38 +261,119 @@ func (h *EndpointHandler) Delete(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *EndpointHandler) Toggle(w http.ResponseWriter, r *http.Request) {
-	id := chi.URLParam(r, "id")
-	ep, err := h.store.GetEndpoint(r.Context(), id)
-	if err != nil {
-		writeError(w, http.StatusInternalServerError, "failed to get endpoint")
-		return
-	}
-	if ep == nil {
-		writeError(w, http.StatusNotFound, "endpoint not found")
+	ep, ok := h.ownedEndpoint(w, r)
+	if !ok {
 		return
 	}
 
 	newActive := !ep.Active
-	if err := h.store.ToggleEndpoint(r.Context(), id, newActive); err != nil {
+	if err := h.store.ToggleEndpoint(r.Context(), ep.ID, newActive); err != nil {
 		writeError(w, http.StatusInternalServerError, "failed to toggle endpoint")
 		return
 	}
 
+	if newActive {
+		h.circuits.Reset(ep.ID)
+	}
+
 	ep.Active = newActive
+	ep.DisabledReason = ""
+	ep.DisabledAt = nil
 	writeJSON(w, http.StatusOK, ep)
 }
 
 func (h *EndpointHandler) Stats(w http.ResponseWriter, r *http.Request) {
-	app := AppFromContext(r.Context())
-	if app == nil {
-		writeError(w, http.StatusUnauthorized, "unauthorized")
+	ep, ok := h.ownedEndpoint(w, r)
+	if !ok {
 		return
 	}
 
-	stats, err := h.store.GetStats(r.Context(), app.ID)
+	stats, err := h.store.GetStats(r.Context(), ep.AppID)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, "failed to get stats")
 		return
 	}
 	writeJSON(w, http.StatusOK, stats)
 }
+
+// ownedEndpoint loads the endpoint named in the URL and checks that it
+// belongs to the authenticated application. Another application's endpoint
+// is reported as not found so IDs cannot be probed across tenants. When ok
+// is false the error response has already been written.
+func (h *EndpointHandler) ownedEndpoint(w http.ResponseWriter, r *http.Request) (*models.Endpoint, bool) {
+	app := AppFromContext(r.Context())
+	if app == nil {
+		writeError(w, http.StatusUnauthorized, "unauthorized")
+		return nil, false
+	}
+
+	ep, err := h.store.GetEndpoint(r.Context(), chi.URLParam(r, "id"))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to get endpoint")
+		return nil, false
+	}
+	if ep == nil || ep.AppID != app.ID {
+		writeError(w, http.StatusNotFound, "endpoint not found")
+		return nil, false
+	}
+	return ep, true
+}
+
+// maxRetryAttempts bounds max_attempts and the length of a retry schedule.
+const maxRetryAttempts = 100
+
+// validateRetryPolicy returns why p is unusable, or "" if it is fine. A nil
+// policy is fine: it inherits.
+func validateRetryPolicy(p *models.RetryPolicy) string {
+	if p == nil {
+		return ""
+	}
+	switch {
+	case p.MaxAttempts < 0 || p.MaxAttempts > maxRetryAttempts:
+		return fmt.Sprintf("retry_policy.max_attempts must be between 0 and %d", maxRetryAttempts)
+	case len(p.Schedule) > 0 && p.Base != 0:
+		return "retry_policy.schedule and retry_policy.base are mutually exclusive"
+	case len(p.Schedule) > maxRetryAttempts:
+		return fmt.Sprintf("retry_policy.schedule must have at most %d entries", maxRetryAttempts)
+	case p.Base < 0:
+		return "retry_policy.base must not be negative"
+	case p.Base == 0 && (p.Cap != 0 || p.Jitter != 0):
+		return "retry_policy.cap and retry_policy.jitter require retry_policy.base"
+	case p.Cap != 0 && p.Cap < p.Base:
+		return "retry_policy.cap must not be less than retry_policy.base"
+	case p.Jitter < 0 || p.Jitter > 1:
+		return "retry_policy.jitter must be between 0 and 1"
+	case p.MaxAge < 0:
+		return "retry_policy.max_age must not be negative"
+	}
+	for _, d := range p.Schedule {
+		if d <= 0 {
+			return "retry_policy.schedule entries must be positive durations"
+		}
+	}
+	return ""
+}
+
+// Bounds on an endpoint's batch policy.
+const (
+	maxBatchSize   = 1000
+	minBatchBytes  = 1024
+	maxBatchLinger = time.Minute
+)
+
+// validateBatch returns why b is unusable, or "" if it is fine. A nil
+// policy turns batching off.
+func validateBatch(b *models.BatchPolicy) string {
+	if b == nil {
+		return ""
+	}
+	switch {
+	case b.MaxSize < 1 || b.MaxSize > maxBatchSize:
+		return fmt.Sprintf("batch.max_size must be between 1 and %d", maxBatchSize)
+	case b.MaxBytes != 0 && b.MaxBytes < minBatchBytes:
+		return fmt.Sprintf("batch.max_bytes must be 0 or at least %d", minBatchBytes)
+	case b.Linger < 0 || time.Duration(b.Linger) > maxBatchLinger:
+		return fmt.Sprintf("batch.linger must be between 0 and %s", maxBatchLinger)
+	}
+	return ""
+}
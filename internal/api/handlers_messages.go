@@ -1,30 +1,64 @@
 package api
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
 	"strconv"
 	"time"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/shohag/piperelay/internal/config"
+	"github.com/shohag/piperelay/internal/delivery"
 	"github.com/shohag/piperelay/internal/models"
 	"github.com/shohag/piperelay/internal/storage"
 )
 
 type MessageHandler struct {
-	store storage.Storage
+	store    storage.Storage
+	cfg      config.MessagesConfig
+	policy   models.RetryPolicy
+	notifier *delivery.Notifier
 }
 
-func NewMessageHandler(store storage.Storage) *MessageHandler {
-	return &MessageHandler{store: store}
+// NewMessageHandler creates a message handler. policy is the server-wide
+// retry policy that application and endpoint policies are layered over.
+// notifier is signalled whenever new deliveries are stored.
+func NewMessageHandler(store storage.Storage, cfg config.MessagesConfig, policy models.RetryPolicy, notifier *delivery.Notifier) *MessageHandler {
+	return &MessageHandler{store: store, cfg: cfg, policy: policy, notifier: notifier}
 }
 
 type sendMessageRequest struct {
-	EventType string          `json:"event_type"`
-	Payload   json.RawMessage `json:"payload"`
+	EventType      string          `json:"event_type"`
+	Payload        json.RawMessage `json:"payload"`
+	IdempotencyKey string          `json:"idempotency_key"`
+	// DeliverAt or Delay (a Go duration such as "15m" or "72h") schedule the
+	// message for later; at most one may be given.
+	DeliverAt *time.Time `json:"deliver_at"`
+	Delay     string     `json:"delay"`
+	// ExpiresAt or TTL (a duration counted from when the message is due)
+	// stop delivery of a message that is no longer useful; at most one may
+	// be given.
+	ExpiresAt *time.Time `json:"expires_at"`
+	TTL       string     `json:"ttl"`
+	// Priority is "high", "normal" or "low"; empty uses the application's
+	// default for the event type.
+	Priority string `json:"priority"`
+	// OrderingKey groups messages, such as all events of one order, that
+	// endpoints in FIFO mode must receive one at a time and in sequence.
+	OrderingKey string `json:"ordering_key"`
 }
 
-const maxPayloadSize = 256 * 1024 // 256KB
+const (
+	maxPayloadSize        = 256 * 1024 // 256KB
+	maxIdempotencyKeySize = 255
+	maxOrderingKeySize    = 255
+)
 
 func (h *MessageHandler) Send(w http.ResponseWriter, r *http.Request) {
 	app := AppFromContext(r.Context())
@@ -39,72 +73,482 @@ func (h *MessageHandler) Send(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusBadRequest, "invalid request body")
 		return
 	}
-	if req.EventType == "" {
-		writeError(w, http.StatusBadRequest, "event_type is required")
+	if key := r.Header.Get("Idempotency-Key"); key != "" {
+		req.IdempotencyKey = key
+	}
+	if reason := req.validate(); reason != "" {
+		writeError(w, http.StatusBadRequest, reason)
 		return
 	}
-	if len(req.Payload) == 0 {
-		writeError(w, http.StatusBadRequest, "payload is required")
+
+	// Find matching endpoints and create deliveries
+	endpoints, err := h.store.GetEndpointsByEventType(r.Context(), app.ID, req.EventType)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to find endpoints")
 		return
 	}
+	batch := []storage.MessageWithDeliveries{h.newMessage(app, req, endpoints, time.Now().UTC())}
+	if err := h.store.CreateMessagesWithDeliveries(r.Context(), batch); err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to create message")
+		return
+	}
+	out := batch[0]
+	if out.ReplayOf != "" {
+		h.replay(w, r, out.ReplayOf)
+		return
+	}
+	h.announce(out)
+	h.fillBatches(r.Context(), endpoints)
 
-	now := time.Now().UTC()
-	msg := &models.Message{
-		ID:        models.NewID("msg"),
-		AppID:     app.ID,
-		EventType: req.EventType,
-		Payload:   req.Payload,
-		CreatedAt: now,
+	writeJSON(w, http.StatusAccepted, map[string]interface{}{
+		"message":    out.Message,
+		"deliveries": len(out.Deliveries),
+	})
+}
+
+type batchSendRequest struct {
+	Messages []sendMessageRequest `json:"messages"`
+}
+
+// Batch accepts several messages in one request. Each is validated on its
+// own and reported in results; the valid ones are persisted together in one
+// transaction.
+func (h *MessageHandler) Batch(w http.ResponseWriter, r *http.Request) {
+	app := AppFromContext(r.Context())
+	if app == nil {
+		writeError(w, http.StatusUnauthorized, "unauthorized")
+		return
 	}
 
-	if err := h.store.CreateMessage(r.Context(), msg); err != nil {
-		writeError(w, http.StatusInternalServerError, "failed to create message")
+	r.Body = http.MaxBytesReader(w, r.Body, h.cfg.BatchMaxBytes)
+	var req batchSendRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("batch must be at most %d bytes", h.cfg.BatchMaxBytes))
+			return
+		}
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	if len(req.Messages) == 0 {
+		writeError(w, http.StatusBadRequest, "messages is required")
+		return
+	}
+	if len(req.Messages) > h.cfg.BatchMaxItems {
+		writeError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("batch must contain at most %d messages", h.cfg.BatchMaxItems))
 		return
 	}
 
-	// Find matching endpoints and create deliveries
-	endpoints, err := h.store.GetEndpointsByEventType(r.Context(), app.ID, req.EventType)
+	in := h.newIngester(app)
+	results := make([]batchSendResult, len(req.Messages))
+	for i, item := range req.Messages {
+		reason, err := in.add(r.Context(), i, item)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "failed to create messages")
+			return
+		}
+		results[i] = batchSendResult{Index: i, Error: reason}
+	}
+
+	flushed, err := in.flush(r.Context())
 	if err != nil {
-		writeError(w, http.StatusInternalServerError, "failed to find endpoints")
+		writeError(w, http.StatusInternalServerError, "failed to create messages")
 		return
 	}
+	for _, res := range flushed {
+		results[res.Index] = res
+	}
 
-	deliveries := make([]models.Delivery, 0, len(endpoints))
-	for _, ep := range endpoints {
-		d := models.Delivery{
-			ID:         models.NewID("dlv"),
-			MessageID:  msg.ID,
-			EndpointID: ep.ID,
-			Status:     models.DeliveryPending,
-			CreatedAt:  now,
-			UpdatedAt:  now,
-		}
-		if err := h.store.CreateDelivery(r.Context(), &d); err != nil {
-			writeError(w, http.StatusInternalServerError, "failed to create delivery")
-			return
+	var accepted, replayed, failed int
+	for _, res := range results {
+		switch {
+		case res.Error != "":
+			failed++
+		case res.Replayed:
+			replayed++
+		default:
+			accepted++
 		}
-		deliveries = append(deliveries, d)
 	}
 
 	writeJSON(w, http.StatusAccepted, map[string]interface{}{
-		"message":    msg,
-		"deliveries": len(deliveries),
+		"accepted": accepted,
+		"replayed": replayed,
+		"failed":   failed,
+		"results":  results,
 	})
 }
 
-func (h *MessageHandler) Get(w http.ResponseWriter, r *http.Request) {
-	id := chi.URLParam(r, "id")
-	msg, err := h.store.GetMessage(r.Context(), id)
+type importError struct {
+	Line  int    `json:"line"`
+	Error string `json:"error"`
+}
+
+type importSummary struct {
+	Lines    int           `json:"lines"` // non-blank lines read
+	Accepted int           `json:"accepted"`
+	Replayed int           `json:"replayed"`
+	Rejected int           `json:"rejected"`
+	Errors   []importError `json:"errors"`
+	// Error is set when the import stopped early; lines before it that
+	// were accepted are stored.
+	Error string `json:"error,omitempty"`
+}
+
+const (
+	// maxImportErrors caps how many rejected lines are itemised in the summary.
+	maxImportErrors = 100
+	// importIdleTimeout is how long an import may go without completing a
+	// chunk before the connection is dropped.
+	importIdleTimeout = 2 * time.Minute
+)
+
+// Import streams newline-delimited JSON send requests from the body. Lines
+// are read and validated one at a time and committed in chunks of
+// messages.import_chunk_size, so a large backfill never sits in memory and
+// the producer is held back while each chunk is written. The response is a
+// summary of accepted and rejected lines.
+func (h *MessageHandler) Import(w http.ResponseWriter, r *http.Request) {
+	app := AppFromContext(r.Context())
+	if app == nil {
+		writeError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+
+	// The server's read and write timeouts are sized for single requests;
+	// keep pushing them out while the upload makes progress.
+	rc := http.NewResponseController(w)
+	extend := func() {
+		deadline := time.Now().Add(importIdleTimeout)
+		rc.SetReadDeadline(deadline)
+		rc.SetWriteDeadline(deadline)
+	}
+	extend()
+
+	in := h.newIngester(app)
+	br := bufio.NewReaderSize(r.Body, maxPayloadSize+4096)
+	summary := importSummary{Errors: []importError{}}
+
+	reject := func(line int, reason string) {
+		summary.Rejected++
+		if len(summary.Errors) < maxImportErrors {
+			summary.Errors = append(summary.Errors, importError{Line: line, Error: reason})
+		}
+	}
+	flush := func() bool {
+		results, err := in.flush(r.Context())
+		if err != nil {
+			summary.Error = "failed to create messages"
+			return false
+		}
+		for _, res := range results {
+			switch {
+			case res.Error != "":
+				reject(res.Index, res.Error)
+			case res.Replayed:
+				summary.Replayed++
+			default:
+				summary.Accepted++
+			}
+		}
+		extend()
+		return true
+	}
+
+	for line := 1; ; line++ {
+		raw, err := readLine(br)
+		if err == io.EOF {
+			break
+		}
+		if err == errLineTooLong {
+			summary.Lines++
+			reject(line, "line exceeds 256KB")
+			continue
+		}
+		if err != nil {
+			summary.Error = "failed to read request body"
+			break
+		}
+		if len(bytes.TrimSpace(raw)) == 0 {
+			continue
+		}
+		summary.Lines++
+
+		var req sendMessageRequest
+		if err := json.Unmarshal(raw, &req); err != nil {
+			reject(line, "invalid JSON")
+			continue
+		}
+
+		reason, err := in.add(r.Context(), line, req)
+		if err != nil {
+			summary.Error = "failed to create messages"
+			break
+		}
+		if reason != "" {
+			reject(line, reason)
+		}
+
+		if len(in.queued) >= h.cfg.ImportChunkSize && !flush() {
+			break
+		}
+	}
+
+	if summary.Error == "" {
+		flush()
+	}
+	if summary.Error != "" {
+		writeJSON(w, http.StatusInternalServerError, summary)
+		return
+	}
+	writeJSON(w, http.StatusOK, summary)
+}
+
+// validate returns why req cannot be accepted, or "" if it can.
+func (req *sendMessageRequest) validate() string {
+	switch {
+	case req.EventType == "":
+		return "event_type is required"
+	case len(req.Payload) == 0:
+		return "payload is required"
+	case len(req.Payload) > maxPayloadSize:
+		return "payload must be at most 256KB"
+	case len(req.IdempotencyKey) > maxIdempotencyKeySize:
+		return "idempotency key must be at most 255 characters"
+	case len(req.OrderingKey) > maxOrderingKeySize:
+		return "ordering_key must be at most 255 characters"
+	case req.DeliverAt != nil && req.Delay != "":
+		return "deliver_at and delay are mutually exclusive"
+	case req.ExpiresAt != nil && req.TTL != "":
+		return "expires_at and ttl are mutually exclusive"
+	}
+	if req.Priority != "" {
+		if _, err := models.ParsePriority(req.Priority); err != nil {
+			return "priority must be high, normal or low"
+		}
+	}
+
+	now := time.Now()
+	deliverAt, err := req.deliverAt(now)
+	if err != nil {
+		return "delay must be a non-negative duration such as 90s, 15m or 24h"
+	}
+	due := dueAt(now, deliverAt)
+	expiresAt, err := req.expiresAt(due)
+	if err != nil {
+		return "ttl must be a positive duration such as 5m or 1h"
+	}
+	if expiresAt != nil && !expiresAt.After(due) {
+		return "expires_at must be later than the time the message is due"
+	}
+	return ""
+}
+
+// deliverAt resolves the requested schedule against now. It returns nil for
+// messages that should go out immediately, including a deliver_at that has
+// already passed.
+func (req *sendMessageRequest) deliverAt(now time.Time) (*time.Time, error) {
+	at := req.DeliverAt
+	if req.Delay != "" {
+		delay, err := time.ParseDuration(req.Delay)
+		if err != nil || delay < 0 {
+			return nil, errors.New("invalid delay")
+		}
+		t := now.Add(delay)
+		at = &t
+	}
+
+	if at == nil || !at.After(now) {
+		return nil, nil
+	}
+	t := at.UTC()
+	return &t, nil
+}
+
+// expiresAt resolves the requested expiry against due, the time the message
+// becomes deliverable. It returns nil for messages that never expire.
+func (req *sendMessageRequest) expiresAt(due time.Time) (*time.Time, error) {
+	if req.TTL != "" {
+		ttl, err := time.ParseDuration(req.TTL)
+		if err != nil || ttl <= 0 {
+			return nil, errors.New("invalid ttl")
+		}
+		t := due.Add(ttl).UTC()
+		return &t, nil
+	}
+	if req.ExpiresAt == nil {
+		return nil, nil
+	}
+	t := req.ExpiresAt.UTC()
+	return &t, nil
+}
+
+// dueAt is when a message scheduled for deliverAt becomes deliverable.
+func dueAt(now time.Time, deliverAt *time.Time) time.Time {
+	if deliverAt != nil {
+		return *deliverAt
+	}
+	return now
+}
+
+// newMessage builds a message and one pending delivery per endpoint, each
+// recording the retry policy in effect for its endpoint. A scheduled
+// message's deliveries are not due until its deliver_at, and those to a
+// batching endpoint wait a further linger for others to join them. req must
+// have passed validate.
+func (h *MessageHandler) newMessage(app *models.Application, req sendMessageRequest, endpoints []models.Endpoint, now time.Time) storage.MessageWithDeliveries {
+	deliverAt, _ := req.deliverAt(now)
+	expiresAt, _ := req.expiresAt(dueAt(now, deliverAt))
+
+	// A delivery one level higher is ranked as if it had been due
+	// PriorityAging earlier, so lower ones wait a bounded time, not forever.
+	priority := app.PriorityFor(req.EventType)
+	if req.Priority != "" {
+		priority, _ = models.ParsePriority(req.Priority)
+	}
+	rankAt := dueAt(now, deliverAt).Add(-time.Duration(priority) * h.cfg.PriorityAging)
+
+	msg := &models.Message{
+		ID:          models.NewID("msg"),
+		AppID:       app.ID,
+		EventType:   req.EventType,
+		Payload:     req.Payload,
+		DeliverAt:   deliverAt,
+		ExpiresAt:   expiresAt,
+		OrderingKey: req.OrderingKey,
+		CreatedAt:   now,
+	}
+
+	deliveries := make([]models.Delivery, 0, len(endpoints))
+	for _, ep := range endpoints {
+		policy := delivery.ResolvePolicy(h.policy, app.RetryPolicy, ep.RetryPolicy)
+		// Only FIFO endpoints hold deliveries back by key.
+		orderingKey := ""
+		if ep.FIFO {
+			orderingKey = req.OrderingKey
+		}
+		var lingerUntil *time.Time
+		if lingers(&ep) {
+			t := dueAt(now, deliverAt).Add(time.Duration(ep.Batch.Linger))
+			lingerUntil = &t
+		}
+		deliveries = append(deliveries, models.Delivery{
+			ID:          models.NewID("dlv"),
+			MessageID:   msg.ID,
+			EndpointID:  ep.ID,
+			Status:      models.DeliveryPending,
+			RetryPolicy: &policy,
+			Priority:    priority,
+			OrderingKey: orderingKey,
+			RankAt:      rankAt,
+			NextRetryAt: deliverAt,
+			LingerUntil: lingerUntil,
+			CreatedAt:   now,
+			UpdatedAt:   now,
+		})
+	}
+	out := storage.MessageWithDeliveries{Message: msg, Deliveries: deliveries}
+	if h.idempotent(req.IdempotencyKey) {
+		out.IdempotencyKey = req.IdempotencyKey
+		out.KeysSince = now.Add(-h.cfg.IdempotencyWindow)
+	}
+	return out
+}
+
+// announce wakes the delivery pool whenever a stored message's deliveries
+// fall due: right away, at its deliver_at if it is scheduled, and after the
+// linger of each batching endpoint.
+func (h *MessageHandler) announce(m storage.MessageWithDeliveries) {
+	seen := make(map[time.Time]bool)
+	for _, d := range m.Deliveries {
+		// A linger runs from when the delivery is due, so it ends later.
+		due := d.NextRetryAt
+		if d.LingerUntil != nil {
+			due = d.LingerUntil
+		}
+		switch {
+		case due == nil:
+			h.notifier.Notify()
+		case !seen[*due]:
+			seen[*due] = true
+			h.notifier.NotifyAt(*due)
+		}
+	}
+}
+
+// lingers reports whether messages for ep wait for others to join a batch.
+func lingers(ep *models.Endpoint) bool {
+	return ep.Batch != nil && ep.Batch.Linger > 0
+}
+
+// fillBatches makes a batch due as soon as enough stored messages are
+// waiting to fill it, instead of after their linger. It counts rows in
+// storage, so a replayed idempotency key adds nothing, and messages that
+// already went out in a batch that lingered out are no longer waiting.
+// Should it fail, the batch only waits out its linger.
+func (h *MessageHandler) fillBatches(ctx context.Context, endpoints []models.Endpoint) {
+	ctx = context.WithoutCancel(ctx)
+	for i := range endpoints {
+		ep := &endpoints[i]
+		if !lingers(ep) {
+			continue
+		}
+		if full, _ := h.store.ReleaseFullBatch(ctx, ep.ID, ep.Batch.MaxSize, time.Duration(ep.Batch.Linger)); full {
+			h.notifier.Notify()
+		}
+	}
+}
+
+func (h *MessageHandler) idempotent(key string) bool {
+	return key != "" && h.cfg.IdempotencyWindow > 0
+}
+
+// replay answers a repeated idempotency key with the message it was first
+// used for, without fanning out again.
+func (h *MessageHandler) replay(w http.ResponseWriter, r *http.Request, messageID string) {
+	msg, deliveries, err := h.replayed(r.Context(), messageID)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, "failed to get message")
 		return
 	}
 	if msg == nil {
-		writeError(w, http.StatusNotFound, "message not found")
+		writeError(w, http.StatusConflict, errKeyMessageGone)
+		return
+	}
+
+	w.Header().Set("Idempotent-Replayed", "true")
+	writeJSON(w, http.StatusAccepted, map[string]interface{}{
+		"message":    msg,
+		"deliveries": deliveries,
+	})
+}
+
+const errKeyMessageGone = "the message this idempotency key was used for has been deleted"
+
+// replayed loads the message a reused idempotency key is bound to and its
+// delivery count. A nil message means retention has deleted it while the
+// key was still within the idempotency window.
+func (h *MessageHandler) replayed(ctx context.Context, messageID string) (*models.Message, int, error) {
+	msg, err := h.store.GetMessage(ctx, messageID)
+	if err != nil || msg == nil {
+		return nil, 0, err
+	}
+
+	deliveries, err := h.store.GetDeliveriesByMessage(ctx, msg.ID)
+	if err != nil {
+		return nil, 0, err
+	}
+	return msg, len(deliveries), nil
+}
+
+func (h *MessageHandler) Get(w http.ResponseWriter, r *http.Request) {
+	msg, ok := h.ownedMessage(w, r)
+	if !ok {
 		return
 	}
 
-	deliveries, err := h.store.GetDeliveriesByMessage(r.Context(), id)
+	deliveries, err := h.store.GetDeliveriesByMessage(r.Context(), msg.ID)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, "failed to get deliveries")
 		return
@@ -140,19 +584,61 @@ func (h *MessageHandler) List(w http.ResponseWriter, r *http.Request) {
 	writeJSON(w, http.StatusOK, msgs)
 }
 
-func (h *MessageHandler) Retry(w http.ResponseWriter, r *http.Request) {
-	id := chi.URLParam(r, "id")
-	msg, err := h.store.GetMessage(r.Context(), id)
+// Scheduled lists messages that are still waiting for their deliver_at.
+func (h *MessageHandler) Scheduled(w http.ResponseWriter, r *http.Request) {
+	app := AppFromContext(r.Context())
+	if app == nil {
+		writeError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+
+	msgs, err := h.store.ListScheduledMessages(r.Context(), app.ID, limit, offset)
 	if err != nil {
-		writeError(w, http.StatusInternalServerError, "failed to get message")
+		writeError(w, http.StatusInternalServerError, "failed to list scheduled messages")
 		return
 	}
-	if msg == nil {
-		writeError(w, http.StatusNotFound, "message not found")
+	if msgs == nil {
+		msgs = []models.Message{}
+	}
+	writeJSON(w, http.StatusOK, msgs)
+}
+
+// Cancel withdraws a scheduled message before it fires.
+func (h *MessageHandler) Cancel(w http.ResponseWriter, r *http.Request) {
+	msg, ok := h.ownedMessage(w, r)
+	if !ok {
+		return
+	}
+	if msg.DeliverAt == nil || !msg.DeliverAt.After(time.Now()) {
+		writeError(w, http.StatusConflict, "message is not scheduled or has already fired")
 		return
 	}
 
-	deliveries, err := h.store.GetDeliveriesByMessage(r.Context(), id)
+	cancelled, err := h.store.CancelScheduledDeliveries(r.Context(), msg.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to cancel message")
+		return
+	}
+	if cancelled > 0 && msg.OrderingKey != "" {
+		// Later messages with the same key may have been waiting on it.
+		h.notifier.Notify()
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"cancelled": cancelled,
+	})
+}
+
+func (h *MessageHandler) Retry(w http.ResponseWriter, r *http.Request) {
+	msg, ok := h.ownedMessage(w, r)
+	if !ok {
+		return
+	}
+
+	deliveries, err := h.store.GetDeliveriesByMessage(r.Context(), msg.ID)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, "failed to get deliveries")
 		return
@@ -170,8 +656,34 @@ func (h *MessageHandler) Retry(w http.ResponseWriter, r *http.Request) {
 			retried++
 		}
 	}
+	if retried > 0 {
+		h.notifier.Notify()
+	}
 
 	writeJSON(w, http.StatusOK, map[string]interface{}{
 		"retried": retried,
 	})
 }
+
+// ownedMessage loads the message named in the URL and checks that it
+// belongs to the authenticated application. Another application's message is
+// reported as not found so IDs cannot be probed across tenants. When ok is
+// false the error response has already been written.
+func (h *MessageHandler) ownedMessage(w http.ResponseWriter, r *http.Request) (*models.Message, bool) {
+	app := AppFromContext(r.Context())
+	if app == nil {
+		writeError(w, http.StatusUnauthorized, "unauthorized")
+		return nil, false
+	}
+
+	msg, err := h.store.GetMessage(r.Context(), chi.URLParam(r, "id"))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to get message")
+		return nil, false
+	}
+	if msg == nil || msg.AppID != app.ID {
+		writeError(w, http.StatusNotFound, "message not found")
+		return nil, false
+	}
+	return msg, true
+}
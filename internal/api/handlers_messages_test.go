@@ -0,0 +1,189 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shohag/piperelay/internal/models"
+	"github.com/shohag/piperelay/internal/storage"
+)
+
+// batchTenant is an application with one endpoint that batches up to three
+// messages, each lingering a minute for the others.
+type batchTenant struct {
+	s   *testServer
+	app models.Application
+	ep  models.Endpoint
+}
+
+func newBatchTenant(s *testServer) *batchTenant {
+	s.t.Helper()
+	bt := &batchTenant{s: s, app: s.createApp("batches")}
+	body := map[string]interface{}{
+		"url":   "https://example.com/batches",
+		"batch": map[string]interface{}{"max_size": 3, "linger": "1m"},
+	}
+	if code := s.do(http.MethodPost, "/api/v1/endpoints", bt.app.APIKey, body, &bt.ep); code != http.StatusCreated {
+		s.t.Fatalf("creating endpoint: status %d", code)
+	}
+	return bt
+}
+
+func (bt *batchTenant) send(key string) {
+	bt.s.t.Helper()
+	msg := map[string]interface{}{"event_type": "order.created", "payload": map[string]string{}, "idempotency_key": key}
+	if code := bt.s.do(http.MethodPost, "/api/v1/messages", bt.app.APIKey, msg, nil); code != http.StatusAccepted {
+		bt.s.t.Fatalf("sending %s: status %d", key, code)
+	}
+}
+
+// due reports whether the endpoint has anything due, which a full batch
+// does right away.
+func (bt *batchTenant) due() bool {
+	bt.s.t.Helper()
+	backlog, err := bt.s.store.DueEndpoints(context.Background(), 10)
+	if err != nil {
+		bt.s.t.Fatal(err)
+	}
+	return len(backlog) > 0
+}
+
+// deliver claims what the pool would for one batch and records it sent.
+func (bt *batchTenant) deliver(want int) {
+	bt.s.t.Helper()
+	ctx := context.Background()
+	ds, err := bt.s.store.ClaimDeliveries(ctx, storage.ClaimOptions{
+		WorkerID:    "worker",
+		Lease:       time.Minute,
+		PerEndpoint: map[string]int{bt.ep.ID: 3},
+		Linger:      map[string]time.Duration{bt.ep.ID: time.Minute},
+	})
+	if err != nil {
+		bt.s.t.Fatal(err)
+	}
+	if len(ds) != want {
+		bt.s.t.Fatalf("claimed a batch of %d, want %d", len(ds), want)
+	}
+	for i := range ds {
+		ds[i].Status = models.DeliverySuccess
+		if err := bt.s.store.UpdateDelivery(ctx, &ds[i]); err != nil {
+			bt.s.t.Fatal(err)
+		}
+	}
+}
+
+func TestBatchFillsFromStoredMessages(t *testing.T) {
+	bt := newBatchTenant(newTestServer(t))
+
+	bt.send("a")
+	bt.send("b")
+	if bt.due() {
+		t.Fatal("two of three messages are due before their linger")
+	}
+	// Retries answered from the idempotency key store nothing.
+	bt.send("a")
+	bt.send("b")
+	if bt.due() {
+		t.Fatal("idempotent replays filled the batch")
+	}
+	bt.send("c")
+	if !bt.due() {
+		t.Fatal("the third message did not release the batch")
+	}
+	bt.deliver(3)
+
+	// A partial batch lingers out and is sent; the next batch starts empty.
+	bt.send("d")
+	bt.send("e")
+	bt.deliver(2)
+	bt.send("f")
+	bt.send("g")
+	if bt.due() {
+		t.Fatal("messages sent in an earlier batch counted towards this one")
+	}
+	bt.send("h")
+	if !bt.due() {
+		t.Fatal("the third message did not release the batch")
+	}
+	bt.deliver(3)
+}
+
+func TestImportFillsBatches(t *testing.T) {
+	s := newTestServer(t)
+	bt := newBatchTenant(s)
+
+	line := func(key string) string {
+		return fmt.Sprintf(`{"event_type": "order.created", "payload": {}, "idempotency_key": %q}`, key)
+	}
+	bt.send("a")
+	summary := s.importNDJSON(bt.app.APIKey, strings.Join([]string{line("a"), line("b"), line("b")}, "\n"))
+	if summary.Accepted != 1 || summary.Replayed != 2 {
+		t.Fatalf("summary = %+v, want 1 accepted and 2 replayed", summary)
+	}
+	if bt.due() {
+		t.Fatal("idempotent replays filled the batch")
+	}
+
+	s.importNDJSON(bt.app.APIKey, line("c"))
+	if !bt.due() {
+		t.Fatal("the imported message did not release the batch")
+	}
+	bt.deliver(3)
+}
+
+// Messages sent in one batch share a created_at, and their IDs need not sort
+// in the order they were sent; a FIFO endpoint must still get them in that
+// order.
+func TestBatchKeepsKeyOrder(t *testing.T) {
+	s := newTestServer(t)
+	ctx := context.Background()
+	app := s.createApp("orders")
+	var ep models.Endpoint
+	if code := s.do(http.MethodPost, "/api/v1/endpoints", app.APIKey, map[string]interface{}{"url": "https://example.com/orders", "fifo": true}, &ep); code != http.StatusCreated {
+		t.Fatalf("creating endpoint: status %d", code)
+	}
+
+	const n = 50
+	batch := make([]map[string]interface{}, n)
+	for i := range batch {
+		batch[i] = map[string]interface{}{"event_type": "order.updated", "payload": map[string]int{"n": i}, "ordering_key": "order-1"}
+	}
+	if code := s.do(http.MethodPost, "/api/v1/messages/batch", app.APIKey, map[string]interface{}{"messages": batch}, nil); code != http.StatusAccepted {
+		t.Fatalf("sending batch: status %d", code)
+	}
+
+	for want := 0; want < n; want++ {
+		ds, err := s.store.ClaimDeliveries(ctx, storage.ClaimOptions{
+			WorkerID:    "worker",
+			Lease:       time.Minute,
+			PerEndpoint: map[string]int{ep.ID: n},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ds) != 1 {
+			t.Fatalf("claim %d got %d deliveries, want 1 at a time", want, len(ds))
+		}
+		msg, err := s.store.GetMessage(ctx, ds[0].MessageID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var payload struct{ N int }
+		if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+			t.Fatal(err)
+		}
+		if payload.N != want {
+			t.Fatalf("claim %d delivered message %d", want, payload.N)
+		}
+
+		ds[0].Status = models.DeliverySuccess
+		if err := s.store.UpdateDelivery(ctx, &ds[0]); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -3,15 +3,29 @@ package api
 import (
 	"net/http"
 
+	"github.com/shohag/piperelay/internal/delivery"
 	"github.com/shohag/piperelay/internal/storage"
 )
 
 type StatsHandler struct {
-	store storage.Storage
+	store    storage.Storage
+	bulkhead *delivery.Bulkhead
 }
 
-func NewStatsHandler(store storage.Storage) *StatsHandler {
-	return &StatsHandler{store: store}
+func NewStatsHandler(store storage.Storage, bulkhead *delivery.Bulkhead) *StatsHandler {
+	return &StatsHandler{store: store, bulkhead: bulkhead}
+}
+
+type statsResponse struct {
+	*storage.Stats
+	Lanes map[delivery.Lane]laneStats `json:"lanes"`
+}
+
+// laneStats is a lane's size and load across the whole process, with the
+// caller's own endpoints that are currently in it.
+type laneStats struct {
+	delivery.LaneStatus
+	Endpoints []string `json:"endpoints"`
 }
 
 func (h *StatsHandler) Health(w http.ResponseWriter, r *http.Request) {
@@ -33,5 +47,22 @@ func (h *StatsHandler) Stats(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusInternalServerError, "failed to get stats")
 		return
 	}
-	writeJSON(w, http.StatusOK, stats)
+	endpoints, err := h.store.ListEndpoints(r.Context(), app.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to get stats")
+		return
+	}
+
+	lanes := make(map[delivery.Lane]laneStats)
+	for lane, status := range h.bulkhead.Lanes() {
+		lanes[lane] = laneStats{LaneStatus: status, Endpoints: []string{}}
+	}
+	for _, ep := range endpoints {
+		lane := h.bulkhead.Lane(ep.ID)
+		ls := lanes[lane]
+		ls.Endpoints = append(ls.Endpoints, ep.ID)
+		lanes[lane] = ls
+	}
+
+	writeJSON(w, http.StatusOK, statsResponse{Stats: stats, Lanes: lanes})
 }
@@ -0,0 +1,181 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/shohag/piperelay/internal/models"
+	"github.com/shohag/piperelay/internal/storage"
+)
+
+type batchSendResult struct {
+	Index      int    `json:"index"`
+	MessageID  string `json:"message_id,omitempty"`
+	Deliveries int    `json:"deliveries"`
+	Replayed   bool   `json:"replayed,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// ingester turns send requests for one application into messages that are
+// persisted together by flush. It is shared by the batch and import
+// endpoints: endpoint lookups are cached per event type, and idempotency
+// keys are remembered until their chunk is flushed, so a key repeated before
+// then resolves to the message it was first used for. After a flush the
+// idempotency_keys table does the same, so an import of any length holds
+// only one chunk's keys.
+type ingester struct {
+	h         *MessageHandler
+	app       *models.Application
+	endpoints map[string][]models.Endpoint
+	keys      map[string]int // pending index of each key's first use
+	queued    []queued
+	pending   []storage.MessageWithDeliveries
+	batching  map[string]models.Endpoint // lingering endpoints of pending
+}
+
+// queued is a request accepted by add whose outcome flush reports: the
+// pending message it is stored as, or, for a repeated key, the one it
+// repeats.
+type queued struct {
+	index   int
+	pending int
+	repeat  bool
+}
+
+func (h *MessageHandler) newIngester(app *models.Application) *ingester {
+	return &ingester{
+		h:         h,
+		app:       app,
+		endpoints: make(map[string][]models.Endpoint),
+		keys:      make(map[string]int),
+		batching:  make(map[string]models.Endpoint),
+	}
+}
+
+// add validates the request at index and queues its message. It returns
+// why a request was rejected, if it was; the error is reserved for storage
+// failures, after which the caller should abort.
+func (in *ingester) add(ctx context.Context, index int, req sendMessageRequest) (string, error) {
+	if reason := req.validate(); reason != "" {
+		return reason, nil
+	}
+
+	idempotent := in.h.idempotent(req.IdempotencyKey)
+	if idempotent {
+		if first, ok := in.keys[req.IdempotencyKey]; ok {
+			in.queued = append(in.queued, queued{index: index, pending: first, repeat: true})
+			return "", nil
+		}
+	}
+
+	eps, ok := in.endpoints[req.EventType]
+	if !ok {
+		var err error
+		eps, err = in.h.store.GetEndpointsByEventType(ctx, in.app.ID, req.EventType)
+		if err != nil {
+			return "", err
+		}
+		in.endpoints[req.EventType] = eps
+	}
+
+	if idempotent {
+		in.keys[req.IdempotencyKey] = len(in.pending)
+	}
+	in.queued = append(in.queued, queued{index: index, pending: len(in.pending)})
+	in.pending = append(in.pending, in.h.newMessage(in.app, req, eps, time.Now().UTC()))
+	for _, ep := range eps {
+		if lingers(&ep) {
+			in.batching[ep.ID] = ep
+		}
+	}
+	return "", nil
+}
+
+// flush persists every queued message in one transaction and reports the
+// outcome of each queued request. A message whose idempotency key turns out
+// to be bound already is answered with the message it is bound to.
+func (in *ingester) flush(ctx context.Context) ([]batchSendResult, error) {
+	if len(in.queued) == 0 {
+		return nil, nil
+	}
+	defer in.abort()
+
+	if err := in.h.store.CreateMessagesWithDeliveries(ctx, in.pending); err != nil {
+		return nil, err
+	}
+	for _, m := range in.pending {
+		if m.ReplayOf == "" {
+			in.h.announce(m)
+		}
+	}
+	batching := make([]models.Endpoint, 0, len(in.batching))
+	for _, ep := range in.batching {
+		batching = append(batching, ep)
+	}
+	in.h.fillBatches(ctx, batching)
+
+	stored := make([]batchSendResult, len(in.pending))
+	for i, m := range in.pending {
+		if m.ReplayOf == "" {
+			stored[i] = batchSendResult{MessageID: m.Message.ID, Deliveries: len(m.Deliveries)}
+			continue
+		}
+		// The chunk is committed by now, so a failed lookup only fails the
+		// one result instead of the whole flush.
+		msg, n, err := in.h.replayed(ctx, m.ReplayOf)
+		switch {
+		case err != nil:
+			stored[i] = batchSendResult{Error: "failed to get message"}
+		case msg == nil:
+			stored[i] = batchSendResult{Error: errKeyMessageGone}
+		default:
+			stored[i] = batchSendResult{MessageID: msg.ID, Deliveries: n, Replayed: true}
+		}
+	}
+
+	results := make([]batchSendResult, len(in.queued))
+	for i, q := range in.queued {
+		res := stored[q.pending]
+		res.Index = q.index
+		if q.repeat && res.Error == "" {
+			res.Replayed = true
+		}
+		results[i] = res
+	}
+	return results, nil
+}
+
+// abort drops everything queued since the last flush.
+func (in *ingester) abort() {
+	in.queued, in.pending = in.queued[:0], in.pending[:0]
+	clear(in.keys)
+	clear(in.batching)
+}
+
+var errLineTooLong = errors.New("line too long")
+
+// readLine returns the next line from br without its line ending. The slice
+// is only valid until the next read. A line longer than br's buffer is
+// skipped and reported as errLineTooLong, so one bad record does not end the
+// stream. It returns io.EOF after the last line.
+func readLine(br *bufio.Reader) ([]byte, error) {
+	line, err := br.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		for err == bufio.ErrBufferFull {
+			_, err = br.ReadSlice('\n')
+		}
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		return nil, errLineTooLong
+	}
+	if err != nil && (err != io.EOF || len(line) == 0) {
+		return nil, err
+	}
+
+	return bytes.TrimRight(line, "\r\n"), nil
+}
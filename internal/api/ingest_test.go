@@ -0,0 +1,95 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/shohag/piperelay/internal/delivery"
+)
+
+func (s *testServer) importNDJSON(token, body string) importSummary {
+	s.t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/messages/import", strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	rec := httptest.NewRecorder()
+	s.handler.ServeHTTP(rec, req)
+
+	var summary importSummary
+	if err := json.Unmarshal(rec.Body.Bytes(), &summary); err != nil {
+		s.t.Fatalf("decoding %q: %v", rec.Body.String(), err)
+	}
+	if rec.Code != http.StatusOK {
+		s.t.Fatalf("import: status %d: %+v", rec.Code, summary)
+	}
+	return summary
+}
+
+func TestImportDeduplicatesKeysAcrossChunks(t *testing.T) {
+	s := newTestServer(t) // commits every 10 messages
+	tn := s.createTenant("alice")
+
+	keys := map[int]string{
+		1:  "first",
+		5:  "same-chunk",
+		6:  "same-chunk", // repeats line 5 before it is committed
+		23: "first",      // repeats line 1 two chunks later
+	}
+	var body strings.Builder
+	for line := 1; line <= 25; line++ {
+		fmt.Fprintf(&body, `{"event_type":"order.created","payload":{"line":%d},"idempotency_key":%q}`+"\n", line, keys[line])
+	}
+
+	summary := s.importNDJSON(tn.app.APIKey, body.String())
+	if summary.Lines != 25 || summary.Accepted != 23 || summary.Replayed != 2 || summary.Rejected != 0 {
+		t.Fatalf("summary = %+v, want 25 lines, 23 accepted, 2 replayed", summary)
+	}
+
+	msgs, err := s.store.ListMessages(context.Background(), tn.app.ID, 100, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// createTenant sent one message of its own.
+	if len(msgs) != 24 {
+		t.Fatalf("stored %d messages, want 24", len(msgs))
+	}
+}
+
+func TestIngesterForgetsKeysOnceFlushed(t *testing.T) {
+	s := newTestServer(t)
+	tn := s.createTenant("alice")
+	ctx := context.Background()
+
+	h := NewMessageHandler(s.store, s.srv.cfg.Messages, delivery.DefaultPolicy(s.srv.cfg.Delivery), s.srv.pool.Notifier())
+	in := h.newIngester(&tn.app)
+	for i := 0; i < 5; i++ {
+		req := sendMessageRequest{EventType: "order.created", Payload: json.RawMessage(`{}`), IdempotencyKey: fmt.Sprintf("key-%d", i)}
+		if reason, err := in.add(ctx, i, req); err != nil || reason != "" {
+			t.Fatalf("add %d = %q, %v", i, reason, err)
+		}
+	}
+	if len(in.keys) != 5 {
+		t.Fatalf("remembering %d keys before the flush, want 5", len(in.keys))
+	}
+
+	if _, err := in.flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(in.keys) != 0 {
+		t.Fatalf("remembering %d keys after the flush, want none", len(in.keys))
+	}
+
+	// The committed key still resolves to its message.
+	if _, err := in.add(ctx, 0, sendMessageRequest{EventType: "order.created", Payload: json.RawMessage(`{}`), IdempotencyKey: "key-0"}); err != nil {
+		t.Fatal(err)
+	}
+	results, err := in.flush(ctx)
+	if err != nil || len(results) != 1 || !results[0].Replayed {
+		t.Fatalf("repeated key = %+v, %v; want it replayed", results, err)
+	}
+}
@@ -2,6 +2,8 @@ package api
 
 import (
 	"context"
+	"crypto/sha256"
+	"crypto/subtle"
 	"net/http"
 	"strings"
 	"time"
@@ -51,6 +53,61 @@ func AuthMiddleware(store storage.Storage) func(http.Handler) http.Handler {
 	}
 }
 
+// AdminAuthMiddleware guards the admin routes with the configured admin
+// tokens. With no tokens configured (insecure mode) requests pass through.
+func AdminAuthMiddleware(creds map[string]string, log zerolog.Logger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if len(creds) == 0 {
+			return next
+		}
+
+		// Tokens are compared as SHA-256 digests, which all have the same
+		// length: ConstantTimeCompare returns early on a length mismatch.
+		type admin struct {
+			name   string
+			digest [sha256.Size]byte
+		}
+		admins := make([]admin, 0, len(creds))
+		for n, t := range creds {
+			admins = append(admins, admin{name: n, digest: sha256.Sum256([]byte(t))})
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			auth := r.Header.Get("Authorization")
+			if auth == "" {
+				writeError(w, http.StatusUnauthorized, "missing authorization header")
+				return
+			}
+
+			token := strings.TrimPrefix(auth, "Bearer ")
+			if token == auth {
+				writeError(w, http.StatusUnauthorized, "invalid authorization format, use: Bearer <admin_token>")
+				return
+			}
+
+			// Compare against every token, without branching on the
+			// result, so timing reveals neither which one matched nor how
+			// much of it.
+			presented := sha256.Sum256([]byte(token))
+			match := -1
+			for i, a := range admins {
+				match = subtle.ConstantTimeSelect(subtle.ConstantTimeCompare(presented[:], a.digest[:]), i, match)
+			}
+			if match < 0 {
+				writeError(w, http.StatusUnauthorized, "invalid admin token")
+				return
+			}
+
+			log.Info().
+				Str("admin", admins[match].name).
+				Str("method", r.Method).
+				Str("path", r.URL.Path).
+				Msg("admin request")
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
 func LoggingMiddleware(log zerolog.Logger) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -77,3 +134,8 @@ func (rw *responseWriter) WriteHeader(code int) {
 	rw.statusCode = code
 	rw.ResponseWriter.WriteHeader(code)
 }
+
+// Unwrap lets http.ResponseController reach the underlying connection.
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
@@ -0,0 +1,67 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/rs/zerolog"
+)
+
+func TestAdminAuthMiddleware(t *testing.T) {
+	creds := map[string]string{
+		"default": "s3cret-token",
+		"ops":     "another-much-longer-admin-token",
+	}
+
+	var admitted int
+	handler := AdminAuthMiddleware(creds, zerolog.Nop())(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		admitted++
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	tests := []struct {
+		name   string
+		header string
+		want   int
+	}{
+		{"first token", "Bearer s3cret-token", http.StatusNoContent},
+		{"second token", "Bearer another-much-longer-admin-token", http.StatusNoContent},
+		{"wrong token", "Bearer s3cret-tokem", http.StatusUnauthorized},
+		{"prefix of a token", "Bearer s3cret", http.StatusUnauthorized},
+		{"token with a suffix", "Bearer s3cret-token-and-more", http.StatusUnauthorized},
+		{"empty token", "Bearer ", http.StatusUnauthorized},
+		{"no scheme", "s3cret-token", http.StatusUnauthorized},
+		{"missing header", "", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			admitted = 0
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/applications", nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.want {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.want)
+			}
+			if reached := admitted == 1; reached != (tt.want == http.StatusNoContent) {
+				t.Fatalf("handler reached = %v", reached)
+			}
+		})
+	}
+}
+
+func TestAdminAuthMiddlewareInsecure(t *testing.T) {
+	handler := AdminAuthMiddleware(nil, zerolog.Nop())(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/applications", nil))
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("status = %d, want requests to pass without credentials", rec.Code)
+	}
+}
@@ -2,6 +2,7 @@ package api
 
 import (
 	"context"
+	"expvar"
 	"fmt"
 	"net/http"
 	"time"
@@ -10,21 +11,24 @@ import (
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/rs/zerolog"
 	"github.com/shohag/piperelay/internal/config"
+	"github.com/shohag/piperelay/internal/delivery"
 	"github.com/shohag/piperelay/internal/storage"
 )
 
 type Server struct {
-	cfg    config.ServerConfig
+	cfg    *config.Config
 	store  storage.Storage
+	pool   *delivery.Pool
 	router *chi.Mux
 	log    zerolog.Logger
 	http   *http.Server
 }
 
-func NewServer(cfg config.ServerConfig, store storage.Storage, log zerolog.Logger) *Server {
+func NewServer(cfg *config.Config, store storage.Storage, pool *delivery.Pool, log zerolog.Logger) *Server {
 	s := &Server{
 		cfg:   cfg,
 		store: store,
+		pool:  pool,
 		log:   log,
 	}
 	s.router = s.buildRouter()
@@ -40,21 +44,34 @@ func (s *Server) buildRouter() *chi.Mux {
 	r.Use(LoggingMiddleware(s.log))
 
 	appHandler := NewApplicationHandler(s.store)
-	epHandler := NewEndpointHandler(s.store)
-	msgHandler := NewMessageHandler(s.store)
+	epHandler := NewEndpointHandler(s.store, s.pool.Circuits(), s.pool.Bulkhead(), s.pool.Guard())
+	msgHandler := NewMessageHandler(s.store, s.cfg.Messages, delivery.DefaultPolicy(s.cfg.Delivery), s.pool.Notifier())
 	dlvHandler := NewDeliveryHandler(s.store)
-	statsHandler := NewStatsHandler(s.store)
+	statsHandler := NewStatsHandler(s.store, s.pool.Bulkhead())
 
 	// Health check — no auth
 	r.Get("/health", statsHandler.Health)
 
+	adminAuth := AdminAuthMiddleware(s.cfg.Admin.Credentials(), s.log)
+	if len(s.cfg.Admin.Credentials()) == 0 {
+		s.log.Warn().Msg("admin routes are unauthenticated (admin.insecure is set)")
+	}
+
+	// Runtime counters, including retention purge totals — admin auth
+	r.With(adminAuth).Handle("/debug/vars", expvar.Handler())
+
 	r.Route("/api/v1", func(r chi.Router) {
-		// Application management — no bearer auth (admin routes)
-		r.Post("/applications", appHandler.Create)
-		r.Get("/applications", appHandler.List)
-		r.Get("/applications/{id}", appHandler.Get)
-		r.Delete("/applications/{id}", appHandler.Delete)
-		r.Post("/applications/{id}/rotate-key", appHandler.RotateKey)
+		// Application management — admin token auth
+		r.Group(func(r chi.Router) {
+			r.Use(adminAuth)
+
+			r.Post("/applications", appHandler.Create)
+			r.Get("/applications", appHandler.List)
+			r.Get("/applications/{id}", appHandler.Get)
+			r.Put("/applications/{id}", appHandler.Update)
+			r.Delete("/applications/{id}", appHandler.Delete)
+			r.Post("/applications/{id}/rotate-key", appHandler.RotateKey)
+		})
 
 		// Authenticated routes
 		r.Group(func(r chi.Router) {
@@ -71,9 +88,13 @@ func (s *Server) buildRouter() *chi.Mux {
 
 			// Messages
 			r.Post("/messages", msgHandler.Send)
+			r.Post("/messages/batch", msgHandler.Batch)
+			r.Post("/messages/import", msgHandler.Import)
 			r.Get("/messages", msgHandler.List)
+			r.Get("/messages/scheduled", msgHandler.Scheduled)
 			r.Get("/messages/{id}", msgHandler.Get)
 			r.Post("/messages/{id}/retry", msgHandler.Retry)
+			r.Post("/messages/{id}/cancel", msgHandler.Cancel)
 
 			// Deliveries
 			r.Get("/deliveries/{id}", dlvHandler.Get)
@@ -88,12 +109,12 @@ func (s *Server) buildRouter() *chi.Mux {
 }
 
 func (s *Server) Start() error {
-	addr := fmt.Sprintf("%s:%d", s.cfg.Host, s.cfg.Port)
+	addr := fmt.Sprintf("%s:%d", s.cfg.Server.Host, s.cfg.Server.Port)
 	s.http = &http.Server{
 		Addr:         addr,
 		Handler:      s.router,
-		ReadTimeout:  s.cfg.ReadTimeout,
-		WriteTimeout: s.cfg.WriteTimeout,
+		ReadTimeout:  s.cfg.Server.ReadTimeout,
+		WriteTimeout: s.cfg.Server.WriteTimeout,
 	}
 
 	s.log.Info().Str("addr", addr).Msg("starting HTTP server")
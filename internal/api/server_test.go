@@ -0,0 +1,130 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/shohag/piperelay/internal/config"
+	"github.com/shohag/piperelay/internal/delivery"
+	"github.com/shohag/piperelay/internal/models"
+	"github.com/shohag/piperelay/internal/storage"
+)
+
+const testAdminToken = "test-admin-token"
+
+// testServer is the full API router on a fresh SQLite database. Its
+// delivery pool is never started, so nothing is sent.
+type testServer struct {
+	t       *testing.T
+	store   storage.Storage
+	srv     *Server
+	handler http.Handler
+}
+
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+	store, err := storage.NewSQLite(filepath.Join(t.TempDir(), "piperelay.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	if err := store.Migrate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &config.Config{
+		Delivery: config.DeliveryConfig{
+			Workers:     1,
+			Timeout:     5 * time.Second,
+			MaxAttempts: 3,
+		},
+		Messages: config.MessagesConfig{
+			IdempotencyWindow: time.Hour,
+			BatchMaxItems:     100,
+			BatchMaxBytes:     1 << 20,
+			ImportChunkSize:   10,
+			PriorityAging:     time.Minute,
+		},
+		Admin: config.AdminConfig{Token: testAdminToken},
+	}
+	srv := NewServer(cfg, store, delivery.NewPool(cfg.Delivery, store, zerolog.Nop()), zerolog.Nop())
+	return &testServer{t: t, store: store, srv: srv, handler: srv.router}
+}
+
+// do sends a request authenticated with token and decodes a JSON response
+// into out, if given.
+func (s *testServer) do(method, path, token string, body, out interface{}) int {
+	s.t.Helper()
+	var buf bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&buf).Encode(body); err != nil {
+			s.t.Fatal(err)
+		}
+	}
+	req := httptest.NewRequest(method, path, &buf)
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	s.handler.ServeHTTP(rec, req)
+
+	if out != nil && rec.Code < 300 {
+		if err := json.Unmarshal(rec.Body.Bytes(), out); err != nil {
+			s.t.Fatalf("%s %s: decoding %q: %v", method, path, rec.Body.String(), err)
+		}
+	}
+	return rec.Code
+}
+
+// createApp creates an application through the admin API and returns it,
+// API key included.
+func (s *testServer) createApp(name string) models.Application {
+	s.t.Helper()
+	var app models.Application
+	if code := s.do(http.MethodPost, "/api/v1/applications", testAdminToken, map[string]string{"name": name}, &app); code != http.StatusCreated {
+		s.t.Fatalf("creating application: status %d", code)
+	}
+	return app
+}
+
+// tenant is one application's resources: an endpoint, a message scheduled
+// for it an hour from now, and that message's delivery.
+type tenant struct {
+	app        models.Application
+	endpointID string
+	messageID  string
+	deliveryID string
+}
+
+func (s *testServer) createTenant(name string) tenant {
+	s.t.Helper()
+	tn := tenant{app: s.createApp(name)}
+
+	var ep models.Endpoint
+	if code := s.do(http.MethodPost, "/api/v1/endpoints", tn.app.APIKey, map[string]string{"url": "https://example.com/" + name}, &ep); code != http.StatusCreated {
+		s.t.Fatalf("creating endpoint: status %d", code)
+	}
+	tn.endpointID = ep.ID
+
+	var sent struct {
+		Message models.Message `json:"message"`
+	}
+	msg := map[string]interface{}{"event_type": "order.created", "payload": map[string]string{"tenant": name}, "delay": "1h"}
+	if code := s.do(http.MethodPost, "/api/v1/messages", tn.app.APIKey, msg, &sent); code != http.StatusAccepted {
+		s.t.Fatalf("sending message: status %d", code)
+	}
+	tn.messageID = sent.Message.ID
+
+	deliveries, err := s.store.GetDeliveriesByMessage(context.Background(), tn.messageID)
+	if err != nil || len(deliveries) != 1 {
+		s.t.Fatalf("deliveries for %s: %d, %v", tn.messageID, len(deliveries), err)
+	}
+	tn.deliveryID = deliveries[0].ID
+	return tn
+}
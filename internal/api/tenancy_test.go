@@ -0,0 +1,136 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/shohag/piperelay/internal/models"
+)
+
+// tenantRoutes are every route addressed by an endpoint, message or
+// delivery ID, with a request body where the route needs one.
+func tenantRoutes(tn tenant) []struct {
+	method, path string
+	body         interface{}
+} {
+	return []struct {
+		method, path string
+		body         interface{}
+	}{
+		{http.MethodGet, "/api/v1/endpoints/" + tn.endpointID, nil},
+		{http.MethodPut, "/api/v1/endpoints/" + tn.endpointID, map[string]string{"url": "https://example.com/hijacked", "description": "hijacked"}},
+		{http.MethodPatch, "/api/v1/endpoints/" + tn.endpointID + "/toggle", nil},
+		{http.MethodGet, "/api/v1/endpoints/" + tn.endpointID + "/stats", nil},
+		{http.MethodDelete, "/api/v1/endpoints/" + tn.endpointID, nil},
+		{http.MethodGet, "/api/v1/messages/" + tn.messageID, nil},
+		{http.MethodPost, "/api/v1/messages/" + tn.messageID + "/retry", nil},
+		{http.MethodPost, "/api/v1/messages/" + tn.messageID + "/cancel", nil},
+		{http.MethodGet, "/api/v1/deliveries/" + tn.deliveryID, nil},
+		{http.MethodGet, "/api/v1/deliveries/" + tn.deliveryID + "/attempts", nil},
+	}
+}
+
+func TestTenantCannotReachAnotherTenantsResources(t *testing.T) {
+	s := newTestServer(t)
+	ctx := context.Background()
+	alice := s.createTenant("alice")
+	bob := s.createTenant("bob")
+
+	// Give alice's delivery an attempt and a failure to retry, so the
+	// attempts and retry routes have something to leak or change.
+	d, err := s.store.GetDelivery(ctx, alice.deliveryID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Status = models.DeliveryFailed
+	d.AttemptCount = 1
+	if err := s.store.UpdateDelivery(ctx, d); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.store.CreateAttempt(ctx, &models.Attempt{
+		ID: models.NewID("att"), DeliveryID: d.ID, AttemptNumber: 1, StatusCode: 500,
+		ResponseBody: "alice's response", CreatedAt: time.Now().UTC().Format(time.RFC3339),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, route := range tenantRoutes(alice) {
+		t.Run(route.method+" "+route.path, func(t *testing.T) {
+			if code := s.do(route.method, route.path, bob.app.APIKey, route.body, nil); code != http.StatusNotFound {
+				t.Fatalf("bob got status %d, want 404", code)
+			}
+		})
+	}
+
+	// None of bob's requests changed anything of alice's.
+	ep, err := s.store.GetEndpoint(ctx, alice.endpointID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ep == nil || !ep.Active || ep.URL != "https://example.com/alice" || ep.Description != "" {
+		t.Fatalf("alice's endpoint changed: %+v", ep)
+	}
+	d, err = s.store.GetDelivery(ctx, alice.deliveryID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Status != models.DeliveryFailed {
+		t.Fatalf("alice's delivery is %s, want it still failed", d.Status)
+	}
+
+	// The same routes work for the owner.
+	for _, route := range tenantRoutes(alice) {
+		if route.method == http.MethodDelete {
+			continue
+		}
+		if code := s.do(route.method, route.path, alice.app.APIKey, route.body, nil); code != http.StatusOK {
+			t.Errorf("alice: %s %s: status %d, want 200", route.method, route.path, code)
+		}
+	}
+}
+
+func TestTenantCannotCancelAnotherTenantsScheduledMessage(t *testing.T) {
+	s := newTestServer(t)
+	alice := s.createTenant("alice")
+	bob := s.createTenant("bob")
+
+	if code := s.do(http.MethodPost, "/api/v1/messages/"+alice.messageID+"/cancel", bob.app.APIKey, nil, nil); code != http.StatusNotFound {
+		t.Fatalf("bob cancelling: status %d, want 404", code)
+	}
+
+	var scheduled []models.Message
+	if code := s.do(http.MethodGet, "/api/v1/messages/scheduled", alice.app.APIKey, nil, &scheduled); code != http.StatusOK {
+		t.Fatalf("listing scheduled: status %d", code)
+	}
+	if len(scheduled) != 1 || scheduled[0].ID != alice.messageID {
+		t.Fatalf("alice's scheduled messages = %+v, want her message still scheduled", scheduled)
+	}
+}
+
+func TestTenantListsOnlyItsOwnResources(t *testing.T) {
+	s := newTestServer(t)
+	alice := s.createTenant("alice")
+	bob := s.createTenant("bob")
+
+	var endpoints []models.Endpoint
+	if code := s.do(http.MethodGet, "/api/v1/endpoints", bob.app.APIKey, nil, &endpoints); code != http.StatusOK {
+		t.Fatalf("listing endpoints: status %d", code)
+	}
+	for _, ep := range endpoints {
+		if ep.ID == alice.endpointID || ep.AppID != bob.app.ID {
+			t.Fatalf("bob's endpoint list includes %s of %s", ep.ID, ep.AppID)
+		}
+	}
+
+	for _, path := range []string{"/api/v1/messages", "/api/v1/messages/scheduled"} {
+		var msgs []models.Message
+		if code := s.do(http.MethodGet, path, bob.app.APIKey, nil, &msgs); code != http.StatusOK {
+			t.Fatalf("GET %s: status %d", path, code)
+		}
+		if len(msgs) != 1 || msgs[0].ID != bob.messageID {
+			t.Fatalf("GET %s for bob = %+v, want only his message", path, msgs)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package delivery
+
+import (
+	"sync"
+	"time"
+
+	"github.com/shohag/piperelay/internal/config"
+)
+
+type CircuitState string
+
+const (
+	CircuitClosed   CircuitState = "closed"
+	CircuitOpen     CircuitState = "open"
+	CircuitHalfOpen CircuitState = "half_open"
+)
+
+// CircuitStatus is the externally visible state of one endpoint's circuit.
+type CircuitStatus struct {
+	State               CircuitState `json:"state"`
+	ConsecutiveFailures int          `json:"consecutive_failures"`
+	OpenedAt            *time.Time   `json:"opened_at,omitempty"`
+	NextProbeAt         *time.Time   `json:"next_probe_at,omitempty"`
+}
+
+// CircuitBreaker tracks consecutive failures per endpoint. Once an endpoint
+// reaches the failure threshold its circuit opens and deliveries are held
+// back without an HTTP call. After the cooldown a single probe delivery is
+// let through (half-open); success closes the circuit, failure reopens it.
+//
+// State is kept in memory, so each PipeRelay process has its own view.
+type CircuitBreaker struct {
+	cfg      config.CircuitBreakerConfig
+	mu       sync.Mutex
+	circuits map[string]*circuit
+	now      func() time.Time
+}
+
+type circuit struct {
+	state    CircuitState
+	failures int
+	openedAt time.Time // start of the current outage; kept across probes
+	probeAt  time.Time
+}
+
+func NewCircuitBreaker(cfg config.CircuitBreakerConfig) *CircuitBreaker {
+	if cfg.Cooldown <= 0 {
+		cfg.Cooldown = time.Minute
+	}
+	return &CircuitBreaker{cfg: cfg, circuits: make(map[string]*circuit), now: time.Now}
+}
+
+// Allow reports whether a delivery to endpointID may be sent now. When it
+// may not, the returned time is when the caller should try again.
+func (b *CircuitBreaker) Allow(endpointID string) (bool, time.Time) {
+	if b.cfg.FailureThreshold <= 0 {
+		return true, time.Time{}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c, ok := b.circuits[endpointID]
+	if !ok {
+		return true, time.Time{}
+	}
+
+	now := b.now().UTC()
+	switch c.state {
+	case CircuitOpen:
+		if now.Before(c.probeAt) {
+			return false, c.probeAt
+		}
+		// This caller carries the probe; everyone else waits for its outcome.
+		c.state = CircuitHalfOpen
+		c.probeAt = now.Add(b.cfg.Cooldown)
+		return true, time.Time{}
+	case CircuitHalfOpen:
+		if now.Before(c.probeAt) {
+			return false, c.probeAt
+		}
+		// The probe never reported back; let another one through.
+		c.probeAt = now.Add(b.cfg.Cooldown)
+		return true, time.Time{}
+	}
+	return true, time.Time{}
+}
+
+// Success closes the circuit for endpointID.
+func (b *CircuitBreaker) Success(endpointID string) {
+	b.mu.Lock()
+	delete(b.circuits, endpointID)
+	b.mu.Unlock()
+}
+
+// Failure records a failed delivery. It returns how long the circuit has
+// been open when that exceeds DisableAfter, signalling that the endpoint
+// should be deactivated; otherwise it returns zero.
+func (b *CircuitBreaker) Failure(endpointID string) time.Duration {
+	if b.cfg.FailureThreshold <= 0 {
+		return 0
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c, ok := b.circuits[endpointID]
+	if !ok {
+		c = &circuit{state: CircuitClosed}
+		b.circuits[endpointID] = c
+	}
+	c.failures++
+
+	now := b.now().UTC()
+	switch c.state {
+	case CircuitClosed:
+		if c.failures < b.cfg.FailureThreshold {
+			return 0
+		}
+		c.state = CircuitOpen
+		c.openedAt = now
+		c.probeAt = now.Add(b.cfg.Cooldown)
+	case CircuitHalfOpen:
+		c.state = CircuitOpen
+		c.probeAt = now.Add(b.cfg.Cooldown)
+	}
+
+	if open := now.Sub(c.openedAt); b.cfg.DisableAfter > 0 && open >= b.cfg.DisableAfter {
+		return open
+	}
+	return 0
+}
+
+// Reset forgets all state for endpointID, e.g. after it is re-enabled.
+func (b *CircuitBreaker) Reset(endpointID string) {
+	b.Success(endpointID)
+}
+
+func (b *CircuitBreaker) Status(endpointID string) CircuitStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c, ok := b.circuits[endpointID]
+	if !ok {
+		return CircuitStatus{State: CircuitClosed}
+	}
+
+	status := CircuitStatus{State: c.state, ConsecutiveFailures: c.failures}
+	if c.state != CircuitClosed {
+		openedAt, probeAt := c.openedAt, c.probeAt
+		status.OpenedAt = &openedAt
+		status.NextProbeAt = &probeAt
+	}
+	return status
+}
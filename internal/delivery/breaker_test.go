@@ -0,0 +1,208 @@
+package delivery
+
+import (
+	"testing"
+	"time"
+
+	"github.com/shohag/piperelay/internal/config"
+)
+
+func newTestBreaker(cfg config.CircuitBreakerConfig) (*CircuitBreaker, *fakeClock) {
+	clock := newFakeClock()
+	b := NewCircuitBreaker(cfg)
+	b.now = clock.Now
+	return b, clock
+}
+
+// breakerStep is one action against an endpoint's circuit and what should
+// follow from it.
+type breakerStep struct {
+	advance time.Duration // moved forward before the action
+	action  string        // "allow", "fail" or "success"
+
+	allowed  bool          // for allow
+	disable  time.Duration // for fail: the outage length it reports
+	state    CircuitState  // afterwards
+	failures int           // afterwards
+}
+
+func TestCircuitBreakerTransitions(t *testing.T) {
+	cfg := config.CircuitBreakerConfig{
+		FailureThreshold: 3,
+		Cooldown:         time.Minute,
+		DisableAfter:     5 * time.Minute,
+	}
+
+	tests := []struct {
+		name  string
+		steps []breakerStep
+	}{
+		{
+			name: "stays closed below the threshold",
+			steps: []breakerStep{
+				{action: "fail", state: CircuitClosed, failures: 1},
+				{action: "fail", state: CircuitClosed, failures: 2},
+				{action: "allow", allowed: true, state: CircuitClosed, failures: 2},
+			},
+		},
+		{
+			name: "success resets the failure count",
+			steps: []breakerStep{
+				{action: "fail", state: CircuitClosed, failures: 1},
+				{action: "fail", state: CircuitClosed, failures: 2},
+				{action: "success", state: CircuitClosed},
+				{action: "fail", state: CircuitClosed, failures: 1},
+			},
+		},
+		{
+			name: "opens at the threshold and holds deliveries",
+			steps: []breakerStep{
+				{action: "fail", state: CircuitClosed, failures: 1},
+				{action: "fail", state: CircuitClosed, failures: 2},
+				{action: "fail", state: CircuitOpen, failures: 3},
+				{action: "allow", allowed: false, state: CircuitOpen, failures: 3},
+				{advance: 59 * time.Second, action: "allow", allowed: false, state: CircuitOpen, failures: 3},
+			},
+		},
+		{
+			name: "lets one probe through after the cooldown",
+			steps: []breakerStep{
+				{action: "fail", state: CircuitClosed, failures: 1},
+				{action: "fail", state: CircuitClosed, failures: 2},
+				{action: "fail", state: CircuitOpen, failures: 3},
+				{advance: time.Minute, action: "allow", allowed: true, state: CircuitHalfOpen, failures: 3},
+				{action: "allow", allowed: false, state: CircuitHalfOpen, failures: 3},
+			},
+		},
+		{
+			name: "successful probe closes the circuit",
+			steps: []breakerStep{
+				{action: "fail", state: CircuitClosed, failures: 1},
+				{action: "fail", state: CircuitClosed, failures: 2},
+				{action: "fail", state: CircuitOpen, failures: 3},
+				{advance: time.Minute, action: "allow", allowed: true, state: CircuitHalfOpen, failures: 3},
+				{action: "success", state: CircuitClosed},
+				{action: "allow", allowed: true, state: CircuitClosed},
+			},
+		},
+		{
+			name: "failed probe reopens for another cooldown",
+			steps: []breakerStep{
+				{action: "fail", state: CircuitClosed, failures: 1},
+				{action: "fail", state: CircuitClosed, failures: 2},
+				{action: "fail", state: CircuitOpen, failures: 3},
+				{advance: time.Minute, action: "allow", allowed: true, state: CircuitHalfOpen, failures: 3},
+				{action: "fail", state: CircuitOpen, failures: 4},
+				{advance: 30 * time.Second, action: "allow", allowed: false, state: CircuitOpen, failures: 4},
+				{advance: 30 * time.Second, action: "allow", allowed: true, state: CircuitHalfOpen, failures: 4},
+			},
+		},
+		{
+			name: "lost probe is replaced after the cooldown",
+			steps: []breakerStep{
+				{action: "fail", state: CircuitClosed, failures: 1},
+				{action: "fail", state: CircuitClosed, failures: 2},
+				{action: "fail", state: CircuitOpen, failures: 3},
+				{advance: time.Minute, action: "allow", allowed: true, state: CircuitHalfOpen, failures: 3},
+				{advance: time.Minute, action: "allow", allowed: true, state: CircuitHalfOpen, failures: 3},
+			},
+		},
+		{
+			name: "reports the outage once it reaches disable_after",
+			steps: []breakerStep{
+				{action: "fail", state: CircuitClosed, failures: 1},
+				{action: "fail", state: CircuitClosed, failures: 2},
+				{action: "fail", state: CircuitOpen, failures: 3},
+				{advance: 2 * time.Minute, action: "allow", allowed: true, state: CircuitHalfOpen, failures: 3},
+				{action: "fail", state: CircuitOpen, failures: 4},
+				{advance: 2 * time.Minute, action: "allow", allowed: true, state: CircuitHalfOpen, failures: 4},
+				{action: "fail", state: CircuitOpen, failures: 5},
+				{advance: time.Minute, action: "allow", allowed: true, state: CircuitHalfOpen, failures: 5},
+				{action: "fail", disable: 5 * time.Minute, state: CircuitOpen, failures: 6},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, clock := newTestBreaker(cfg)
+			for i, step := range tt.steps {
+				clock.Advance(step.advance)
+				switch step.action {
+				case "allow":
+					allowed, probeAt := b.Allow("ep")
+					if allowed != step.allowed {
+						t.Fatalf("step %d: allowed = %v, want %v", i, allowed, step.allowed)
+					}
+					if !allowed && !probeAt.After(clock.Now()) {
+						t.Fatalf("step %d: held until %s, not after now", i, probeAt)
+					}
+				case "fail":
+					if open := b.Failure("ep"); open != step.disable {
+						t.Fatalf("step %d: failure reported %s open, want %s", i, open, step.disable)
+					}
+				case "success":
+					b.Success("ep")
+				}
+
+				status := b.Status("ep")
+				if status.State != step.state || status.ConsecutiveFailures != step.failures {
+					t.Fatalf("step %d: status = %s/%d, want %s/%d", i, status.State, status.ConsecutiveFailures, step.state, step.failures)
+				}
+			}
+		})
+	}
+}
+
+func TestCircuitBreakerProbeTime(t *testing.T) {
+	b, clock := newTestBreaker(config.CircuitBreakerConfig{FailureThreshold: 1, Cooldown: 90 * time.Second})
+	opened := clock.Now()
+	b.Failure("ep")
+
+	clock.Advance(30 * time.Second)
+	allowed, probeAt := b.Allow("ep")
+	if allowed || !probeAt.Equal(opened.Add(90*time.Second)) {
+		t.Fatalf("Allow = %v, %s; want false, %s", allowed, probeAt, opened.Add(90*time.Second))
+	}
+
+	status := b.Status("ep")
+	if status.OpenedAt == nil || !status.OpenedAt.Equal(opened) {
+		t.Fatalf("opened at %v, want %s", status.OpenedAt, opened)
+	}
+}
+
+func TestCircuitBreakerDisabled(t *testing.T) {
+	b, _ := newTestBreaker(config.CircuitBreakerConfig{FailureThreshold: 0, DisableAfter: time.Nanosecond})
+	for i := 0; i < 10; i++ {
+		if open := b.Failure("ep"); open != 0 {
+			t.Fatalf("failure %d reported %s open", i, open)
+		}
+	}
+	if allowed, _ := b.Allow("ep"); !allowed {
+		t.Fatal("breaker with no threshold held a delivery")
+	}
+}
+
+func TestCircuitBreakerNeverDisablesWithoutDisableAfter(t *testing.T) {
+	b, clock := newTestBreaker(config.CircuitBreakerConfig{FailureThreshold: 1, Cooldown: time.Minute})
+	b.Failure("ep")
+	for i := 0; i < 10; i++ {
+		clock.Advance(time.Hour)
+		b.Allow("ep")
+		if open := b.Failure("ep"); open != 0 {
+			t.Fatalf("failure after %dh reported %s open", i+1, open)
+		}
+	}
+}
+
+func TestCircuitBreakerPerEndpoint(t *testing.T) {
+	b, _ := newTestBreaker(config.CircuitBreakerConfig{FailureThreshold: 1, Cooldown: time.Minute})
+	b.Failure("a")
+
+	if allowed, _ := b.Allow("a"); allowed {
+		t.Fatal("endpoint a was allowed with its circuit open")
+	}
+	if allowed, _ := b.Allow("b"); !allowed {
+		t.Fatal("endpoint b was held by a's circuit")
+	}
+}
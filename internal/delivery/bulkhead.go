@@ -0,0 +1,186 @@
+package delivery
+
+import (
+	"sync"
+	"time"
+
+	"github.com/shohag/piperelay/internal/config"
+)
+
+// Lane is a set of workers that deliveries run on.
+type Lane string
+
+const (
+	LaneMain     Lane = "main"
+	LaneIsolated Lane = "isolated"
+)
+
+// healthWeight is how much the latest attempt counts in an endpoint's
+// moving averages.
+const healthWeight = 0.2
+
+// EndpointHealth is the externally visible health of one endpoint.
+type EndpointHealth struct {
+	Lane        Lane       `json:"lane"`
+	LatencyMs   int64      `json:"latency_ms"`
+	FailureRate float64    `json:"failure_rate"`
+	Samples     int        `json:"samples"`
+	IsolatedAt  *time.Time `json:"isolated_at,omitempty"`
+}
+
+// LaneStatus reports a lane's size and how many of its workers are busy.
+type LaneStatus struct {
+	Workers int `json:"workers"`
+	Busy    int `json:"busy"`
+}
+
+// Bulkhead keeps slow and failing endpoints from tying up the workers that
+// healthy endpoints need. It tracks a moving average of each endpoint's
+// latency and failure rate; an endpoint that crosses either threshold is
+// moved to the isolated lane, a small set of workers of its own. It moves
+// back once both averages drop below half their thresholds, so an endpoint
+// near a threshold does not flap between lanes.
+//
+// Like the circuit breaker, state is kept in memory per process.
+type Bulkhead struct {
+	cfg      config.BulkheadConfig
+	main     chan struct{}
+	isolated chan struct{}
+
+	mu        sync.Mutex
+	endpoints map[string]*endpointHealth
+	now       func() time.Time
+}
+
+type endpointHealth struct {
+	latency    float64 // milliseconds
+	failures   float64
+	samples    int
+	isolatedAt time.Time // zero while in the main lane
+}
+
+// NewBulkhead creates a bulkhead whose main lane has workers workers.
+func NewBulkhead(cfg config.BulkheadConfig, workers int) *Bulkhead {
+	if cfg.Workers < 0 {
+		cfg.Workers = 0
+	}
+	if cfg.SlowThreshold <= 0 {
+		cfg.SlowThreshold = 5 * time.Second
+	}
+	if cfg.FailureRate <= 0 || cfg.FailureRate > 1 {
+		cfg.FailureRate = 0.5
+	}
+	return &Bulkhead{
+		cfg:       cfg,
+		main:      make(chan struct{}, workers),
+		isolated:  make(chan struct{}, cfg.Workers),
+		endpoints: make(map[string]*endpointHealth),
+		now:       time.Now,
+	}
+}
+
+// Lane returns the lane deliveries to endpointID run on.
+func (b *Bulkhead) Lane(endpointID string) Lane {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.lane(b.endpoints[endpointID])
+}
+
+func (b *Bulkhead) lane(h *endpointHealth) Lane {
+	if h == nil || h.isolatedAt.IsZero() {
+		return LaneMain
+	}
+	return LaneIsolated
+}
+
+// slots is the semaphore for lane: a worker holds one entry while it runs.
+func (b *Bulkhead) slots(lane Lane) chan struct{} {
+	if lane == LaneIsolated {
+		return b.isolated
+	}
+	return b.main
+}
+
+// free returns how many of lane's workers are idle.
+func (b *Bulkhead) free(lane Lane) int {
+	s := b.slots(lane)
+	return cap(s) - len(s)
+}
+
+// Record adds an attempt to endpointID's averages. It returns the lane the
+// endpoint is in afterwards and whether this attempt moved it there.
+func (b *Bulkhead) Record(endpointID string, latency time.Duration, failed bool) (Lane, bool) {
+	if b.cfg.Workers == 0 {
+		return LaneMain, false
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	h, ok := b.endpoints[endpointID]
+	if !ok {
+		h = &endpointHealth{}
+		b.endpoints[endpointID] = h
+	}
+
+	ms, failure := float64(latency.Milliseconds()), 0.0
+	if failed {
+		failure = 1
+	}
+	if h.samples == 0 {
+		h.latency, h.failures = ms, failure
+	} else {
+		h.latency += healthWeight * (ms - h.latency)
+		h.failures += healthWeight * (failure - h.failures)
+	}
+	h.samples++
+
+	slow := float64(b.cfg.SlowThreshold.Milliseconds())
+	before := b.lane(h)
+	switch {
+	case before == LaneMain && h.samples >= b.cfg.MinSamples &&
+		(h.latency >= slow || h.failures >= b.cfg.FailureRate):
+		h.isolatedAt = b.now().UTC()
+	case before == LaneIsolated && h.latency < slow/2 && h.failures < b.cfg.FailureRate/2:
+		h.isolatedAt = time.Time{}
+	}
+	after := b.lane(h)
+	return after, after != before
+}
+
+// Reset forgets endpointID's history, e.g. after it is disabled.
+func (b *Bulkhead) Reset(endpointID string) {
+	b.mu.Lock()
+	delete(b.endpoints, endpointID)
+	b.mu.Unlock()
+}
+
+func (b *Bulkhead) Status(endpointID string) EndpointHealth {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	h, ok := b.endpoints[endpointID]
+	if !ok {
+		return EndpointHealth{Lane: LaneMain}
+	}
+
+	status := EndpointHealth{
+		Lane:        b.lane(h),
+		LatencyMs:   int64(h.latency),
+		FailureRate: h.failures,
+		Samples:     h.samples,
+	}
+	if !h.isolatedAt.IsZero() {
+		isolatedAt := h.isolatedAt
+		status.IsolatedAt = &isolatedAt
+	}
+	return status
+}
+
+// Lanes reports the size and load of each lane.
+func (b *Bulkhead) Lanes() map[Lane]LaneStatus {
+	return map[Lane]LaneStatus{
+		LaneMain:     {Workers: cap(b.main), Busy: len(b.main)},
+		LaneIsolated: {Workers: cap(b.isolated), Busy: len(b.isolated)},
+	}
+}
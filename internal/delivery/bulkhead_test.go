@@ -0,0 +1,178 @@
+package delivery
+
+import (
+	"testing"
+	"time"
+
+	"github.com/shohag/piperelay/internal/config"
+)
+
+func newTestBulkhead(workers int) (*Bulkhead, *fakeClock) {
+	clock := newFakeClock()
+	b := NewBulkhead(config.BulkheadConfig{
+		Workers:       workers,
+		SlowThreshold: time.Second,
+		FailureRate:   0.5,
+		MinSamples:    3,
+	}, 4)
+	b.now = clock.Now
+	return b, clock
+}
+
+type bulkheadStep struct {
+	latency time.Duration
+	failed  bool
+	lane    Lane
+	moved   bool
+}
+
+func TestBulkheadMovesEndpoints(t *testing.T) {
+	const slow, fast = 2 * time.Second, 10 * time.Millisecond
+	tests := []struct {
+		name  string
+		steps []bulkheadStep
+	}{
+		{
+			name: "slow",
+			steps: []bulkheadStep{
+				{slow, false, LaneMain, false},
+				{slow, false, LaneMain, false}, // fewer than MinSamples
+				{slow, false, LaneIsolated, true},
+				{slow, false, LaneIsolated, false},
+				// Latency averages 1600, 1280 and 1024ms, then drops
+				// below the threshold but stays isolated until it is
+				// under half of it.
+				{0, false, LaneIsolated, false},
+				{0, false, LaneIsolated, false},
+				{0, false, LaneIsolated, false},
+				{0, false, LaneIsolated, false}, // 819ms
+				{0, false, LaneIsolated, false}, // 655ms
+				{0, false, LaneIsolated, false}, // 524ms
+				{0, false, LaneMain, true},      // 419ms
+			},
+		},
+		{
+			name: "failing",
+			steps: []bulkheadStep{
+				{fast, true, LaneMain, false},
+				{fast, true, LaneMain, false},
+				{fast, true, LaneIsolated, true},
+				{fast, false, LaneIsolated, false}, // 0.8
+				{fast, false, LaneIsolated, false}, // 0.64
+				{fast, false, LaneIsolated, false}, // 0.51
+				{fast, false, LaneIsolated, false}, // 0.41, below the rate
+				{fast, false, LaneIsolated, false}, // 0.33
+				{fast, false, LaneIsolated, false}, // 0.26
+				{fast, false, LaneMain, true},      // 0.21, below half of it
+			},
+		},
+		{
+			name: "healthy",
+			steps: []bulkheadStep{
+				{fast, false, LaneMain, false},
+				{fast, true, LaneMain, false},
+				{fast, false, LaneMain, false},
+				{fast, false, LaneMain, false},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, clock := newTestBulkhead(2)
+			var isolatedAt time.Time
+			for i, step := range tt.steps {
+				clock.Advance(time.Second)
+				lane, moved := b.Record("ep", step.latency, step.failed)
+				if lane != step.lane || moved != step.moved {
+					t.Fatalf("step %d: Record = %s, moved %v; want %s, moved %v", i, lane, moved, step.lane, step.moved)
+				}
+				if got := b.Lane("ep"); got != lane {
+					t.Fatalf("step %d: Lane = %s, Record said %s", i, got, lane)
+				}
+				if moved && lane == LaneIsolated {
+					isolatedAt = clock.Now()
+				}
+
+				status := b.Status("ep")
+				if status.Samples != i+1 {
+					t.Fatalf("step %d: %d samples", i, status.Samples)
+				}
+				switch {
+				case lane == LaneMain && status.IsolatedAt != nil:
+					t.Fatalf("step %d: isolated at %s while in the main lane", i, status.IsolatedAt)
+				case lane == LaneIsolated && (status.IsolatedAt == nil || !status.IsolatedAt.Equal(isolatedAt)):
+					t.Fatalf("step %d: isolated at %v, want %s", i, status.IsolatedAt, isolatedAt)
+				}
+			}
+			if got := b.Lane("other"); got != LaneMain {
+				t.Fatalf("an endpoint without attempts is in the %s lane", got)
+			}
+		})
+	}
+}
+
+func TestBulkheadWithoutIsolatedLane(t *testing.T) {
+	b, _ := newTestBulkhead(0)
+	for i := 0; i < 10; i++ {
+		if lane, moved := b.Record("ep", time.Minute, true); lane != LaneMain || moved {
+			t.Fatalf("attempt %d: Record = %s, moved %v; want the main lane", i, lane, moved)
+		}
+	}
+	if lanes := b.Lanes(); lanes[LaneIsolated].Workers != 0 {
+		t.Fatalf("isolated lane has %d workers, want 0", lanes[LaneIsolated].Workers)
+	}
+}
+
+func TestBulkheadReset(t *testing.T) {
+	b, _ := newTestBulkhead(2)
+	for i := 0; i < 3; i++ {
+		b.Record("ep", time.Minute, true)
+	}
+	if got := b.Lane("ep"); got != LaneIsolated {
+		t.Fatalf("lane = %s, want isolated", got)
+	}
+
+	b.Reset("ep")
+	if status := b.Status("ep"); status.Lane != LaneMain || status.Samples != 0 || status.IsolatedAt != nil {
+		t.Fatalf("status after Reset = %+v", status)
+	}
+}
+
+func TestBulkheadSlots(t *testing.T) {
+	b, _ := newTestBulkhead(1)
+	check := func(mainBusy, isolatedBusy int) {
+		t.Helper()
+		lanes := b.Lanes()
+		if lanes[LaneMain] != (LaneStatus{Workers: 4, Busy: mainBusy}) || lanes[LaneIsolated] != (LaneStatus{Workers: 1, Busy: isolatedBusy}) {
+			t.Fatalf("lanes = %+v, want %d and %d busy", lanes, mainBusy, isolatedBusy)
+		}
+		if free := b.free(LaneMain); free != 4-mainBusy {
+			t.Fatalf("main lane has %d free, want %d", free, 4-mainBusy)
+		}
+		if free := b.free(LaneIsolated); free != 1-isolatedBusy {
+			t.Fatalf("isolated lane has %d free, want %d", free, 1-isolatedBusy)
+		}
+	}
+
+	check(0, 0)
+	for i := 1; i <= 3; i++ {
+		b.slots(LaneMain) <- struct{}{}
+		check(i, 0)
+	}
+	b.slots(LaneIsolated) <- struct{}{}
+	check(3, 1)
+
+	// The isolated lane is full; its next delivery waits without taking
+	// a main worker.
+	select {
+	case b.slots(LaneIsolated) <- struct{}{}:
+		t.Fatal("took a second slot in a one-worker lane")
+	default:
+	}
+	check(3, 1)
+
+	<-b.slots(LaneIsolated)
+	<-b.slots(LaneMain)
+	check(2, 0)
+}
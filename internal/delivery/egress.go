@@ -0,0 +1,160 @@
+package delivery
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/shohag/piperelay/internal/config"
+)
+
+// reserved are the ranges a delivery may not connect to by default: private
+// networks, loopback, link-local (including the 169.254.169.254 metadata
+// service), multicast and other addresses that are never a public webhook
+// receiver, including the documentation ranges and Teredo.
+var reserved = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("10.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"), // carrier-grade NAT, some cloud metadata services
+	netip.MustParsePrefix("127.0.0.0/8"),
+	netip.MustParsePrefix("169.254.0.0/16"),
+	netip.MustParsePrefix("172.16.0.0/12"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("192.0.2.0/24"), // TEST-NET-1
+	netip.MustParsePrefix("192.168.0.0/16"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("198.51.100.0/24"), // TEST-NET-2
+	netip.MustParsePrefix("203.0.113.0/24"),  // TEST-NET-3
+	netip.MustParsePrefix("224.0.0.0/4"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("::/128"),
+	netip.MustParsePrefix("::1/128"),
+	netip.MustParsePrefix("64:ff9b:1::/48"), // local-use NAT64, mapped to whatever the operator chooses
+	netip.MustParsePrefix("2001::/32"),      // Teredo, tunnelled to the IPv4 client it embeds
+	netip.MustParsePrefix("2001:db8::/32"),  // documentation
+	netip.MustParsePrefix("fc00::/7"),       // unique local, including fd00:ec2::254
+	netip.MustParsePrefix("fe80::/10"),
+	netip.MustParsePrefix("ff00::/8"),
+}
+
+// NAT64, 6to4 and Teredo addresses lead to the IPv4 address embedded in
+// them, so that address is checked too: 64:ff9b::a9fe:a9fe reaches
+// 169.254.169.254 on a network with a NAT64 gateway.
+var (
+	nat64     = netip.MustParsePrefix("64:ff9b::/96")
+	sixToFour = netip.MustParsePrefix("2002::/16")
+	teredo    = netip.MustParsePrefix("2001::/32")
+)
+
+// embeddedIPv4 returns the IPv4 address a NAT64, 6to4 or Teredo addr leads
+// to. A Teredo address carries its client's address in the low 32 bits,
+// with every bit inverted.
+func embeddedIPv4(addr netip.Addr) (netip.Addr, bool) {
+	b := addr.As16()
+	switch {
+	case nat64.Contains(addr):
+		return netip.AddrFrom4([4]byte(b[12:16])), true
+	case sixToFour.Contains(addr):
+		return netip.AddrFrom4([4]byte(b[2:6])), true
+	case teredo.Contains(addr):
+		return netip.AddrFrom4([4]byte{^b[12], ^b[13], ^b[14], ^b[15]}), true
+	}
+	return addr, false
+}
+
+// BlockedError is returned for a connection the Guard refused.
+type BlockedError struct {
+	Host string
+	Addr netip.Addr
+}
+
+func (e *BlockedError) Error() string {
+	if e.Host == "" || e.Host == e.Addr.String() {
+		return fmt.Sprintf("blocked: %s is a private or reserved address", e.Addr)
+	}
+	return fmt.Sprintf("blocked: %s resolves to %s, a private or reserved address", e.Host, e.Addr)
+}
+
+// Guard stops deliveries from reaching internal services. It checks the
+// address every connection is actually made to, after DNS resolution, so a
+// host name that resolves to a private address, a record that changes after
+// the endpoint was registered, and a redirect to an internal URL are all
+// caught.
+type Guard struct {
+	allowPrivate bool
+	allowNets    []netip.Prefix
+	allowHosts   map[string]bool
+	dialTimeout  time.Duration
+}
+
+// NewGuard creates a guard from cfg, which should have passed Validate.
+// Connections it dials give up after timeout, usually delivery.timeout.
+func NewGuard(cfg config.EgressConfig, timeout time.Duration) *Guard {
+	g := &Guard{allowPrivate: cfg.AllowPrivate, allowHosts: make(map[string]bool), dialTimeout: timeout}
+	for _, entry := range cfg.Allow {
+		if prefix, err := netip.ParsePrefix(entry); err == nil {
+			g.allowNets = append(g.allowNets, prefix.Masked())
+		} else if addr, err := netip.ParseAddr(entry); err == nil {
+			g.allowNets = append(g.allowNets, netip.PrefixFrom(addr, addr.BitLen()))
+		} else {
+			g.allowHosts[strings.ToLower(entry)] = true
+		}
+	}
+	return g
+}
+
+// Check returns a *BlockedError if host, connected to at addr, is off
+// limits. An IPv4-mapped, NAT64, 6to4 or Teredo address is judged by the IPv4
+// address it leads to as well as by itself.
+func (g *Guard) Check(host string, addr netip.Addr) error {
+	addr = addr.Unmap()
+	if g.allowPrivate || g.allowHosts[strings.ToLower(host)] {
+		return nil
+	}
+	target, _ := embeddedIPv4(addr)
+	for _, prefix := range g.allowNets {
+		if prefix.Contains(addr) || prefix.Contains(target) {
+			return nil
+		}
+	}
+	for _, prefix := range reserved {
+		if prefix.Contains(addr) || prefix.Contains(target) {
+			return &BlockedError{Host: host, Addr: addr}
+		}
+	}
+	return nil
+}
+
+// CheckHost rejects a host given as a literal IP address that Check would
+// block. Host names are only resolved when a delivery connects.
+func (g *Guard) CheckHost(host string) error {
+	addr, err := netip.ParseAddr(strings.Trim(host, "[]"))
+	if err != nil {
+		return nil
+	}
+	return g.Check(host, addr)
+}
+
+// DialContext connects like a net.Dialer, refusing addresses Check blocks.
+func (g *Guard) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	d := &net.Dialer{
+		Timeout:   g.dialTimeout,
+		KeepAlive: 30 * time.Second,
+		Control: func(_, address string, _ syscall.RawConn) error {
+			ap, err := netip.ParseAddrPort(address)
+			if err != nil {
+				return err
+			}
+			return g.Check(host, ap.Addr())
+		},
+	}
+	return d.DialContext(ctx, network, address)
+}
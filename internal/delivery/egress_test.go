@@ -0,0 +1,153 @@
+package delivery
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/shohag/piperelay/internal/config"
+)
+
+func TestGuardCheck(t *testing.T) {
+	strict := NewGuard(config.EgressConfig{}, time.Second)
+	allowing := NewGuard(config.EgressConfig{Allow: []string{"10.1.0.0/16", "192.168.1.5", "Internal.Example"}}, time.Second)
+	open := NewGuard(config.EgressConfig{AllowPrivate: true}, time.Second)
+
+	tests := []struct {
+		name    string
+		guard   *Guard
+		host    string
+		addr    string
+		blocked bool
+	}{
+		{"public IPv4", strict, "example.com", "93.184.216.34", false},
+		{"private IPv4", strict, "example.com", "10.0.0.1", true},
+		{"loopback", strict, "localhost", "127.0.0.1", true},
+		{"metadata service", strict, "", "169.254.169.254", true},
+		{"carrier-grade NAT", strict, "", "100.100.100.200", true},
+		{"public IPv6", strict, "", "2606:2800:220:1::1", false},
+		{"IPv6 loopback", strict, "", "::1", true},
+		{"IPv6 unique local", strict, "", "fd00:ec2::254", true},
+		{"IPv6 link-local", strict, "", "fe80::1", true},
+		{"TEST-NET-1", strict, "", "192.0.2.10", true},
+		{"TEST-NET-2", strict, "", "198.51.100.10", true},
+		{"TEST-NET-3", strict, "", "203.0.113.10", true},
+		{"next to TEST-NET-3", strict, "", "203.0.114.10", false},
+		{"IPv6 documentation", strict, "", "2001:db8::1", true},
+
+		{"IPv4-mapped loopback", strict, "", "::ffff:127.0.0.1", true},
+		{"IPv4-mapped metadata service", strict, "", "::ffff:169.254.169.254", true},
+		{"IPv4-mapped public", strict, "", "::ffff:93.184.216.34", false},
+		{"NAT64 metadata service", strict, "", "64:ff9b::a9fe:a9fe", true},
+		{"NAT64 private", strict, "", "64:ff9b::10.0.0.1", true},
+		{"NAT64 public", strict, "", "64:ff9b::93.184.216.34", false},
+		{"local-use NAT64", strict, "", "64:ff9b:1::5db8:d822", true},
+		{"6to4 loopback", strict, "", "2002:7f00:1::1", true},
+		{"6to4 private", strict, "", "2002:c0a8:101::1", true},
+		{"6to4 public", strict, "", "2002:5db8:d822::1", false},
+		{"Teredo loopback", strict, "", "2001:0:4136:e378:8000:63bf:80ff:fffe", true},
+		{"Teredo public", strict, "", "2001:0:4136:e378:8000:63bf:a247:2bdd", true},
+
+		{"allowed range", allowing, "", "10.1.2.3", false},
+		{"outside allowed range", allowing, "", "10.2.0.1", true},
+		{"allowed address", allowing, "", "192.168.1.5", false},
+		{"next to allowed address", allowing, "", "192.168.1.6", true},
+		{"allowed host", allowing, "internal.example", "10.9.9.9", false},
+		{"allowed host in other case", allowing, "INTERNAL.example", "127.0.0.1", false},
+		{"other host at same address", allowing, "other.example", "10.9.9.9", true},
+		{"IPv4-mapped allowed address", allowing, "", "::ffff:10.1.2.3", false},
+		{"NAT64 allowed address", allowing, "", "64:ff9b::10.1.2.3", false},
+		{"NAT64 outside allowed range", allowing, "", "64:ff9b::10.2.0.1", true},
+		{"Teredo allowed address", allowing, "", "2001:0:4136:e378:8000:63bf:f5fe:fdfc", false},
+		{"Teredo outside allowed range", allowing, "", "2001:0:4136:e378:8000:63bf:f5fd:fffe", true},
+
+		{"allow_private", open, "", "10.0.0.1", false},
+		{"allow_private NAT64", open, "", "64:ff9b::a9fe:a9fe", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.guard.Check(tt.host, netip.MustParseAddr(tt.addr))
+			var blocked *BlockedError
+			if got := errors.As(err, &blocked); got != tt.blocked {
+				t.Fatalf("Check(%q, %s) = %v, want blocked %v", tt.host, tt.addr, err, tt.blocked)
+			}
+		})
+	}
+}
+
+func TestEmbeddedIPv4(t *testing.T) {
+	tests := []struct {
+		addr, want string
+	}{
+		{"64:ff9b::a9fe:a9fe", "169.254.169.254"},
+		{"2002:c0a8:101::1", "192.168.1.1"},
+		{"2001:0:4136:e378:8000:63bf:3fff:fdd2", "192.0.2.45"},
+		{"2001:0:4136:e378:8000:63bf:80ff:fffe", "127.0.0.1"},
+		{"2606:2800:220:1::1", ""},
+	}
+	for _, tt := range tests {
+		got, ok := embeddedIPv4(netip.MustParseAddr(tt.addr))
+		if tt.want == "" {
+			if ok {
+				t.Errorf("embeddedIPv4(%s) = %s, want none", tt.addr, got)
+			}
+			continue
+		}
+		if !ok || got.String() != tt.want {
+			t.Errorf("embeddedIPv4(%s) = %s, %v; want %s", tt.addr, got, ok, tt.want)
+		}
+	}
+}
+
+func TestGuardCheckHost(t *testing.T) {
+	g := NewGuard(config.EgressConfig{}, time.Second)
+	tests := []struct {
+		host    string
+		blocked bool
+	}{
+		{"example.com", false}, // resolved when dialled
+		{"93.184.216.34", false},
+		{"169.254.169.254", true},
+		{"[::1]", true},
+		{"[::ffff:127.0.0.1]", true},
+		{"[64:ff9b::a9fe:a9fe]", true},
+	}
+	for _, tt := range tests {
+		if err := g.CheckHost(tt.host); (err != nil) != tt.blocked {
+			t.Errorf("CheckHost(%q) = %v, want blocked %v", tt.host, err, tt.blocked)
+		}
+	}
+}
+
+func TestGuardDialContext(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	ctx := context.Background()
+
+	_, err = NewGuard(config.EgressConfig{}, time.Second).DialContext(ctx, "tcp", ln.Addr().String())
+	var blocked *BlockedError
+	if !errors.As(err, &blocked) {
+		t.Fatalf("dialling loopback = %v, want a BlockedError", err)
+	}
+
+	conn, err := NewGuard(config.EgressConfig{Allow: []string{"127.0.0.0/8"}}, time.Second).DialContext(ctx, "tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dialling allowed loopback: %v", err)
+	}
+	conn.Close()
+}
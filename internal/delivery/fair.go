@@ -0,0 +1,203 @@
+package delivery
+
+import (
+	"time"
+
+	"github.com/shohag/piperelay/internal/storage"
+)
+
+// fairScheduler decides which endpoints get the pool's free workers. It
+// shares them among applications in proportion to their weights and, within
+// an application, round-robin among its endpoints, so one tenant's backlog
+// cannot starve the others.
+//
+// Each round within an application visits its endpoints in order of the
+// rank of their first due delivery, so when workers are scarce a
+// high-priority delivery goes ahead of normal ones waiting for the
+// application's other endpoints, and aging lets low ones catch up as it
+// does within one endpoint. Priority never overrides application weights:
+// it only breaks ties between applications whose turn it equally is.
+//
+// Applications are ordered by stride scheduling: every pick advances the
+// chosen application's pass by 1/weight, and the lowest pass goes next.
+// Passes persist across claims, which matters because a busy pool claims
+// one or two deliveries at a time as workers free up.
+type fairScheduler struct {
+	maxPerEndpoint int
+
+	vtime    float64            // pass of the most recent pick
+	passes   map[string]float64 // per application
+	seq      uint64
+	lastPick map[string]uint64 // per endpoint, for round-robin
+}
+
+func newFairScheduler(maxPerEndpoint int) *fairScheduler {
+	return &fairScheduler{
+		maxPerEndpoint: maxPerEndpoint,
+		passes:         make(map[string]float64),
+		lastPick:       make(map[string]uint64),
+	}
+}
+
+type appQueue struct {
+	id        string
+	stride    float64
+	endpoints []*endpointQueue
+}
+
+type endpointQueue struct {
+	id        string
+	rankAt    time.Time
+	available int
+	picks     int // in this call
+}
+
+// before reports whether ep should be picked ahead of other, both in the
+// same application: fewest picks this round first, then the earliest
+// ranked, then the least recently picked.
+func (f *fairScheduler) before(ep, other *endpointQueue) bool {
+	if ep.picks != other.picks {
+		return ep.picks < other.picks
+	}
+	if !ep.rankAt.Equal(other.rankAt) {
+		return ep.rankAt.Before(other.rankAt)
+	}
+	return f.lastPick[ep.id] < f.lastPick[other.id]
+}
+
+// head is the earliest rank among app's endpoints that can still be picked.
+func (app *appQueue) head() time.Time {
+	head := app.endpoints[0].rankAt
+	for _, ep := range app.endpoints[1:] {
+		if ep.rankAt.Before(head) {
+			head = ep.rankAt
+		}
+	}
+	return head
+}
+
+// shares returns how many requests to give each endpoint in backlog, at
+// most limit in total. A request carries one delivery, or a whole batch for
+// an endpoint that batches. An endpoint never gets more than its
+// concurrency cap minus what it already has in flight.
+func (f *fairScheduler) shares(backlog []storage.EndpointBacklog, limit int) map[string]int {
+	apps := make(map[string]*appQueue)
+	var order []*appQueue
+	for _, b := range backlog {
+		available := requests(b, b.Due)
+		if capacity := f.endpointLimit(b); capacity > 0 {
+			available = min(available, capacity-requests(b, b.InFlight))
+		}
+		if available <= 0 {
+			continue
+		}
+
+		app, ok := apps[b.AppID]
+		if !ok {
+			weight := b.AppWeight
+			if weight <= 0 {
+				weight = 1
+			}
+			app = &appQueue{id: b.AppID, stride: 1 / float64(weight)}
+			apps[b.AppID] = app
+			order = append(order, app)
+		}
+		app.endpoints = append(app.endpoints, &endpointQueue{id: b.EndpointID, rankAt: b.RankAt, available: available})
+	}
+
+	// An application that was idle rejoins at the current virtual time
+	// rather than with the credit it would have built up.
+	for _, app := range order {
+		if f.passes[app.id] < f.vtime {
+			f.passes[app.id] = f.vtime
+		}
+	}
+	for id, pass := range f.passes {
+		if _, ok := apps[id]; !ok && pass <= f.vtime {
+			delete(f.passes, id)
+		}
+	}
+
+	out := make(map[string]int)
+	for n := 0; n < limit && len(order) > 0; n++ {
+		ai := 0
+		for i, app := range order[1:] {
+			if f.ahead(app, order[ai]) {
+				ai = i + 1
+			}
+		}
+		app := order[ai]
+
+		ei := 0
+		for i, ep := range app.endpoints[1:] {
+			if f.before(ep, app.endpoints[ei]) {
+				ei = i + 1
+			}
+		}
+		ep := app.endpoints[ei]
+
+		out[ep.id]++
+		ep.picks++
+		f.seq++
+		f.lastPick[ep.id] = f.seq
+		f.vtime = f.passes[app.id]
+		f.passes[app.id] += app.stride
+
+		ep.available--
+		if ep.available == 0 {
+			app.endpoints = append(app.endpoints[:ei], app.endpoints[ei+1:]...)
+			if len(app.endpoints) == 0 {
+				order = append(order[:ai], order[ai+1:]...)
+			}
+		}
+	}
+
+	f.prune(backlog)
+	return out
+}
+
+// ahead reports whether app goes before other: lowest pass first, then the
+// earliest ranked work, then by ID so the order is deterministic.
+func (f *fairScheduler) ahead(app, other *appQueue) bool {
+	if p, q := f.passes[app.id], f.passes[other.id]; p != q {
+		return p < q
+	}
+	if h, g := app.head(), other.head(); !h.Equal(g) {
+		return h.Before(g)
+	}
+	return app.id < other.id
+}
+
+// requests is how many requests it takes to send n deliveries to b's
+// endpoint.
+func requests(b storage.EndpointBacklog, n int) int {
+	if b.Batch == nil || b.Batch.MaxSize <= 1 {
+		return n
+	}
+	return (n + b.Batch.MaxSize - 1) / b.Batch.MaxSize
+}
+
+// endpointLimit is the concurrency cap for b's endpoint, or 0 for none.
+func (f *fairScheduler) endpointLimit(b storage.EndpointBacklog) int {
+	if b.MaxConcurrency > 0 {
+		return b.MaxConcurrency
+	}
+	return f.maxPerEndpoint
+}
+
+// prune forgets round-robin positions of endpoints with nothing due, so the
+// map does not grow with every endpoint ever seen.
+func (f *fairScheduler) prune(backlog []storage.EndpointBacklog) {
+	if len(f.lastPick) <= 2*len(backlog) {
+		return
+	}
+	seen := make(map[string]bool, len(backlog))
+	for _, b := range backlog {
+		seen[b.EndpointID] = true
+	}
+	for id := range f.lastPick {
+		if !seen[id] {
+			delete(f.lastPick, id)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package delivery
+
+import (
+	"testing"
+	"time"
+
+	"github.com/shohag/piperelay/internal/models"
+	"github.com/shohag/piperelay/internal/storage"
+)
+
+// perApp sums shares by application.
+func perApp(backlog []storage.EndpointBacklog, shares map[string]int) map[string]int {
+	apps := make(map[string]int)
+	for _, b := range backlog {
+		apps[b.AppID] += shares[b.EndpointID]
+	}
+	return apps
+}
+
+func TestFairSchedulerSplitsByWeight(t *testing.T) {
+	backlog := []storage.EndpointBacklog{
+		{EndpointID: "ep_light", AppID: "light", AppWeight: 1, Due: 1000},
+		{EndpointID: "ep_heavy", AppID: "heavy", AppWeight: 3, Due: 1000},
+	}
+
+	tests := []struct {
+		name   string
+		limit  int // free workers per claim
+		claims int
+	}{
+		{"one large claim", 400, 1},
+		{"claims of one", 1, 400},
+		{"uneven claims", 7, 57},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFairScheduler(0)
+			total := make(map[string]int)
+			for i := 0; i < tt.claims; i++ {
+				for app, n := range perApp(backlog, f.shares(backlog, tt.limit)) {
+					total[app] += n
+				}
+			}
+
+			claimed := total["light"] + total["heavy"]
+			if claimed != tt.limit*tt.claims {
+				t.Fatalf("claimed %d, want %d", claimed, tt.limit*tt.claims)
+			}
+			// Stride scheduling is exact up to one pick.
+			if want := claimed / 4; total["light"] < want-1 || total["light"] > want+1 {
+				t.Fatalf("split light %d / heavy %d, want 1:3", total["light"], total["heavy"])
+			}
+		})
+	}
+}
+
+func TestFairSchedulerZeroWeightCountsAsOne(t *testing.T) {
+	f := newFairScheduler(0)
+	backlog := []storage.EndpointBacklog{
+		{EndpointID: "a", AppID: "a", AppWeight: 0, Due: 100},
+		{EndpointID: "b", AppID: "b", AppWeight: 1, Due: 100},
+	}
+	shares := f.shares(backlog, 10)
+	if shares["a"] != 5 || shares["b"] != 5 {
+		t.Fatalf("shares = %v, want 5 each", shares)
+	}
+}
+
+func TestFairSchedulerRoundRobinWithinApp(t *testing.T) {
+	f := newFairScheduler(0)
+	backlog := []storage.EndpointBacklog{
+		{EndpointID: "one", AppID: "app", AppWeight: 1, Due: 100},
+		{EndpointID: "two", AppID: "app", AppWeight: 1, Due: 100},
+		{EndpointID: "three", AppID: "app", AppWeight: 1, Due: 100},
+	}
+
+	total := make(map[string]int)
+	for i := 0; i < 30; i++ {
+		for id, n := range f.shares(backlog, 1) {
+			total[id] += n
+		}
+	}
+	for _, b := range backlog {
+		if total[b.EndpointID] != 10 {
+			t.Fatalf("shares = %v, want 10 each", total)
+		}
+	}
+}
+
+func TestFairSchedulerPrefersEarliestRankedEndpoint(t *testing.T) {
+	now := time.Now()
+	normal := storage.EndpointBacklog{EndpointID: "analytics", AppID: "app", AppWeight: 1, RankAt: now.Add(-time.Minute), Due: 100}
+	high := storage.EndpointBacklog{EndpointID: "payments", AppID: "app", AppWeight: 1, RankAt: now.Add(-5 * time.Minute), Due: 100}
+	aged := storage.EndpointBacklog{EndpointID: "reports", AppID: "app", AppWeight: 1, RankAt: now.Add(-10 * time.Minute), Due: 100}
+
+	tests := []struct {
+		name    string
+		backlog []storage.EndpointBacklog
+		limit   int
+		want    map[string]int
+	}{
+		{"high priority first", []storage.EndpointBacklog{normal, high}, 1, map[string]int{"payments": 1}},
+		{"aged low priority first", []storage.EndpointBacklog{normal, high, aged}, 1, map[string]int{"reports": 1}},
+		{"rank orders each round", []storage.EndpointBacklog{normal, high, aged}, 5, map[string]int{"reports": 2, "payments": 2, "analytics": 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			shares := newFairScheduler(0).shares(tt.backlog, tt.limit)
+			if len(shares) != len(tt.want) {
+				t.Fatalf("shares = %v, want %v", shares, tt.want)
+			}
+			for id, n := range tt.want {
+				if shares[id] != n {
+					t.Fatalf("shares = %v, want %v", shares, tt.want)
+				}
+			}
+		})
+	}
+}
+
+// Priority breaks ties between applications but never outweighs them.
+func TestFairSchedulerRankBetweenApplications(t *testing.T) {
+	now := time.Now()
+	backlog := []storage.EndpointBacklog{
+		{EndpointID: "a", AppID: "a", AppWeight: 1, RankAt: now, Due: 100},
+		{EndpointID: "b", AppID: "b", AppWeight: 1, RankAt: now.Add(-5 * time.Minute), Due: 100},
+	}
+
+	f := newFairScheduler(0)
+	if shares := f.shares(backlog, 1); shares["b"] != 1 {
+		t.Fatalf("first pick = %v, want b's earlier ranked work", shares)
+	}
+	if shares := f.shares(backlog, 1); shares["a"] != 1 {
+		t.Fatalf("second pick = %v, want a's turn", shares)
+	}
+	if shares := f.shares(backlog, 10); shares["a"] != 5 || shares["b"] != 5 {
+		t.Fatalf("shares = %v, want 5 each", shares)
+	}
+}
+
+func TestFairSchedulerLeftoverGoesToOthers(t *testing.T) {
+	f := newFairScheduler(0)
+	backlog := []storage.EndpointBacklog{
+		{EndpointID: "small", AppID: "small", AppWeight: 10, Due: 2},
+		{EndpointID: "big", AppID: "big", AppWeight: 1, Due: 100},
+	}
+	shares := f.shares(backlog, 10)
+	if shares["small"] != 2 || shares["big"] != 8 {
+		t.Fatalf("shares = %v, want small 2 and big the remaining 8", shares)
+	}
+}
+
+func TestFairSchedulerIdleAppRejoinsWithoutCredit(t *testing.T) {
+	f := newFairScheduler(0)
+	busy := storage.EndpointBacklog{EndpointID: "busy", AppID: "busy", AppWeight: 1, Due: 1000}
+	for i := 0; i < 100; i++ {
+		f.shares([]storage.EndpointBacklog{busy}, 1)
+	}
+
+	backlog := []storage.EndpointBacklog{busy, {EndpointID: "new", AppID: "new", AppWeight: 1, Due: 1000}}
+	shares := f.shares(backlog, 10)
+	if shares["busy"] != 5 || shares["new"] != 5 {
+		t.Fatalf("shares = %v, want 5 each once both are busy", shares)
+	}
+}
+
+func TestFairSchedulerEndpointConcurrency(t *testing.T) {
+	batch := &models.BatchPolicy{MaxSize: 10}
+	tests := []struct {
+		name      string
+		poolCap   int // delivery.endpoint_concurrency
+		backlog   storage.EndpointBacklog
+		want      int
+		wantOther int
+	}{
+		{"uncapped", 0, storage.EndpointBacklog{Due: 50}, 20, 20},
+		{"max_concurrency", 0, storage.EndpointBacklog{MaxConcurrency: 3, Due: 50}, 3, 37},
+		{"max_concurrency minus in flight", 0, storage.EndpointBacklog{MaxConcurrency: 3, InFlight: 2, Due: 50}, 1, 39},
+		{"max_concurrency reached", 0, storage.EndpointBacklog{MaxConcurrency: 3, InFlight: 3, Due: 50}, 0, 40},
+		{"over max_concurrency", 0, storage.EndpointBacklog{MaxConcurrency: 3, InFlight: 5, Due: 50}, 0, 40},
+		{"pool default", 4, storage.EndpointBacklog{Due: 50}, 4, 4},
+		{"max_concurrency over pool default", 4, storage.EndpointBacklog{MaxConcurrency: 6, InFlight: 1, Due: 50}, 5, 4},
+		{"fewer due than the cap", 0, storage.EndpointBacklog{MaxConcurrency: 10, Due: 2}, 2, 38},
+		{"batches count as one request", 0, storage.EndpointBacklog{MaxConcurrency: 2, Due: 50, Batch: batch}, 2, 38},
+		{"partial batch", 0, storage.EndpointBacklog{Due: 25, Batch: batch}, 3, 37},
+		{"in-flight batches", 0, storage.EndpointBacklog{MaxConcurrency: 3, InFlight: 15, Due: 50, Batch: batch}, 1, 39},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFairScheduler(tt.poolCap)
+			capped := tt.backlog
+			capped.EndpointID, capped.AppID, capped.AppWeight = "capped", "app", 1
+			other := storage.EndpointBacklog{EndpointID: "other", AppID: "other", AppWeight: 1, Due: 1000}
+
+			shares := f.shares([]storage.EndpointBacklog{capped, other}, 40)
+			if shares["capped"] != tt.want || shares["other"] != tt.wantOther {
+				t.Fatalf("shares = %v, want capped %d and other %d", shares, tt.want, tt.wantOther)
+			}
+		})
+	}
+}
@@ -0,0 +1,102 @@
+package delivery
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// maxPendingWakeups bounds how many future wake-ups a Notifier remembers.
+// Beyond that, deliveries are still picked up by the fallback poll.
+const maxPendingWakeups = 10000
+
+// Notifier wakes the pool when deliveries become due, so they are claimed
+// right away instead of on the next poll. Signals are coalesced: any number
+// of Notify calls before the pool looks yield a single wake-up.
+type Notifier struct {
+	ch  chan struct{}
+	now func() time.Time
+
+	mu      sync.Mutex
+	times   timeHeap
+	timer   *time.Timer
+	stopped bool
+}
+
+func NewNotifier() *Notifier {
+	n := &Notifier{ch: make(chan struct{}, 1), now: time.Now}
+	n.timer = time.AfterFunc(time.Hour, n.fire)
+	n.timer.Stop()
+	return n
+}
+
+// Notify signals that deliveries are due now. It never blocks.
+func (n *Notifier) Notify() {
+	select {
+	case n.ch <- struct{}{}:
+	default:
+	}
+}
+
+// NotifyAt signals once t is reached, for deliveries that become due later.
+func (n *Notifier) NotifyAt(t time.Time) {
+	now := n.now()
+	if !t.After(now) {
+		n.Notify()
+		return
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.stopped || len(n.times) >= maxPendingWakeups {
+		return
+	}
+	heap.Push(&n.times, t)
+	if n.times[0].Equal(t) {
+		n.timer.Reset(t.Sub(now))
+	}
+}
+
+// Stop drops the pending wake-ups and ignores later NotifyAt calls. Notify
+// still signals.
+func (n *Notifier) Stop() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.stopped = true
+	n.times = nil
+	n.timer.Stop()
+}
+
+// C receives a value after Notify, or once a NotifyAt time is reached.
+func (n *Notifier) C() <-chan struct{} {
+	return n.ch
+}
+
+// fire drops the wake-ups that are due, signals, and rearms the timer for
+// the next one.
+func (n *Notifier) fire() {
+	n.mu.Lock()
+	now := n.now()
+	for len(n.times) > 0 && !n.times[0].After(now) {
+		heap.Pop(&n.times)
+	}
+	if len(n.times) > 0 {
+		n.timer.Reset(n.times[0].Sub(now))
+	}
+	n.mu.Unlock()
+
+	n.Notify()
+}
+
+type timeHeap []time.Time
+
+func (h timeHeap) Len() int            { return len(h) }
+func (h timeHeap) Less(i, j int) bool  { return h[i].Before(h[j]) }
+func (h timeHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *timeHeap) Push(x interface{}) { *h = append(*h, x.(time.Time)) }
+func (h *timeHeap) Pop() interface{} {
+	old := *h
+	t := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return t
+}
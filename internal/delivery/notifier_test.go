@@ -0,0 +1,126 @@
+package delivery
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestNotifier() (*Notifier, *fakeClock) {
+	clock := newFakeClock()
+	n := NewNotifier()
+	n.now = clock.Now
+	return n, clock
+}
+
+// signals drains n and reports how many wake-ups were waiting.
+func signals(n *Notifier) int {
+	count := 0
+	for {
+		select {
+		case <-n.C():
+			count++
+		default:
+			return count
+		}
+	}
+}
+
+func TestNotifierCoalescesBursts(t *testing.T) {
+	n, clock := newTestNotifier()
+	for i := 0; i < 100; i++ {
+		n.Notify()
+		n.NotifyAt(clock.Now().Add(-time.Second)) // already due
+	}
+	if got := signals(n); got != 1 {
+		t.Fatalf("a burst of notifies gave %d signals, want 1", got)
+	}
+	if got := signals(n); got != 0 {
+		t.Fatalf("%d signals after draining, want none", got)
+	}
+	if len(n.times) != 0 {
+		t.Fatalf("due times were queued: %v", n.times)
+	}
+}
+
+func TestNotifierWakesWhenDue(t *testing.T) {
+	n, clock := newTestNotifier()
+	start := clock.Now()
+	for _, d := range []time.Duration{3 * time.Minute, time.Minute, 2 * time.Minute, 2 * time.Minute} {
+		n.NotifyAt(start.Add(d))
+	}
+	if got := signals(n); got != 0 {
+		t.Fatalf("%d signals before anything was due", got)
+	}
+	if !n.times[0].Equal(start.Add(time.Minute)) {
+		t.Fatalf("earliest wake-up = %s, want %s", n.times[0], start.Add(time.Minute))
+	}
+
+	steps := []struct {
+		advance time.Duration
+		left    int
+		next    time.Duration
+	}{
+		{time.Minute, 3, 2 * time.Minute},
+		{time.Minute, 1, 3 * time.Minute}, // both at 2m go together
+		{time.Minute, 0, 0},
+	}
+	for i, step := range steps {
+		clock.Advance(step.advance)
+		n.fire()
+		if got := signals(n); got != 1 {
+			t.Fatalf("step %d: %d signals, want 1", i, got)
+		}
+		if len(n.times) != step.left {
+			t.Fatalf("step %d: %d wake-ups left, want %d", i, len(n.times), step.left)
+		}
+		if step.left > 0 && !n.times[0].Equal(start.Add(step.next)) {
+			t.Fatalf("step %d: next wake-up = %s, want %s", i, n.times[0], start.Add(step.next))
+		}
+	}
+}
+
+func TestNotifierBoundsPendingWakeups(t *testing.T) {
+	n, clock := newTestNotifier()
+	for i := 0; i <= maxPendingWakeups; i++ {
+		n.NotifyAt(clock.Now().Add(time.Hour + time.Duration(i)))
+	}
+	if len(n.times) != maxPendingWakeups {
+		t.Fatalf("remembering %d wake-ups, want %d", len(n.times), maxPendingWakeups)
+	}
+}
+
+func TestNotifierTimerFires(t *testing.T) {
+	n := NewNotifier()
+	defer n.Stop()
+
+	const delay = 20 * time.Millisecond
+	start := time.Now()
+	n.NotifyAt(start.Add(delay))
+	select {
+	case <-n.C():
+		if elapsed := time.Since(start); elapsed < delay {
+			t.Fatalf("woke after %s, before the %s it was due", elapsed, delay)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no wake-up for a due time")
+	}
+}
+
+func TestNotifierStop(t *testing.T) {
+	n := NewNotifier()
+	n.NotifyAt(time.Now().Add(10 * time.Millisecond))
+	n.Stop()
+	n.NotifyAt(time.Now().Add(10 * time.Millisecond))
+	if len(n.times) != 0 {
+		t.Fatalf("%d wake-ups pending after Stop", len(n.times))
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if got := signals(n); got != 0 {
+		t.Fatalf("%d signals after Stop, want none", got)
+	}
+	n.Notify()
+	if got := signals(n); got != 1 {
+		t.Fatalf("Notify after Stop gave %d signals, want 1", got)
+	}
+}
@@ -2,57 +2,152 @@ package delivery
 
 import (
 	"context"
+	"fmt"
+	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/rs/zerolog"
 	"github.com/shohag/piperelay/internal/config"
+	"github.com/shohag/piperelay/internal/models"
 	"github.com/shohag/piperelay/internal/storage"
 )
 
+// Pool claims due deliveries and runs them on a bounded set of workers. It
+// claims as soon as its Notifier signals; polling every poll interval only
+// catches deliveries nobody announced, such as those left by a restart or
+// created by another process. Workers are split into lanes by a Bulkhead,
+// and each lane's free workers are shared out fairly across applications
+// and endpoints by a fairScheduler.
 type Pool struct {
 	store    storage.Storage
 	worker   *Worker
-	workers  int
+	breaker  *CircuitBreaker
+	bulkhead *Bulkhead
+	guard    *Guard
+	notifier *Notifier
+	fair     map[Lane]*fairScheduler
+	id       string
+	lease    time.Duration
 	pollRate time.Duration
+	backlog  atomic.Bool // the last claim left due deliveries behind
 	log      zerolog.Logger
 	stop     chan struct{}
+	cancel   context.CancelFunc // stops the listener
 	wg       sync.WaitGroup
 }
 
 func NewPool(cfg config.DeliveryConfig, store storage.Storage, log zerolog.Logger) *Pool {
-	sender := NewSender(cfg.Timeout)
+	guard := NewGuard(cfg.Egress, cfg.Timeout)
+	sender := NewSender(cfg, guard)
 
-	schedule := cfg.RetrySchedule
-	if len(schedule) == 0 {
-		schedule = DefaultRetrySchedule
+	breaker := NewCircuitBreaker(cfg.CircuitBreaker)
+	bulkhead := NewBulkhead(cfg.Bulkhead, cfg.Workers)
+	notifier := NewNotifier()
+	moves := NewRedirectWatch(cfg.Redirects.SuggestAfter)
+	worker := NewWorker(store, sender, breaker, bulkhead, moves, notifier, DefaultPolicy(cfg), cfg.TerminalStatusCodes, log)
+
+	id := cfg.WorkerID
+	if id == "" {
+		id = defaultWorkerID()
+	}
+
+	// A lease shorter than the request timeout would let another worker
+	// claim a delivery that is still being sent.
+	lease := cfg.LeaseDuration
+	if lease <= cfg.Timeout {
+		lease = 2 * cfg.Timeout
 	}
 
-	worker := NewWorker(store, sender, cfg.MaxAttempts, schedule, log)
+	pollRate := cfg.PollInterval
+	if pollRate <= 0 {
+		pollRate = 5 * time.Second
+	}
 
 	return &Pool{
 		store:    store,
 		worker:   worker,
-		workers:  cfg.Workers,
-		pollRate: 1 * time.Second,
-		log:      log,
+		breaker:  breaker,
+		bulkhead: bulkhead,
+		guard:    guard,
+		notifier: notifier,
+		fair: map[Lane]*fairScheduler{
+			LaneMain:     newFairScheduler(cfg.EndpointConcurrency),
+			LaneIsolated: newFairScheduler(cfg.EndpointConcurrency),
+		},
+		id:       id,
+		lease:    lease,
+		pollRate: pollRate,
+		log:      log.With().Str("worker_id", id).Logger(),
 		stop:     make(chan struct{}),
 	}
 }
 
+func defaultWorkerID() string {
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		host = "piperelay"
+	}
+	return fmt.Sprintf("%s-%d", host, os.Getpid())
+}
+
+// Circuits exposes the pool's per-endpoint circuit breaker.
+func (p *Pool) Circuits() *CircuitBreaker {
+	return p.breaker
+}
+
+// Bulkhead exposes the pool's worker lanes and per-endpoint health.
+func (p *Pool) Bulkhead() *Bulkhead {
+	return p.bulkhead
+}
+
+// Guard exposes the checks that keep deliveries off internal addresses.
+func (p *Pool) Guard() *Guard {
+	return p.guard
+}
+
+// Notifier returns the notifier producers signal when they create due
+// deliveries.
+func (p *Pool) Notifier() *Notifier {
+	return p.notifier
+}
+
 func (p *Pool) Start(ctx context.Context) {
-	p.log.Info().Int("workers", p.workers).Msg("starting delivery worker pool")
+	lanes := p.bulkhead.Lanes()
+	p.log.Info().
+		Int("workers", lanes[LaneMain].Workers).
+		Int("isolated_workers", lanes[LaneIsolated].Workers).
+		Dur("lease", p.lease).
+		Dur("poll_interval", p.pollRate).
+		Msg("starting delivery worker pool")
 
 	p.wg.Add(1)
 	go func() {
 		defer p.wg.Done()
 		p.pollLoop(ctx)
 	}()
+
+	// The listener gets its own context: it blocks until cancelled, while
+	// in-flight deliveries should finish with the parent one.
+	if l, ok := p.store.(storage.DeliveryListener); ok {
+		var listenCtx context.Context
+		listenCtx, p.cancel = context.WithCancel(ctx)
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			p.listen(listenCtx, l)
+		}()
+	}
 }
 
 func (p *Pool) Stop() {
 	p.log.Info().Msg("stopping delivery worker pool")
 	close(p.stop)
+	if p.cancel != nil {
+		p.cancel()
+	}
+	p.notifier.Stop()
 	p.wg.Wait()
 	p.log.Info().Msg("delivery worker pool stopped")
 }
@@ -61,31 +156,154 @@ func (p *Pool) pollLoop(ctx context.Context) {
 	ticker := time.NewTicker(p.pollRate)
 	defer ticker.Stop()
 
-	sem := make(chan struct{}, p.workers)
-
 	for {
 		select {
 		case <-p.stop:
 			return
 		case <-ctx.Done():
 			return
+		case <-p.notifier.C():
 		case <-ticker.C:
-			deliveries, err := p.store.GetPendingDeliveries(ctx, p.workers)
+		}
+
+		// Only claim what can start right away; anything claimed but left
+		// waiting for a slot would sit on a lease nobody is using.
+		free := map[Lane]int{
+			LaneMain:     p.bulkhead.free(LaneMain),
+			LaneIsolated: p.bulkhead.free(LaneIsolated),
+		}
+		if free[LaneMain] <= 0 && free[LaneIsolated] <= 0 {
+			p.backlog.Store(true)
+			continue
+		}
+
+		// Counting one more than can be claimed shows whether anything
+		// will be left behind.
+		backlog, err := p.store.DueEndpoints(ctx, max(free[LaneMain], free[LaneIsolated])+1)
+		if err != nil {
+			p.log.Error().Err(err).Msg("failed to list due endpoints")
+			continue
+		}
+
+		// Each delivery runs in the lane its endpoint was in when it was
+		// claimed, even if the endpoint moves before it starts.
+		lanes := make(map[string]Lane, len(backlog))
+		byLane := make(map[Lane][]storage.EndpointBacklog)
+		for _, b := range backlog {
+			lane := p.bulkhead.Lane(b.EndpointID)
+			lanes[b.EndpointID] = lane
+			byLane[lane] = append(byLane[lane], b)
+		}
+		shares := make(map[string]int)
+		for lane, fair := range p.fair {
+			for id, n := range fair.shares(byLane[lane], free[lane]) {
+				shares[id] = n
+			}
+		}
+
+		// A share is a number of requests; for a batching endpoint each
+		// one takes up to a full batch, including deliveries still
+		// lingering for others to join them.
+		batches := make(map[string]*models.BatchPolicy)
+		linger := make(map[string]time.Duration)
+		for _, b := range backlog {
+			if n := shares[b.EndpointID]; n > 0 && b.Batch != nil {
+				batches[b.EndpointID] = b.Batch
+				shares[b.EndpointID] = n * max(b.Batch.MaxSize, 1)
+				linger[b.EndpointID] = time.Duration(b.Batch.Linger)
+			}
+		}
+
+		var deliveries []models.Delivery
+		if len(shares) > 0 {
+			deliveries, err = p.store.ClaimDeliveries(ctx, storage.ClaimOptions{
+				WorkerID:    p.id,
+				Lease:       p.lease,
+				PerEndpoint: shares,
+				Linger:      linger,
+			})
 			if err != nil {
-				p.log.Error().Err(err).Msg("failed to fetch pending deliveries")
+				p.log.Error().Err(err).Msg("failed to claim pending deliveries")
 				continue
 			}
+		}
+		jobs := splitBatches(deliveries, batches)
+
+		// If anything due was left behind, because workers or an
+		// endpoint's concurrency ran out, the next worker to finish claims
+		// again rather than waiting for the poll.
+		due := 0
+		for _, b := range backlog {
+			due += requests(b, b.Due)
+		}
+		p.backlog.Store(due > len(jobs))
+
+		for _, ds := range jobs {
+			p.dispatch(ctx, p.bulkhead.slots(lanes[ds[0].EndpointID]), ds, batches[ds[0].EndpointID] != nil)
+		}
+	}
+}
+
+// splitBatches groups claimed deliveries into one slice per request: a
+// delivery on its own, or up to MaxSize of them for a batching endpoint.
+// Claims come back in order per endpoint, so each batch keeps that order.
+func splitBatches(deliveries []models.Delivery, batches map[string]*models.BatchPolicy) [][]models.Delivery {
+	var jobs [][]models.Delivery
+	open := make(map[string][]models.Delivery)
+	for _, d := range deliveries {
+		batch := batches[d.EndpointID]
+		if batch == nil {
+			jobs = append(jobs, []models.Delivery{d})
+			continue
+		}
+		open[d.EndpointID] = append(open[d.EndpointID], d)
+		if len(open[d.EndpointID]) >= batch.MaxSize {
+			jobs = append(jobs, open[d.EndpointID])
+			delete(open, d.EndpointID)
+		}
+	}
+	for _, ds := range open {
+		jobs = append(jobs, ds)
+	}
+	return jobs
+}
 
-			for _, d := range deliveries {
-				d := d
-				sem <- struct{}{}
-				p.wg.Add(1)
-				go func() {
-					defer p.wg.Done()
-					defer func() { <-sem }()
-					p.worker.Process(ctx, d)
-				}()
+func (p *Pool) dispatch(ctx context.Context, sem chan struct{}, ds []models.Delivery, batch bool) {
+	sem <- struct{}{}
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		defer func() {
+			<-sem
+			if p.backlog.Load() {
+				p.notifier.Notify()
 			}
+		}()
+		if batch {
+			p.worker.ProcessBatch(ctx, ds)
+		} else {
+			p.worker.Process(ctx, ds[0])
+		}
+	}()
+}
+
+// listenRetryDelay is how long listen waits before reconnecting.
+var listenRetryDelay = 5 * time.Second
+
+// listen relays deliveries announced by other processes sharing the
+// database, reconnecting after a failure.
+func (p *Pool) listen(ctx context.Context, l storage.DeliveryListener) {
+	for {
+		err := l.ListenDeliveries(ctx, p.notifier.Notify)
+		if ctx.Err() != nil {
+			return
+		}
+		p.log.Warn().Err(err).Msg("delivery listener failed, retrying")
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(listenRetryDelay):
 		}
 	}
 }
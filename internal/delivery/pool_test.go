@@ -0,0 +1,65 @@
+package delivery
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// flakyListener announces once per connection. Its first connection fails
+// right after; later ones stay up until cancelled.
+type flakyListener struct {
+	calls chan int
+	n     int
+}
+
+func (l *flakyListener) ListenDeliveries(ctx context.Context, fn func()) error {
+	l.n++
+	l.calls <- l.n
+	fn()
+	if l.n == 1 {
+		return errors.New("connection reset")
+	}
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestPoolListenRelaysAndReconnects(t *testing.T) {
+	defer func(d time.Duration) { listenRetryDelay = d }(listenRetryDelay)
+	listenRetryDelay = time.Millisecond
+
+	p := &Pool{notifier: NewNotifier(), log: zerolog.Nop()}
+	l := &flakyListener{calls: make(chan int, 2)}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.listen(ctx, l)
+	}()
+
+	for want := 1; want <= 2; want++ {
+		select {
+		case n := <-l.calls:
+			if n != want {
+				t.Fatalf("connection %d, want %d", n, want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("connection %d never made", want)
+		}
+		select {
+		case <-p.notifier.C():
+		case <-time.After(2 * time.Second):
+			t.Fatalf("announcement on connection %d not relayed", want)
+		}
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("listen did not return after cancel")
+	}
+}
@@ -0,0 +1,71 @@
+package delivery
+
+import (
+	"sync"
+	"time"
+)
+
+// RateLimiter enforces Endpoint.RateLimit with one token bucket per
+// endpoint. Buckets hold at most one second's worth of tokens, so an idle
+// endpoint can absorb a burst of RateLimit deliveries before being paced.
+//
+// A bucket left alone for a second is full again, no different from a new
+// one, so idle buckets are dropped and endpoints that are deleted, disabled
+// or no longer limited do not leave theirs behind.
+type RateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	swept   time.Time
+	now     func() time.Time
+}
+
+type bucket struct {
+	rate   float64 // tokens per second
+	tokens float64
+	last   time.Time
+}
+
+func NewRateLimiter() *RateLimiter {
+	return &RateLimiter{buckets: make(map[string]*bucket), now: time.Now}
+}
+
+// Reserve takes a token for endpointID if one is available and returns zero.
+// Otherwise it returns how long to wait until the next token. A limit of zero
+// or less means unlimited.
+func (l *RateLimiter) Reserve(endpointID string, limit int) time.Duration {
+	if limit <= 0 {
+		return 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	if now.Sub(l.swept) >= time.Second {
+		for id, b := range l.buckets {
+			if now.Sub(b.last) >= time.Second {
+				delete(l.buckets, id)
+			}
+		}
+		l.swept = now
+	}
+
+	rate := float64(limit)
+	b, ok := l.buckets[endpointID]
+	if !ok || b.rate != rate {
+		b = &bucket{rate: rate, tokens: rate, last: now}
+		l.buckets[endpointID] = b
+	}
+
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
@@ -0,0 +1,143 @@
+package delivery
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func newTestLimiter() (*RateLimiter, *fakeClock) {
+	clock := newFakeClock()
+	l := NewRateLimiter()
+	l.now = clock.Now
+	return l, clock
+}
+
+func TestRateLimiterUnlimited(t *testing.T) {
+	l, _ := newTestLimiter()
+	for _, limit := range []int{0, -1} {
+		for i := 0; i < 100; i++ {
+			if wait := l.Reserve("ep", limit); wait != 0 {
+				t.Fatalf("limit %d: reserve %d waited %s", limit, i, wait)
+			}
+		}
+	}
+}
+
+func TestRateLimiterBurstThenPace(t *testing.T) {
+	l, _ := newTestLimiter()
+
+	// A fresh bucket is full: one second's worth goes straight through.
+	for i := 0; i < 5; i++ {
+		if wait := l.Reserve("ep", 5); wait != 0 {
+			t.Fatalf("burst reserve %d waited %s", i, wait)
+		}
+	}
+	if wait := l.Reserve("ep", 5); wait != 200*time.Millisecond {
+		t.Fatalf("empty bucket wait = %s, want 200ms", wait)
+	}
+}
+
+func TestRateLimiterRefill(t *testing.T) {
+	tests := []struct {
+		name    string
+		elapsed time.Duration
+		want    int // reservations that go through after elapsed
+	}{
+		{"none", 0, 0},
+		{"partial token", 100 * time.Millisecond, 0},
+		{"one token", 250 * time.Millisecond, 1},
+		{"two tokens", 500 * time.Millisecond, 2},
+		{"capped at one second", time.Minute, 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, clock := newTestLimiter()
+			for i := 0; i < 4; i++ {
+				l.Reserve("ep", 4)
+			}
+
+			clock.Advance(tt.elapsed)
+			got := 0
+			for l.Reserve("ep", 4) == 0 {
+				got++
+			}
+			if got != tt.want {
+				t.Fatalf("reservations = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRateLimiterWaitShrinksWithRefill(t *testing.T) {
+	l, clock := newTestLimiter()
+	l.Reserve("ep", 1)
+
+	if wait := l.Reserve("ep", 1); wait != time.Second {
+		t.Fatalf("wait = %s, want 1s", wait)
+	}
+	clock.Advance(600 * time.Millisecond)
+	if wait := l.Reserve("ep", 1); wait != 400*time.Millisecond {
+		t.Fatalf("wait = %s, want 400ms", wait)
+	}
+	clock.Advance(400 * time.Millisecond)
+	if wait := l.Reserve("ep", 1); wait != 0 {
+		t.Fatalf("wait = %s, want 0", wait)
+	}
+}
+
+func TestRateLimiterPerEndpoint(t *testing.T) {
+	l, _ := newTestLimiter()
+	l.Reserve("a", 1)
+
+	if wait := l.Reserve("a", 1); wait == 0 {
+		t.Fatal("endpoint a was not limited")
+	}
+	if wait := l.Reserve("b", 1); wait != 0 {
+		t.Fatalf("endpoint b waited %s for a's limit", wait)
+	}
+}
+
+func TestRateLimiterLimitChangeResetsBucket(t *testing.T) {
+	l, _ := newTestLimiter()
+	l.Reserve("ep", 1)
+
+	if wait := l.Reserve("ep", 10); wait != 0 {
+		t.Fatalf("wait after raising the limit = %s, want 0", wait)
+	}
+}
+
+func TestRateLimiterDropsIdleBuckets(t *testing.T) {
+	l, clock := newTestLimiter()
+	for i := 0; i < 100; i++ {
+		l.Reserve(fmt.Sprintf("ep_%d", i), 2)
+	}
+	l.Reserve("busy", 2)
+	l.Reserve("busy", 2)
+
+	clock.Advance(999 * time.Millisecond)
+	l.Reserve("busy", 2)
+	if len(l.buckets) != 101 {
+		t.Fatalf("%d buckets after 999ms, want all 101 kept", len(l.buckets))
+	}
+
+	// busy's bucket was used 1ms ago and is still refilling.
+	clock.Advance(time.Millisecond)
+	l.Reserve("busy", 2)
+	if wait := l.Reserve("busy", 2); wait == 0 {
+		t.Fatal("busy endpoint's bucket was reset")
+	}
+	if len(l.buckets) != 1 {
+		t.Fatalf("%d buckets after 1s idle, want only busy's", len(l.buckets))
+	}
+
+	// A dropped bucket comes back full, as it would have been.
+	for i := 0; i < 2; i++ {
+		if wait := l.Reserve("ep_0", 2); wait != 0 {
+			t.Fatalf("reserve %d on a dropped bucket waited %s", i, wait)
+		}
+	}
+	if wait := l.Reserve("ep_0", 2); wait == 0 {
+		t.Fatal("third reserve within a second was not paced")
+	}
+}
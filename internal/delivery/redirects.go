@@ -0,0 +1,71 @@
+package delivery
+
+import (
+	"sync"
+
+	"github.com/shohag/piperelay/internal/models"
+)
+
+// RedirectWatch notices endpoints that have moved: ones whose every request
+// ends in permanent redirects to the same URL. After suggestAfter such
+// attempts in a row it suggests that URL once. Like the circuit breaker,
+// state is kept in memory per process.
+type RedirectWatch struct {
+	suggestAfter int
+
+	mu    sync.Mutex
+	moves map[string]*move
+}
+
+type move struct {
+	target string
+	count  int
+}
+
+// NewRedirectWatch creates a watch; suggestAfter of zero never suggests.
+func NewRedirectWatch(suggestAfter int) *RedirectWatch {
+	return &RedirectWatch{suggestAfter: suggestAfter, moves: make(map[string]*move)}
+}
+
+// Observe records the redirects an attempt to endpointID got. It returns
+// the URL to suggest when this attempt is the one that makes it
+// worth suggesting, and "" otherwise.
+func (r *RedirectWatch) Observe(endpointID string, chain []models.Redirect) string {
+	if r.suggestAfter <= 0 {
+		return ""
+	}
+
+	target := permanentTarget(chain)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if target == "" {
+		delete(r.moves, endpointID)
+		return ""
+	}
+	m, ok := r.moves[endpointID]
+	if !ok || m.target != target {
+		m = &move{target: target}
+		r.moves[endpointID] = m
+	}
+	m.count++
+	if m.count == r.suggestAfter {
+		return target
+	}
+	return ""
+}
+
+// permanentTarget is where chain ends if every redirect in it is permanent,
+// or "" if it has none or any temporary one.
+func permanentTarget(chain []models.Redirect) string {
+	if len(chain) == 0 {
+		return ""
+	}
+	for _, r := range chain {
+		if !r.Permanent() {
+			return ""
+		}
+	}
+	return chain[len(chain)-1].Location
+}
@@ -1,6 +1,14 @@
 package delivery
 
-import "time"
+import (
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/shohag/piperelay/internal/config"
+	"github.com/shohag/piperelay/internal/models"
+)
 
 var DefaultRetrySchedule = []time.Duration{
 	30 * time.Second,
@@ -12,16 +20,109 @@ var DefaultRetrySchedule = []time.Duration{
 	24 * time.Hour,
 }
 
-func NextRetryTime(attemptCount int, schedule []time.Duration) *time.Time {
-	// attemptCount is 1-indexed (attempt 1 just happened, so index 0 gives delay before attempt 2)
-	idx := attemptCount - 1
-	if idx < 0 || idx >= len(schedule) {
-		return nil // no more retries
+// DefaultPolicy is the server-wide retry policy from cfg, used where neither
+// an endpoint nor its application sets one.
+func DefaultPolicy(cfg config.DeliveryConfig) models.RetryPolicy {
+	schedule := cfg.RetrySchedule
+	if len(schedule) == 0 {
+		schedule = DefaultRetrySchedule
+	}
+
+	p := models.RetryPolicy{MaxAttempts: cfg.MaxAttempts}
+	for _, d := range schedule {
+		p.Schedule = append(p.Schedule, models.Duration(d))
+	}
+	return p
+}
+
+// ResolvePolicy layers policies over base in order, each overriding the
+// fields it sets. A layer that sets a schedule or an exponential base
+// replaces the backoff below it entirely. Nil layers are skipped.
+func ResolvePolicy(base models.RetryPolicy, layers ...*models.RetryPolicy) models.RetryPolicy {
+	p := base
+	for _, l := range layers {
+		if l == nil {
+			continue
+		}
+		if l.MaxAttempts > 0 {
+			p.MaxAttempts = l.MaxAttempts
+		}
+		if len(l.Schedule) > 0 {
+			p.Schedule, p.Base, p.Cap, p.Jitter = l.Schedule, 0, 0, 0
+		} else if l.Base > 0 {
+			p.Schedule, p.Base, p.Cap, p.Jitter = nil, l.Base, l.Cap, l.Jitter
+		}
+		if l.MaxAge > 0 {
+			p.MaxAge = l.MaxAge
+		}
 	}
-	t := time.Now().UTC().Add(schedule[idx])
-	return &t
+	return p
+}
+
+// RetryDelay returns how long to wait after attempt (1-indexed) before the
+// next one, and false once p allows no further attempts.
+func RetryDelay(p models.RetryPolicy, attempt int) (time.Duration, bool) {
+	if attempt < 1 || (p.MaxAttempts > 0 && attempt >= p.MaxAttempts) {
+		return 0, false
+	}
+
+	if p.Base > 0 {
+		limit := time.Duration(p.Cap)
+		if limit <= 0 {
+			limit = maxRetryAfter
+		}
+		delay := time.Duration(p.Base)
+		for i := 1; i < attempt && delay < limit; i++ {
+			delay *= 2
+		}
+		if delay > limit {
+			delay = limit
+		}
+		// Jitter only shortens the delay, so Cap stays a hard bound.
+		if p.Jitter > 0 {
+			delay -= time.Duration(p.Jitter * rand.Float64() * float64(delay))
+		}
+		return delay, true
+	}
+
+	// Index 0 is the delay before attempt 2.
+	if attempt > len(p.Schedule) {
+		return 0, false
+	}
+	return time.Duration(p.Schedule[attempt-1]), true
 }
 
 func IsSuccess(statusCode int) bool {
 	return statusCode >= 200 && statusCode < 300
 }
+
+// maxRetryAfter caps how far a receiver can push back its next attempt.
+const maxRetryAfter = 24 * time.Hour
+
+// RetryAfter returns the delay requested by a Retry-After header on a 429 or
+// 503 response, or zero if there is none. Both the delay-seconds and
+// HTTP-date forms are accepted.
+func RetryAfter(statusCode int, header http.Header, now time.Time) time.Duration {
+	if statusCode != http.StatusTooManyRequests && statusCode != http.StatusServiceUnavailable {
+		return 0
+	}
+	v := header.Get("Retry-After")
+	if v == "" {
+		return 0
+	}
+
+	var wait time.Duration
+	if secs, err := strconv.Atoi(v); err == nil {
+		wait = time.Duration(secs) * time.Second
+	} else if t, err := http.ParseTime(v); err == nil {
+		wait = t.Sub(now)
+	}
+
+	if wait <= 0 {
+		return 0
+	}
+	if wait > maxRetryAfter {
+		return maxRetryAfter
+	}
+	return wait
+}
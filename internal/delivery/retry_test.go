@@ -0,0 +1,194 @@
+package delivery
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/shohag/piperelay/internal/models"
+)
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	date := func(d time.Duration) string {
+		return now.Add(d).Format(http.TimeFormat)
+	}
+
+	tests := []struct {
+		name   string
+		status int
+		value  string
+		want   time.Duration
+	}{
+		{"delay seconds", 429, "120", 2 * time.Minute},
+		{"delay seconds on 503", 503, "7", 7 * time.Second},
+		{"zero seconds", 429, "0", 0},
+		{"negative seconds", 429, "-30", 0},
+		{"http date", 503, date(90 * time.Second), 90 * time.Second},
+		{"http date in the past", 429, date(-time.Hour), 0},
+		{"http date now", 429, date(0), 0},
+		{"capped seconds", 429, "999999", maxRetryAfter},
+		{"capped date", 429, date(48 * time.Hour), maxRetryAfter},
+		{"garbage", 429, "soon", 0},
+		{"fractional seconds", 429, "1.5", 0},
+		{"missing", 429, "", 0},
+		{"ignored on 500", 500, "120", 0},
+		{"ignored on 200", 200, "120", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			if tt.value != "" {
+				header.Set("Retry-After", tt.value)
+			}
+			if got := RetryAfter(tt.status, header, now); got != tt.want {
+				t.Fatalf("RetryAfter(%d, %q) = %s, want %s", tt.status, tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func durations(ds ...time.Duration) []models.Duration {
+	out := make([]models.Duration, len(ds))
+	for i, d := range ds {
+		out[i] = models.Duration(d)
+	}
+	return out
+}
+
+func TestResolvePolicy(t *testing.T) {
+	global := models.RetryPolicy{MaxAttempts: 8, Schedule: durations(time.Minute, time.Hour)}
+
+	tests := []struct {
+		name   string
+		layers []*models.RetryPolicy // application, then endpoint
+		want   models.RetryPolicy
+	}{
+		{
+			name:   "global only",
+			layers: []*models.RetryPolicy{nil, nil},
+			want:   global,
+		},
+		{
+			name:   "application overrides global",
+			layers: []*models.RetryPolicy{{MaxAttempts: 3, MaxAge: models.Duration(time.Hour)}, nil},
+			want:   models.RetryPolicy{MaxAttempts: 3, Schedule: global.Schedule, MaxAge: models.Duration(time.Hour)},
+		},
+		{
+			name: "endpoint overrides application",
+			layers: []*models.RetryPolicy{
+				{MaxAttempts: 3, MaxAge: models.Duration(time.Hour)},
+				{MaxAttempts: 10, MaxAge: models.Duration(2 * time.Hour)},
+			},
+			want: models.RetryPolicy{MaxAttempts: 10, Schedule: global.Schedule, MaxAge: models.Duration(2 * time.Hour)},
+		},
+		{
+			name:   "zero fields inherit",
+			layers: []*models.RetryPolicy{{MaxAttempts: 3}, {MaxAge: models.Duration(time.Hour)}},
+			want:   models.RetryPolicy{MaxAttempts: 3, Schedule: global.Schedule, MaxAge: models.Duration(time.Hour)},
+		},
+		{
+			name:   "exponential replaces a schedule below it",
+			layers: []*models.RetryPolicy{{Base: models.Duration(time.Second), Cap: models.Duration(time.Minute), Jitter: 0.5}, nil},
+			want:   models.RetryPolicy{MaxAttempts: 8, Base: models.Duration(time.Second), Cap: models.Duration(time.Minute), Jitter: 0.5},
+		},
+		{
+			name: "schedule replaces exponential below it",
+			layers: []*models.RetryPolicy{
+				{Base: models.Duration(time.Second), Cap: models.Duration(time.Minute), Jitter: 0.5},
+				{Schedule: durations(5 * time.Second)},
+			},
+			want: models.RetryPolicy{MaxAttempts: 8, Schedule: durations(5 * time.Second)},
+		},
+		{
+			name: "exponential layers do not mix",
+			layers: []*models.RetryPolicy{
+				{Base: models.Duration(time.Second), Cap: models.Duration(time.Minute), Jitter: 0.5},
+				{Base: models.Duration(2 * time.Second)},
+			},
+			want: models.RetryPolicy{MaxAttempts: 8, Base: models.Duration(2 * time.Second)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ResolvePolicy(global, tt.layers...)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("ResolvePolicy = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryDelaySchedule(t *testing.T) {
+	p := models.RetryPolicy{Schedule: durations(time.Second, time.Minute, time.Hour)}
+
+	tests := []struct {
+		attempt int
+		max     int
+		want    time.Duration
+		ok      bool
+	}{
+		{0, 0, 0, false},
+		{1, 0, time.Second, true},
+		{2, 0, time.Minute, true},
+		{3, 0, time.Hour, true},
+		{4, 0, 0, false}, // schedule exhausted
+		{1, 2, time.Second, true},
+		{2, 2, 0, false}, // the second attempt was the last
+		{3, 10, time.Hour, true},
+	}
+	for _, tt := range tests {
+		p.MaxAttempts = tt.max
+		got, ok := RetryDelay(p, tt.attempt)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("RetryDelay(max %d, attempt %d) = %s, %v; want %s, %v", tt.max, tt.attempt, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestRetryDelayExponential(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  models.RetryPolicy
+		attempt int
+		want    time.Duration
+	}{
+		{"first retry waits base", models.RetryPolicy{Base: models.Duration(time.Second)}, 1, time.Second},
+		{"doubles per attempt", models.RetryPolicy{Base: models.Duration(time.Second)}, 4, 8 * time.Second},
+		{"stops at cap", models.RetryPolicy{Base: models.Duration(time.Second), Cap: models.Duration(10 * time.Second)}, 5, 10 * time.Second},
+		{"base above cap", models.RetryPolicy{Base: models.Duration(time.Minute), Cap: models.Duration(time.Second)}, 1, time.Second},
+		{"default cap", models.RetryPolicy{Base: models.Duration(time.Hour)}, 10, maxRetryAfter},
+		{"no overflow", models.RetryPolicy{Base: models.Duration(time.Second)}, 500, maxRetryAfter},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := RetryDelay(tt.policy, tt.attempt)
+			if !ok || got != tt.want {
+				t.Fatalf("RetryDelay = %s, %v; want %s", got, ok, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryDelayJitter(t *testing.T) {
+	for _, jitter := range []float64{0.1, 0.5, 1} {
+		p := models.RetryPolicy{Base: models.Duration(time.Second), Cap: models.Duration(8 * time.Second), Jitter: jitter}
+		for attempt := 1; attempt <= 6; attempt++ {
+			full := min(time.Second<<(attempt-1), 8*time.Second)
+			floor := full - time.Duration(jitter*float64(full))
+
+			seen := make(map[time.Duration]bool)
+			for i := 0; i < 200; i++ {
+				got, ok := RetryDelay(p, attempt)
+				if !ok || got < floor || got > full {
+					t.Fatalf("jitter %v attempt %d: delay %s, want within [%s, %s]", jitter, attempt, got, floor, full)
+				}
+				seen[got] = true
+			}
+			if len(seen) < 2 {
+				t.Fatalf("jitter %v attempt %d: every delay was the same", jitter, attempt)
+			}
+		}
+	}
+}
@@ -3,66 +3,257 @@ package delivery
 import (
 	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/shohag/piperelay/internal/config"
+	"github.com/shohag/piperelay/internal/models"
 	"github.com/shohag/piperelay/internal/signing"
 )
 
+// SendResult is the outcome of one request. FinalURL and Redirects are set
+// only if the receiver redirected it; FinalURL is the URL that gave the
+// final response, which is not where the last redirect pointed if that
+// redirect was not followed.
 type SendResult struct {
-	StatusCode   int
-	ResponseBody string
-	LatencyMs    int64
-	Error        string
+	StatusCode    int
+	Header        http.Header
+	RequestHeader http.Header
+	ResponseBody  string
+	LatencyMs     int64
+	Timing        *models.AttemptTiming
+	Error         string
+	FinalURL      string
+	Redirects     []models.Redirect
+}
+
+// Target is where a request goes and how: the endpoint's URL and signing
+// secret, its redirect policy and how many bytes of the response body to
+// keep. Zero values use the sender's defaults.
+type Target struct {
+	URL       string
+	Secret    string
+	Redirects models.RedirectPolicy
+	BodyLimit int
 }
 
 type Sender struct {
-	client *http.Client
+	client         *http.Client
+	timeout        time.Duration
+	redirects      models.RedirectPolicy
+	allowDowngrade bool
+	bodyLimit      int
 }
 
-func NewSender(timeout time.Duration) *Sender {
+// maxRedirects matches net/http's own limit.
+const maxRedirects = 10
+
+// NewSender creates a sender whose connections go through guard. It ignores
+// HTTP_PROXY and friends: a proxy would make the connection guard checks.
+func NewSender(cfg config.DeliveryConfig, guard *Guard) *Sender {
+	redirects := models.RedirectPolicy(cfg.Redirects.Policy)
+	if redirects == "" {
+		redirects = models.RedirectFollow
+	}
+	bodyLimit := cfg.ResponseBodyLimit
+	if bodyLimit <= 0 {
+		bodyLimit = 1024
+	}
 	return &Sender{
+		timeout:        cfg.Timeout,
+		redirects:      redirects,
+		allowDowngrade: cfg.Redirects.AllowDowngrade,
+		bodyLimit:      bodyLimit,
 		client: &http.Client{
-			Timeout: timeout,
+			// post follows redirects itself.
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+			Transport: &http.Transport{
+				DialContext:           guard.DialContext,
+				ForceAttemptHTTP2:     true,
+				MaxIdleConns:          100,
+				IdleConnTimeout:       90 * time.Second,
+				TLSHandshakeTimeout:   10 * time.Second,
+				ExpectContinueTimeout: 1 * time.Second,
+			},
 		},
 	}
 }
 
-func (s *Sender) Send(ctx context.Context, url, secret, messageID string, payload []byte) *SendResult {
-	start := time.Now()
+// BatchMessage is one element of a batch request body.
+type BatchMessage struct {
+	ID        string          `json:"id"`
+	EventType string          `json:"event_type"`
+	Payload   json.RawMessage `json:"payload"`
+}
 
-	signature, timestamp := signing.Sign(secret, payload)
+func (s *Sender) Send(ctx context.Context, t Target, messageID string, payload []byte) *SendResult {
+	return s.post(ctx, t, messageID, payload, nil)
+}
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+// SendBatch posts msgs to t as one JSON array, signed as a single body.
+// X-PipeRelay-ID carries batchID; each element carries its own message ID.
+func (s *Sender) SendBatch(ctx context.Context, t Target, batchID string, msgs []BatchMessage) *SendResult {
+	body, err := json.Marshal(msgs)
 	if err != nil {
-		return &SendResult{
-			Error:     fmt.Sprintf("failed to create request: %v", err),
-			LatencyMs: time.Since(start).Milliseconds(),
-		}
+		return &SendResult{Error: fmt.Sprintf("failed to encode batch: %v", err)}
+	}
+	return s.post(ctx, t, batchID, body, map[string]string{
+		"X-PipeRelay-Batch-Size": strconv.Itoa(len(msgs)),
+	})
+}
+
+func (s *Sender) post(ctx context.Context, t Target, id string, payload []byte, header map[string]string) *SendResult {
+	tr := newTracer()
+	ctx = httptrace.WithClientTrace(ctx, tr.clientTrace())
+	// The timeout covers the whole redirect chain, so a delivery never
+	// outlives its lease.
+	if s.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.timeout)
+		defer cancel()
+	}
+
+	redirects := t.Redirects
+	if redirects == "" {
+		redirects = s.redirects
+	}
+
+	bodyLimit := t.BodyLimit
+	if bodyLimit <= 0 {
+		bodyLimit = s.bodyLimit
+	}
+
+	signature, timestamp := signing.Sign(t.Secret, payload)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.URL, bytes.NewReader(payload))
+	if err != nil {
+		return tr.finish(&SendResult{Error: fmt.Sprintf("failed to create request: %v", err)})
 	}
 
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("User-Agent", "PipeRelay/1.0")
-	req.Header.Set("X-PipeRelay-ID", messageID)
+	req.Header.Set("X-PipeRelay-ID", id)
 	req.Header.Set("X-PipeRelay-Timestamp", fmt.Sprintf("%d", timestamp))
 	req.Header.Set("X-PipeRelay-Signature", signature)
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
 
-	resp, err := s.client.Do(req)
-	if err != nil {
-		return &SendResult{
-			Error:     fmt.Sprintf("request failed: %v", err),
-			LatencyMs: time.Since(start).Milliseconds(),
+	var chain []models.Redirect
+	var resp *http.Response
+	for {
+		resp, err = s.client.Do(req)
+		var blocked *BlockedError
+		if errors.As(err, &blocked) {
+			return tr.finish(&SendResult{Error: blocked.Error(), Redirects: chain})
+		}
+		if err != nil {
+			return tr.finish(&SendResult{Error: fmt.Sprintf("request failed: %v", err), Redirects: chain})
 		}
+
+		loc, ok := redirectLocation(resp)
+		if !ok {
+			break
+		}
+		r := models.Redirect{StatusCode: resp.StatusCode, Location: loc.String()}
+		if !followRedirect(redirects, s.allowDowngrade, req, resp.StatusCode, loc) {
+			r.NotFollowed = true
+			chain = append(chain, r)
+			break
+		}
+		chain = append(chain, r)
+		if len(chain) > maxRedirects {
+			resp.Body.Close()
+			return tr.finish(&SendResult{Error: fmt.Sprintf("stopped after %d redirects", maxRedirects), Redirects: chain})
+		}
+
+		// Let the connection be reused for the next request.
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+		resp.Body.Close()
+
+		next, err := http.NewRequestWithContext(ctx, http.MethodPost, loc.String(), bytes.NewReader(payload))
+		if err != nil {
+			return tr.finish(&SendResult{Error: fmt.Sprintf("failed to create request: %v", err), Redirects: chain})
+		}
+		next.Header = req.Header.Clone()
+		req = next
 	}
 	defer resp.Body.Close()
 
-	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, int64(bodyLimit)))
 
-	return &SendResult{
+	result := &SendResult{
 		StatusCode:   resp.StatusCode,
+		Header:       resp.Header,
 		ResponseBody: string(body),
-		LatencyMs:    time.Since(start).Milliseconds(),
+		Redirects:    chain,
+	}
+	if len(chain) > 0 {
+		result.FinalURL = req.URL.String()
+	}
+	return tr.finish(result)
+}
+
+// redirectLocation returns where resp redirects to, if it is a redirect.
+func redirectLocation(resp *http.Response) (*url.URL, bool) {
+	switch resp.StatusCode {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+	default:
+		return nil, false
+	}
+	loc, err := resp.Location()
+	if err != nil {
+		return nil, false
+	}
+	return loc, true
+}
+
+// followRedirect applies policy to a redirect that req got. Followed
+// redirects resend the POST with the same body and signature. That includes
+// 301 and 302, which browsers turn into a GET, but a 303 asks for exactly
+// that, so it is never followed; sending a GET would silently drop the
+// payload. A redirect from https to http would send the payload and its
+// signature in the clear, so it is only followed if allowDowngrade is set.
+func followRedirect(policy models.RedirectPolicy, allowDowngrade bool, req *http.Request, status int, loc *url.URL) bool {
+	switch {
+	case policy == models.RedirectNoFollow:
+		return false
+	case policy == models.RedirectSameHost && !sameHost(req.URL, loc):
+		return false
+	case status == http.StatusSeeOther:
+		return false
+	case !allowDowngrade && strings.EqualFold(req.URL.Scheme, "https") && !strings.EqualFold(loc.Scheme, "https"):
+		return false
+	}
+	return true
+}
+
+// sameHost reports whether a and b name the same host and port, counting
+// a missing port as the scheme's default.
+func sameHost(a, b *url.URL) bool {
+	return strings.EqualFold(a.Hostname(), b.Hostname()) && effectivePort(a) == effectivePort(b)
+}
+
+func effectivePort(u *url.URL) string {
+	if port := u.Port(); port != "" {
+		return port
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "https":
+		return "443"
+	case "http":
+		return "80"
 	}
+	return ""
 }
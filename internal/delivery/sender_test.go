@@ -0,0 +1,376 @@
+package delivery
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/shohag/piperelay/internal/config"
+	"github.com/shohag/piperelay/internal/models"
+)
+
+func newTestSender(timeout time.Duration) *Sender {
+	cfg := config.DeliveryConfig{Timeout: timeout, Egress: config.EgressConfig{AllowPrivate: true}}
+	return NewSender(cfg, NewGuard(cfg.Egress, cfg.Timeout))
+}
+
+// receiver records the requests that reach /hook.
+type receiver struct {
+	mu       sync.Mutex
+	requests []*http.Request
+	bodies   []string
+}
+
+func (rc *receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	rc.mu.Lock()
+	rc.requests = append(rc.requests, r)
+	rc.bodies = append(rc.bodies, string(body))
+	rc.mu.Unlock()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// redirecting answers /from/<code> with that redirect to loc.
+func redirecting(loc string, hook http.Handler) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/hook", hook)
+	for _, code := range []int{301, 302, 303, 307, 308} {
+		mux.HandleFunc("/from/"+strconv.Itoa(code), func(w http.ResponseWriter, r *http.Request) {
+			http.Redirect(w, r, loc, code)
+		})
+	}
+	return httptest.NewServer(mux)
+}
+
+func TestSenderRedirects(t *testing.T) {
+	other := &receiver{}
+	elsewhere := httptest.NewServer(other)
+	defer elsewhere.Close()
+
+	tests := []struct {
+		name     string
+		status   int
+		policy   models.RedirectPolicy
+		offHost  bool
+		followed bool
+	}{
+		{"301 resends the POST", 301, models.RedirectFollow, false, true},
+		{"302 resends the POST", 302, models.RedirectFollow, false, true},
+		{"307", 307, models.RedirectFollow, false, true},
+		{"308", 308, models.RedirectFollow, false, true},
+		{"303 would drop the payload", 303, models.RedirectFollow, false, false},
+		{"to another host", 301, models.RedirectFollow, true, true},
+		{"no-follow", 307, models.RedirectNoFollow, false, false},
+		{"same-host on the same host", 301, models.RedirectSameHost, false, true},
+		{"same-host to another host", 301, models.RedirectSameHost, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hook := &receiver{}
+			loc, got := "/hook", hook
+			if tt.offHost {
+				loc, got = elsewhere.URL+"/hook", other
+				other.requests, other.bodies = nil, nil
+			}
+			srv := redirecting(loc, hook)
+			defer srv.Close()
+			target := srv.URL + "/hook"
+			if tt.offHost {
+				target = loc
+			}
+			start := srv.URL + "/from/" + strconv.Itoa(tt.status)
+
+			result := newTestSender(5*time.Second).Send(context.Background(), Target{URL: start, Secret: "secret", Redirects: tt.policy}, "msg_1", []byte(`{"n":1}`))
+			if result.Error != "" {
+				t.Fatal(result.Error)
+			}
+
+			wantChain := []models.Redirect{{StatusCode: tt.status, Location: target, NotFollowed: !tt.followed}}
+			if len(result.Redirects) != 1 || result.Redirects[0] != wantChain[0] {
+				t.Fatalf("redirects = %+v, want %+v", result.Redirects, wantChain)
+			}
+			if !tt.followed {
+				// The redirect itself answered, from the URL first asked.
+				if result.StatusCode != tt.status || result.FinalURL != start {
+					t.Fatalf("status %d from %q, want %d from %q", result.StatusCode, result.FinalURL, tt.status, start)
+				}
+				if len(got.requests) != 0 {
+					t.Fatalf("the redirect was followed %d times", len(got.requests))
+				}
+				return
+			}
+
+			if result.StatusCode != http.StatusNoContent || result.FinalURL != target {
+				t.Fatalf("status %d from %q, want 204 from %q", result.StatusCode, result.FinalURL, target)
+			}
+			if len(got.requests) != 1 {
+				t.Fatalf("target got %d requests, want 1", len(got.requests))
+			}
+			r := got.requests[0]
+			if r.Method != http.MethodPost || got.bodies[0] != `{"n":1}` || r.Header.Get("X-PipeRelay-Signature") == "" || r.Header.Get("X-PipeRelay-ID") != "msg_1" {
+				t.Fatalf("target got %s %q with headers %v", r.Method, got.bodies[0], r.Header)
+			}
+		})
+	}
+}
+
+func TestFollowRedirect(t *testing.T) {
+	tests := []struct {
+		name      string
+		policy    models.RedirectPolicy
+		downgrade bool
+		from, to  string
+		followed  bool
+	}{
+		{"same host", models.RedirectSameHost, false, "https://hooks.example.com/a", "https://hooks.example.com/b", true},
+		{"default https port", models.RedirectSameHost, false, "https://hooks.example.com/a", "https://hooks.example.com:443/b", true},
+		{"default http port", models.RedirectSameHost, false, "http://hooks.example.com:80/a", "http://hooks.example.com/b", true},
+		{"host in other case", models.RedirectSameHost, false, "https://hooks.example.com/a", "https://HOOKS.example.com/b", true},
+		{"IPv6 default port", models.RedirectSameHost, false, "https://[2606:2800:220:1::1]/a", "https://[2606:2800:220:1::1]:443/b", true},
+		{"other port", models.RedirectSameHost, false, "https://hooks.example.com/a", "https://hooks.example.com:8443/b", false},
+		{"other host", models.RedirectSameHost, false, "https://hooks.example.com/a", "https://evil.example.com/b", false},
+		{"http to https", models.RedirectSameHost, false, "http://hooks.example.com/a", "https://hooks.example.com/b", false},
+
+		{"upgrade", models.RedirectFollow, false, "http://hooks.example.com/a", "https://hooks.example.com/b", true},
+		{"downgrade", models.RedirectFollow, false, "https://hooks.example.com/a", "http://hooks.example.com/b", false},
+		{"downgrade on the same port", models.RedirectSameHost, false, "https://hooks.example.com:8080/a", "http://hooks.example.com:8080/b", false},
+		{"downgrade allowed", models.RedirectFollow, true, "https://hooks.example.com/a", "http://hooks.example.com/b", true},
+		{"downgrade allowed on the same port", models.RedirectSameHost, true, "https://hooks.example.com:8080/a", "http://hooks.example.com:8080/b", true},
+		{"downgrade allowed with no-follow", models.RedirectNoFollow, true, "https://hooks.example.com/a", "http://hooks.example.com/b", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, tt.from, nil)
+			loc, err := url.Parse(tt.to)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := followRedirect(tt.policy, tt.downgrade, req, http.StatusTemporaryRedirect, loc); got != tt.followed {
+				t.Fatalf("followRedirect(%s, %s -> %s) = %v, want %v", tt.policy, tt.from, tt.to, got, tt.followed)
+			}
+		})
+	}
+}
+
+func TestSenderRefusesDowngrade(t *testing.T) {
+	hook := &receiver{}
+	plain := httptest.NewServer(hook)
+	defer plain.Close()
+	secure := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, plain.URL+"/hook", http.StatusPermanentRedirect)
+	}))
+	defer secure.Close()
+
+	for _, allow := range []bool{false, true} {
+		cfg := config.DeliveryConfig{
+			Timeout:   5 * time.Second,
+			Egress:    config.EgressConfig{AllowPrivate: true},
+			Redirects: config.RedirectConfig{AllowDowngrade: allow},
+		}
+		s := NewSender(cfg, NewGuard(cfg.Egress, cfg.Timeout))
+		s.client.Transport.(*http.Transport).TLSClientConfig = secure.Client().Transport.(*http.Transport).TLSClientConfig
+
+		result := s.Send(context.Background(), Target{URL: secure.URL + "/from"}, "msg_1", []byte(`{}`))
+		if result.Error != "" {
+			t.Fatal(result.Error)
+		}
+		if len(result.Redirects) != 1 || result.Redirects[0].NotFollowed == allow {
+			t.Fatalf("allow_downgrade %v: redirects = %+v", allow, result.Redirects)
+		}
+		wantStatus, wantRequests := http.StatusPermanentRedirect, 0
+		if allow {
+			wantStatus, wantRequests = http.StatusNoContent, 1
+		}
+		if result.StatusCode != wantStatus || len(hook.requests) != wantRequests {
+			t.Fatalf("allow_downgrade %v: status %d, %d requests over http; want %d and %d", allow, result.StatusCode, len(hook.requests), wantStatus, wantRequests)
+		}
+	}
+}
+
+func TestSenderRedirectChain(t *testing.T) {
+	hook := &receiver{}
+	mux := http.NewServeMux()
+	mux.Handle("/hook", hook)
+	mux.HandleFunc("/a", func(w http.ResponseWriter, r *http.Request) { http.Redirect(w, r, "/b", http.StatusMovedPermanently) })
+	mux.HandleFunc("/b", func(w http.ResponseWriter, r *http.Request) { http.Redirect(w, r, "/hook", http.StatusFound) })
+	mux.HandleFunc("/c", func(w http.ResponseWriter, r *http.Request) { http.Redirect(w, r, "/see", http.StatusSeeOther) })
+	mux.HandleFunc("/loop", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/loop", http.StatusTemporaryRedirect)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	s := newTestSender(5 * time.Second)
+	ctx := context.Background()
+
+	result := s.Send(ctx, Target{URL: srv.URL + "/a"}, "msg_1", []byte(`{}`))
+	want := []models.Redirect{{StatusCode: 301, Location: srv.URL + "/b"}, {StatusCode: 302, Location: srv.URL + "/hook"}}
+	if result.StatusCode != http.StatusNoContent || result.FinalURL != srv.URL+"/hook" || len(result.Redirects) != 2 || result.Redirects[0] != want[0] || result.Redirects[1] != want[1] {
+		t.Fatalf("result = %d from %q via %+v", result.StatusCode, result.FinalURL, result.Redirects)
+	}
+
+	// Stopping partway, the final URL is the one that sent the 303.
+	mux.HandleFunc("/d", func(w http.ResponseWriter, r *http.Request) { http.Redirect(w, r, "/c", http.StatusTemporaryRedirect) })
+	result = s.Send(ctx, Target{URL: srv.URL + "/d"}, "msg_2", []byte(`{}`))
+	want = []models.Redirect{{StatusCode: 307, Location: srv.URL + "/c"}, {StatusCode: 303, Location: srv.URL + "/see", NotFollowed: true}}
+	if result.StatusCode != http.StatusSeeOther || result.FinalURL != srv.URL+"/c" || len(result.Redirects) != 2 || result.Redirects[0] != want[0] || result.Redirects[1] != want[1] {
+		t.Fatalf("result = %d from %q via %+v", result.StatusCode, result.FinalURL, result.Redirects)
+	}
+
+	result = s.Send(ctx, Target{URL: srv.URL + "/loop"}, "msg_3", []byte(`{}`))
+	if !strings.Contains(result.Error, "stopped after 10 redirects") || len(result.Redirects) != maxRedirects+1 {
+		t.Fatalf("loop: error %q after %d redirects", result.Error, len(result.Redirects))
+	}
+}
+
+func TestSenderTimeoutCoversRedirects(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(60 * time.Millisecond)
+		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	result := newTestSender(200*time.Millisecond).Send(context.Background(), Target{URL: srv.URL + "/"}, "msg_1", []byte(`{}`))
+	if !strings.Contains(result.Error, "deadline exceeded") {
+		t.Fatalf("error = %q after %d redirects, want a timeout", result.Error, len(result.Redirects))
+	}
+	if n := len(result.Redirects); n < 2 || n > 4 {
+		t.Fatalf("timed out after %d redirects, want about 3", n)
+	}
+}
+
+// TestSenderRecordsAttempt sends to a receiver and checks what the worker
+// stores on the attempt: the headers both ways, with the signature and
+// credentials redacted, the phase timings and the start of the body.
+func TestSenderRecordsAttempt(t *testing.T) {
+	const delay = 30 * time.Millisecond
+	body := strings.Repeat("x", 5000)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		time.Sleep(delay)
+		w.Header().Set("X-Request-Id", "req_1")
+		w.Header().Set("Set-Cookie", "session=abc")
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusBadGateway)
+		io.WriteString(w, body)
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		name      string
+		limit     int // delivery.response_body_limit
+		appLimit  int // the application's response_body_limit
+		wantBytes int
+	}{
+		{"default limit", 0, 0, 1024},
+		{"server limit", 2000, 0, 2000},
+		{"application limit over the server's", 2000, 100, 100},
+		{"body shorter than the limit", 0, 64 * 1024, len(body)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			store := newTestStore(t)
+			ep := createEndpoint(t, store)
+			ep.URL = srv.URL + "/hook"
+			app, err := store.GetApplication(ctx, ep.AppID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			app.ResponseBodyLimit = tt.appLimit
+			if err := store.UpdateApplication(ctx, app); err != nil {
+				t.Fatal(err)
+			}
+
+			w, _ := newTestWorker(store, config.CircuitBreakerConfig{})
+			cfg := config.DeliveryConfig{Timeout: 5 * time.Second, ResponseBodyLimit: tt.limit, Egress: config.EgressConfig{AllowPrivate: true}}
+			w.sender = NewSender(cfg, NewGuard(cfg.Egress, cfg.Timeout))
+
+			msg, d := createDelivery(t, store, ep, time.Now().UTC(), nil)
+			result := w.sender.Send(ctx, w.target(ctx, ep), d.ID, []byte(`{"n":1}`))
+			if result.Error != "" {
+				t.Fatal(result.Error)
+			}
+			w.finish(ctx, d, msg, nil, result, outcome{})
+
+			attempts, err := store.GetAttemptsByDelivery(ctx, d.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(attempts) != 1 {
+				t.Fatalf("%d attempts recorded, want 1", len(attempts))
+			}
+			a := attempts[0]
+
+			if a.StatusCode != http.StatusBadGateway || a.ResponseBody != body[:tt.wantBytes] {
+				t.Fatalf("status %d with a %d byte body, want %d with %d bytes", a.StatusCode, len(a.ResponseBody), http.StatusBadGateway, tt.wantBytes)
+			}
+
+			sent := map[string]string{
+				"Content-Type":          "application/json",
+				"Content-Length":        "7",
+				"User-Agent":            "PipeRelay/1.0",
+				"X-Piperelay-Id":        d.ID,
+				"X-Piperelay-Signature": "[redacted]",
+			}
+			for key, want := range sent {
+				if got := a.RequestHeaders.Get(key); got != want {
+					t.Errorf("request header %s = %q, want %q", key, got, want)
+				}
+			}
+			if a.RequestHeaders.Get("X-Piperelay-Timestamp") == "" {
+				t.Error("no request timestamp header recorded")
+			}
+			received := map[string]string{
+				"X-Request-Id": "req_1",
+				"Set-Cookie":   "[redacted]",
+				"Content-Type": "text/plain",
+			}
+			for key, want := range received {
+				if got := a.ResponseHeaders.Get(key); got != want {
+					t.Errorf("response header %s = %q, want %q", key, got, want)
+				}
+			}
+
+			// The receiver is local, so the wait before its first byte is
+			// most of the request.
+			timing := a.Timing
+			if timing == nil {
+				t.Fatal("no timing recorded")
+			}
+			if timing.FirstByteMs < delay.Milliseconds() || timing.TotalMs < timing.FirstByteMs || timing.TotalMs > 5000 {
+				t.Fatalf("timing %+v, want a first byte after at least %s", timing, delay)
+			}
+			if timing.DNSMs != 0 || timing.TLSMs != 0 {
+				t.Fatalf("timing %+v has DNS or TLS for a plain http address", timing)
+			}
+			if a.LatencyMs != timing.TotalMs {
+				t.Fatalf("latency %dms, total %dms", a.LatencyMs, timing.TotalMs)
+			}
+		})
+	}
+}
+
+// The result keeps the signature: only the stored attempt leaves it out.
+func TestSenderResultKeepsSignature(t *testing.T) {
+	hook := &receiver{}
+	srv := httptest.NewServer(hook)
+	defer srv.Close()
+
+	result := newTestSender(5*time.Second).Send(context.Background(), Target{URL: srv.URL, Secret: "secret"}, "msg_1", []byte(`{}`))
+	if result.Error != "" {
+		t.Fatal(result.Error)
+	}
+	sent := hook.requests[0].Header.Get("X-PipeRelay-Signature")
+	if sent == "" || result.RequestHeader.Get("X-PipeRelay-Signature") != sent {
+		t.Fatalf("result signature %q, sent %q", result.RequestHeader.Get("X-PipeRelay-Signature"), sent)
+	}
+}
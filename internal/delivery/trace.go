@@ -0,0 +1,116 @@
+package delivery
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptrace"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shohag/piperelay/internal/models"
+)
+
+// tracer times the phases of a request through httptrace and records the
+// headers it was sent with, as written on the wire. After a redirect the
+// headers are those of the last request.
+type tracer struct {
+	start time.Time
+
+	mu           sync.Mutex
+	dnsStart     time.Time
+	connectStart time.Time
+	tlsStart     time.Time
+	dns          time.Duration
+	connect      time.Duration
+	tls          time.Duration
+	firstByte    time.Duration
+	header       http.Header
+}
+
+func newTracer() *tracer {
+	return &tracer{start: time.Now(), header: make(http.Header)}
+}
+
+func (t *tracer) clientTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		GetConn: func(string) {
+			t.mu.Lock()
+			t.header = make(http.Header)
+			t.mu.Unlock()
+		},
+		DNSStart: func(httptrace.DNSStartInfo) {
+			t.mu.Lock()
+			t.dnsStart = time.Now()
+			t.mu.Unlock()
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			t.mu.Lock()
+			t.dns += time.Since(t.dnsStart)
+			t.mu.Unlock()
+		},
+		// Dialing several addresses at once starts overlapping connects;
+		// the phase runs from the first start to the first to finish.
+		ConnectStart: func(_, _ string) {
+			t.mu.Lock()
+			if t.connectStart.IsZero() {
+				t.connectStart = time.Now()
+			}
+			t.mu.Unlock()
+		},
+		ConnectDone: func(_, _ string, err error) {
+			t.mu.Lock()
+			if err == nil && !t.connectStart.IsZero() {
+				t.connect += time.Since(t.connectStart)
+				t.connectStart = time.Time{}
+			}
+			t.mu.Unlock()
+		},
+		TLSHandshakeStart: func() {
+			t.mu.Lock()
+			t.tlsStart = time.Now()
+			t.mu.Unlock()
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			t.mu.Lock()
+			t.tls += time.Since(t.tlsStart)
+			t.mu.Unlock()
+		},
+		WroteHeaderField: func(key string, value []string) {
+			// HTTP/2 pseudo-headers such as :authority are not headers.
+			if strings.HasPrefix(key, ":") {
+				return
+			}
+			t.mu.Lock()
+			key = http.CanonicalHeaderKey(key)
+			t.header[key] = append(t.header[key], value...)
+			t.mu.Unlock()
+		},
+		GotFirstResponseByte: func() {
+			t.mu.Lock()
+			t.firstByte = time.Since(t.start)
+			t.mu.Unlock()
+		},
+	}
+}
+
+// finish stamps result with the request headers and timings recorded so far.
+func (t *tracer) finish(result *SendResult) *SendResult {
+	total := time.Since(t.start)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	result.LatencyMs = total.Milliseconds()
+	result.Timing = &models.AttemptTiming{
+		DNSMs:       t.dns.Milliseconds(),
+		ConnectMs:   t.connect.Milliseconds(),
+		TLSMs:       t.tls.Milliseconds(),
+		FirstByteMs: t.firstByte.Milliseconds(),
+		TotalMs:     total.Milliseconds(),
+	}
+	if len(t.header) > 0 {
+		result.RequestHeader = t.header
+	}
+	return result
+}
@@ -2,6 +2,9 @@ package delivery
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"net/http"
 	"time"
 
 	"github.com/rs/zerolog"
@@ -10,62 +13,341 @@ import (
 )
 
 type Worker struct {
-	store         storage.Storage
-	sender        *Sender
-	maxAttempts   int
-	retrySchedule []time.Duration
-	log           zerolog.Logger
+	store    storage.Storage
+	sender   *Sender
+	limiter  *RateLimiter
+	breaker  *CircuitBreaker
+	bulkhead *Bulkhead
+	moves    *RedirectWatch
+	notifier *Notifier
+	policy   models.RetryPolicy
+	terminal map[int]bool
+	log      zerolog.Logger
 }
 
-func NewWorker(store storage.Storage, sender *Sender, maxAttempts int, retrySchedule []time.Duration, log zerolog.Logger) *Worker {
+// NewWorker creates a worker. notifier is told when rescheduled deliveries
+// fall due again. policy applies to deliveries that were created without a
+// recorded retry policy of their own.
+func NewWorker(store storage.Storage, sender *Sender, breaker *CircuitBreaker, bulkhead *Bulkhead, moves *RedirectWatch, notifier *Notifier, policy models.RetryPolicy, terminalStatusCodes []int, log zerolog.Logger) *Worker {
+	terminal := make(map[int]bool, len(terminalStatusCodes))
+	for _, code := range terminalStatusCodes {
+		terminal[code] = true
+	}
+
 	return &Worker{
-		store:         store,
-		sender:        sender,
-		maxAttempts:   maxAttempts,
-		retrySchedule: retrySchedule,
-		log:           log,
+		store:    store,
+		sender:   sender,
+		limiter:  NewRateLimiter(),
+		breaker:  breaker,
+		bulkhead: bulkhead,
+		moves:    moves,
+		notifier: notifier,
+		policy:   policy,
+		terminal: terminal,
+		log:      log,
 	}
 }
 
+// defaultBatchBytes bounds a batch's payload when its endpoint sets no
+// max_bytes.
+const defaultBatchBytes = 1 << 20
+
+// outcome classifies the response to one request.
+type outcome struct {
+	succeeded bool
+	gone      bool
+	terminal  bool
+}
+
 func (w *Worker) Process(ctx context.Context, d models.Delivery) {
 	msg, err := w.store.GetMessage(ctx, d.MessageID)
-	if err != nil || msg == nil {
+	if err != nil {
 		w.log.Error().Err(err).Str("delivery_id", d.ID).Msg("failed to get message for delivery")
+		w.unlock(ctx, []models.Delivery{d})
+		return
+	}
+	if msg == nil {
+		w.drop(ctx, d, "message no longer exists")
 		return
 	}
 
 	ep, err := w.store.GetEndpoint(ctx, d.EndpointID)
-	if err != nil || ep == nil {
+	if err != nil {
 		w.log.Error().Err(err).Str("delivery_id", d.ID).Msg("failed to get endpoint for delivery")
+		w.unlock(ctx, []models.Delivery{d})
+		return
+	}
+	if ep == nil {
+		w.drop(ctx, d, "endpoint no longer exists")
+		return
+	}
+
+	expiresAt := expiry(msg, ep)
+	if expiresAt != nil && !time.Now().Before(*expiresAt) {
+		w.expire(ctx, d, *expiresAt)
 		return
 	}
 
 	if !ep.Active {
 		w.log.Info().Str("delivery_id", d.ID).Msg("skipping delivery to inactive endpoint")
+		w.unlock(ctx, []models.Delivery{d})
+		return
+	}
+
+	if !w.admit(ctx, ep, []models.Delivery{d}) {
+		return
+	}
+
+	result := w.sender.Send(ctx, w.target(ctx, ep), msg.ID, msg.Payload)
+	w.finish(ctx, d, msg, expiresAt, result, w.judge(ctx, ep, result))
+}
+
+type batchEntry struct {
+	delivery  models.Delivery
+	msg       *models.Message
+	expiresAt *time.Time
+}
+
+// ProcessBatch sends ds, deliveries to one batching endpoint, in a single
+// request. Deliveries that would take the batch past the endpoint's max
+// bytes are handed back for the next one. Each delivery sent gets its own
+// attempt record and is retried on its own schedule.
+func (w *Worker) ProcessBatch(ctx context.Context, ds []models.Delivery) {
+	ep, err := w.store.GetEndpoint(ctx, ds[0].EndpointID)
+	if err != nil {
+		w.log.Error().Err(err).Str("endpoint_id", ds[0].EndpointID).Msg("failed to get endpoint for batch")
+		w.unlock(ctx, ds)
+		return
+	}
+	if ep == nil {
+		for _, d := range ds {
+			w.drop(ctx, d, "endpoint no longer exists")
+		}
+		return
+	}
+
+	// The endpoint stopped batching after these were claimed.
+	if ep.Batch == nil {
+		for _, d := range ds {
+			w.Process(ctx, d)
+		}
+		return
+	}
+
+	maxBytes := ep.Batch.MaxBytes
+	if maxBytes <= 0 {
+		maxBytes = defaultBatchBytes
+	}
+
+	var batch []batchEntry
+	size := 0
+	for i, d := range ds {
+		msg, err := w.store.GetMessage(ctx, d.MessageID)
+		if err != nil {
+			w.log.Error().Err(err).Str("delivery_id", d.ID).Msg("failed to get message for delivery")
+			w.unlock(ctx, []models.Delivery{d})
+			continue
+		}
+		if msg == nil {
+			w.drop(ctx, d, "message no longer exists")
+			continue
+		}
+
+		expiresAt := expiry(msg, ep)
+		if expiresAt != nil && !time.Now().Before(*expiresAt) {
+			w.expire(ctx, d, *expiresAt)
+			continue
+		}
+
+		// A message larger than max bytes on its own still goes, alone.
+		if len(batch) > 0 && size+len(msg.Payload) > maxBytes {
+			w.release(ctx, ds[i:])
+			break
+		}
+		size += len(msg.Payload)
+		batch = append(batch, batchEntry{delivery: d, msg: msg, expiresAt: expiresAt})
+	}
+	if len(batch) == 0 {
+		return
+	}
+
+	deliveries := make([]models.Delivery, len(batch))
+	msgs := make([]BatchMessage, len(batch))
+	for i, e := range batch {
+		deliveries[i] = e.delivery
+		msgs[i] = BatchMessage{ID: e.msg.ID, EventType: e.msg.EventType, Payload: e.msg.Payload}
+	}
+
+	if !ep.Active {
+		w.log.Info().Str("endpoint_id", ep.ID).Int("deliveries", len(batch)).Msg("skipping batch to inactive endpoint")
+		w.unlock(ctx, deliveries)
+		return
+	}
+	if !w.admit(ctx, ep, deliveries) {
 		return
 	}
 
-	result := w.sender.Send(ctx, ep.URL, ep.Secret, msg.ID, msg.Payload)
+	batchID := models.NewID("batch")
+	result := w.sender.SendBatch(ctx, w.target(ctx, ep), batchID, msgs)
+	w.log.Debug().
+		Str("batch_id", batchID).
+		Str("endpoint_id", ep.ID).
+		Int("messages", len(msgs)).
+		Int("bytes", size).
+		Msg("batch sent")
+
+	out := w.judge(ctx, ep, result)
+	for _, e := range batch {
+		w.finish(ctx, e.delivery, e.msg, e.expiresAt, result, out)
+	}
+}
+
+// target describes how to send to ep. The response body limit is read from
+// its application on every attempt, so a change applies to the next one.
+func (w *Worker) target(ctx context.Context, ep *models.Endpoint) Target {
+	t := Target{URL: ep.URL, Secret: ep.Secret, Redirects: ep.RedirectPolicy}
+	app, err := w.store.GetApplication(ctx, ep.AppID)
+	if err != nil {
+		w.log.Warn().Err(err).Str("endpoint_id", ep.ID).Msg("failed to get application, using default response body limit")
+	} else if app != nil {
+		t.BodyLimit = app.ResponseBodyLimit
+	}
+	return t
+}
+
+// admit checks ep's circuit breaker and rate limit before a request that
+// carries ds. If the request cannot go yet, ds are rescheduled and admit
+// returns false. The rate limit counts requests, so a batch takes a single
+// token.
+func (w *Worker) admit(ctx context.Context, ep *models.Endpoint, ds []models.Delivery) bool {
+	if ok, probeAt := w.breaker.Allow(ep.ID); !ok {
+		for _, d := range ds {
+			w.log.Debug().
+				Str("delivery_id", d.ID).
+				Str("endpoint_id", ep.ID).
+				Time("next_probe", probeAt).
+				Msg("circuit open, holding delivery")
+			w.postpone(ctx, d, probeAt)
+		}
+		return false
+	}
+
+	if wait := w.limiter.Reserve(ep.ID, ep.RateLimit); wait > 0 {
+		for _, d := range ds {
+			w.throttle(ctx, d, wait)
+		}
+		return false
+	}
+	return true
+}
+
+// judge classifies the response to a request to ep and feeds it to the
+// bulkhead, circuit breaker and redirect watch, once per request however
+// many deliveries it carried.
+func (w *Worker) judge(ctx context.Context, ep *models.Endpoint, result *SendResult) outcome {
+	out := outcome{
+		succeeded: result.Error == "" && IsSuccess(result.StatusCode),
+		gone:      result.Error == "" && result.StatusCode == http.StatusGone,
+		terminal:  result.Error == "" && w.terminal[result.StatusCode],
+	}
+	failed := !out.succeeded && !out.gone && !out.terminal
+
+	if lane, moved := w.bulkhead.Record(ep.ID, time.Duration(result.LatencyMs)*time.Millisecond, failed); moved {
+		health := w.bulkhead.Status(ep.ID)
+		w.log.Warn().
+			Str("endpoint_id", ep.ID).
+			Str("lane", string(lane)).
+			Int64("latency_ms", health.LatencyMs).
+			Float64("failure_rate", health.FailureRate).
+			Msg("endpoint moved to another delivery lane")
+	}
+
+	switch {
+	case out.succeeded:
+		w.breaker.Success(ep.ID)
+	case out.gone:
+		w.disableEndpoint(ctx, ep.ID, "endpoint responded 410 Gone")
+	case out.terminal:
+		// The receiver rejected this message, not the traffic; the
+		// endpoint itself may be perfectly healthy.
+	default:
+		if open := w.breaker.Failure(ep.ID); open > 0 {
+			w.disableEndpoint(ctx, ep.ID, fmt.Sprintf("circuit breaker open for %s", open.Round(time.Second)))
+		}
+	}
+
+	if target := w.moves.Observe(ep.ID, result.Redirects); target != "" && target != ep.SuggestedURL {
+		if err := w.store.SuggestEndpointURL(ctx, ep.ID, target); err != nil {
+			w.log.Error().Err(err).Str("endpoint_id", ep.ID).Msg("failed to record suggested endpoint url")
+		} else {
+			w.log.Warn().
+				Str("endpoint_id", ep.ID).
+				Str("url", ep.URL).
+				Str("suggested_url", target).
+				Msg("endpoint keeps redirecting permanently, suggesting a new url")
+		}
+	}
+	return out
+}
+
+// redacted are headers whose values are not stored on attempts: the
+// signature, which with the payload could be replayed to the receiver, and
+// credentials in either direction.
+var redacted = []string{
+	"Authorization",
+	"Cookie",
+	"Proxy-Authorization",
+	"Set-Cookie",
+	"X-PipeRelay-Signature",
+}
+
+// redact returns a copy of h with the values of redacted headers replaced.
+func redact(h http.Header) http.Header {
+	if h == nil {
+		return nil
+	}
+	h = h.Clone()
+	for _, key := range redacted {
+		key = http.CanonicalHeaderKey(key)
+		if _, ok := h[key]; ok {
+			h[key] = []string{"[redacted]"}
+		}
+	}
+	return h
+}
 
+// finish records an attempt of d that got result and moves d to its next
+// status: done, failed, expired or scheduled for a retry.
+func (w *Worker) finish(ctx context.Context, d models.Delivery, msg *models.Message, expiresAt *time.Time, result *SendResult, out outcome) {
 	d.AttemptCount++
 	now := time.Now().UTC()
 
+	policy := w.policy
+	if d.RetryPolicy != nil {
+		policy = *d.RetryPolicy
+	}
+
 	attempt := &models.Attempt{
-		ID:            models.NewID("att"),
-		DeliveryID:    d.ID,
-		AttemptNumber: d.AttemptCount,
-		StatusCode:    result.StatusCode,
-		ResponseBody:  result.ResponseBody,
-		LatencyMs:     result.LatencyMs,
-		Error:         result.Error,
-		CreatedAt:     now.Format(time.RFC3339),
+		ID:              models.NewID("att"),
+		DeliveryID:      d.ID,
+		AttemptNumber:   d.AttemptCount,
+		StatusCode:      result.StatusCode,
+		RequestHeaders:  redact(result.RequestHeader),
+		ResponseHeaders: redact(result.Header),
+		ResponseBody:    result.ResponseBody,
+		LatencyMs:       result.LatencyMs,
+		Timing:          result.Timing,
+		Error:           result.Error,
+		FinalURL:        result.FinalURL,
+		Redirects:       result.Redirects,
+		CreatedAt:       now.Format(time.RFC3339),
 	}
 
 	if err := w.store.CreateAttempt(ctx, attempt); err != nil {
 		w.log.Error().Err(err).Str("delivery_id", d.ID).Msg("failed to record attempt")
 	}
 
-	if result.Error == "" && IsSuccess(result.StatusCode) {
+	if out.succeeded {
 		d.Status = models.DeliverySuccess
 		d.NextRetryAt = nil
 		w.log.Info().
@@ -73,7 +355,15 @@ func (w *Worker) Process(ctx context.Context, d models.Delivery) {
 			Int("status_code", result.StatusCode).
 			Int64("latency_ms", result.LatencyMs).
 			Msg("delivery succeeded")
-	} else if d.AttemptCount >= w.maxAttempts {
+	} else if out.gone || out.terminal {
+		d.Status = models.DeliveryFailed
+		d.NextRetryAt = nil
+		w.log.Warn().
+			Str("delivery_id", d.ID).
+			Int("attempts", d.AttemptCount).
+			Int("status_code", result.StatusCode).
+			Msg("delivery failed with non-retryable status")
+	} else if wait, ok := RetryDelay(policy, d.AttemptCount); !ok {
 		d.Status = models.DeliveryFailed
 		d.NextRetryAt = nil
 		w.log.Warn().
@@ -82,16 +372,191 @@ func (w *Worker) Process(ctx context.Context, d models.Delivery) {
 			Str("error", result.Error).
 			Msg("delivery permanently failed")
 	} else {
-		d.Status = models.DeliveryRetrying
-		d.NextRetryAt = NextRetryTime(d.AttemptCount, w.retrySchedule)
-		w.log.Info().
-			Str("delivery_id", d.ID).
-			Int("attempt", d.AttemptCount).
-			Time("next_retry", *d.NextRetryAt).
-			Msg("delivery scheduled for retry")
+		if after := RetryAfter(result.StatusCode, result.Header, now); after > 0 {
+			wait = after
+		}
+		next := now.Add(wait)
+
+		switch {
+		case expiresAt != nil && !next.Before(*expiresAt):
+			// The retry would never be sent; settle it now rather than
+			// holding the delivery until then.
+			d.Status = models.DeliveryExpired
+			d.NextRetryAt = nil
+			w.log.Info().
+				Str("delivery_id", d.ID).
+				Int("attempts", d.AttemptCount).
+				Time("expires_at", *expiresAt).
+				Msg("delivery expired before its next retry")
+		case policy.MaxAge > 0 && next.After(dueAt(msg).Add(time.Duration(policy.MaxAge))):
+			d.Status = models.DeliveryFailed
+			d.NextRetryAt = nil
+			w.log.Warn().
+				Str("delivery_id", d.ID).
+				Int("attempts", d.AttemptCount).
+				Str("error", result.Error).
+				Msg("delivery failed, retry policy max age reached")
+		default:
+			d.Status = models.DeliveryRetrying
+			d.NextRetryAt = &next
+			w.log.Info().
+				Str("delivery_id", d.ID).
+				Int("attempt", d.AttemptCount).
+				Time("next_retry", next).
+				Msg("delivery scheduled for retry")
+		}
+	}
+
+	if err := w.store.UpdateDelivery(ctx, &d); err != nil {
+		w.updateFailed(d, err, "failed to update delivery")
+		return
+	}
+	if d.NextRetryAt != nil {
+		w.notifier.NotifyAt(*d.NextRetryAt)
+	}
+	w.settled(d)
+}
+
+// settled wakes the pool once a delivery with an ordering key is done with,
+// since the next one with its key can go now.
+func (w *Worker) settled(d models.Delivery) {
+	if d.OrderingKey != "" && d.Status != models.DeliveryPending && d.Status != models.DeliveryRetrying {
+		w.notifier.Notify()
+	}
+}
+
+// expiry returns when msg stops being worth delivering to ep: its own
+// expires_at, or else the endpoint's message TTL counted from when the
+// message became due. It returns nil if the message never expires.
+func expiry(msg *models.Message, ep *models.Endpoint) *time.Time {
+	if msg.ExpiresAt != nil {
+		return msg.ExpiresAt
+	}
+	if ep.MessageTTL <= 0 {
+		return nil
+	}
+	t := dueAt(msg).Add(time.Duration(ep.MessageTTL))
+	return &t
+}
+
+// dueAt is when msg became deliverable.
+func dueAt(msg *models.Message) time.Time {
+	if msg.DeliverAt != nil {
+		return *msg.DeliverAt
+	}
+	return msg.CreatedAt
+}
+
+// expire moves a delivery to the expired terminal status without attempting
+// it.
+func (w *Worker) expire(ctx context.Context, d models.Delivery, expiresAt time.Time) {
+	d.Status = models.DeliveryExpired
+	d.NextRetryAt = nil
+	if err := w.store.UpdateDelivery(ctx, &d); err != nil {
+		w.updateFailed(d, err, "failed to expire delivery")
+		return
+	}
+	w.settled(d)
+	w.log.Info().
+		Str("delivery_id", d.ID).
+		Int("attempts", d.AttemptCount).
+		Time("expires_at", expiresAt).
+		Msg("delivery expired")
+}
+
+// throttle pushes a delivery back by wait without counting it as an attempt.
+// A throttled attempt in its history shows why it was late.
+func (w *Worker) throttle(ctx context.Context, d models.Delivery, wait time.Duration) {
+	d.ThrottledCount++
+
+	attempt := &models.Attempt{
+		ID:            models.NewID("att"),
+		DeliveryID:    d.ID,
+		AttemptNumber: d.AttemptCount + 1,
+		Throttled:     true,
+		Error:         fmt.Sprintf("throttled by endpoint rate limit, next try in %s", wait.Round(time.Millisecond)),
+		CreatedAt:     time.Now().UTC().Format(time.RFC3339),
+	}
+	if err := w.store.CreateAttempt(ctx, attempt); err != nil {
+		w.log.Error().Err(err).Str("delivery_id", d.ID).Msg("failed to record throttled attempt")
+	}
+
+	w.log.Info().
+		Str("delivery_id", d.ID).
+		Str("endpoint_id", d.EndpointID).
+		Dur("wait", wait).
+		Int("throttled", d.ThrottledCount).
+		Msg("delivery throttled by endpoint rate limit")
+
+	w.postpone(ctx, d, time.Now().UTC().Add(wait))
+}
+
+// release hands claimed deliveries back unsent, due now, so the next
+// claim picks them up.
+func (w *Worker) release(ctx context.Context, ds []models.Delivery) {
+	now := time.Now().UTC()
+	for _, d := range ds {
+		d.NextRetryAt = &now
+		if err := w.store.UpdateDelivery(ctx, &d); err != nil {
+			w.updateFailed(d, err, "failed to release delivery")
+		}
+	}
+	w.notifier.Notify()
+}
+
+// unlock gives up the lease on claimed deliveries without sending them or
+// changing when they are due.
+func (w *Worker) unlock(ctx context.Context, ds []models.Delivery) {
+	for _, d := range ds {
+		if err := w.store.UpdateDelivery(ctx, &d); err != nil {
+			w.updateFailed(d, err, "failed to unlock delivery")
+		}
 	}
+}
 
+// drop fails a delivery that can never be sent, without an attempt.
+func (w *Worker) drop(ctx context.Context, d models.Delivery, reason string) {
+	d.Status = models.DeliveryFailed
+	d.NextRetryAt = nil
 	if err := w.store.UpdateDelivery(ctx, &d); err != nil {
-		w.log.Error().Err(err).Str("delivery_id", d.ID).Msg("failed to update delivery")
+		// Deleting a message or endpoint deletes its deliveries too, so
+		// usually there is nothing left to fail.
+		if !errors.Is(err, storage.ErrLeaseLost) {
+			w.log.Error().Err(err).Str("delivery_id", d.ID).Msg("failed to mark delivery failed")
+		}
+		return
+	}
+	w.settled(d)
+	w.log.Warn().Str("delivery_id", d.ID).Str("reason", reason).Msg("delivery failed without an attempt")
+}
+
+// updateFailed logs a failed UpdateDelivery. Losing the lease means the
+// delivery outlived it and another worker has taken it over, so this
+// worker's result is dropped in favour of that one's.
+func (w *Worker) updateFailed(d models.Delivery, err error, msg string) {
+	if errors.Is(err, storage.ErrLeaseLost) {
+		w.log.Warn().Str("delivery_id", d.ID).Msg("delivery lease lost to another worker, discarding result")
+		return
+	}
+	w.log.Error().Err(err).Str("delivery_id", d.ID).Msg(msg)
+}
+
+// postpone reschedules a delivery for until without counting an attempt.
+func (w *Worker) postpone(ctx context.Context, d models.Delivery, until time.Time) {
+	d.NextRetryAt = &until
+	if err := w.store.UpdateDelivery(ctx, &d); err != nil {
+		w.updateFailed(d, err, "failed to postpone delivery")
+		return
+	}
+	w.notifier.NotifyAt(until)
+}
+
+func (w *Worker) disableEndpoint(ctx context.Context, endpointID, reason string) {
+	if err := w.store.DisableEndpoint(ctx, endpointID, reason); err != nil {
+		w.log.Error().Err(err).Str("endpoint_id", endpointID).Msg("failed to disable endpoint")
+		return
 	}
+	w.breaker.Reset(endpointID)
+	w.bulkhead.Reset(endpointID)
+	w.log.Warn().Str("endpoint_id", endpointID).Str("reason", reason).Msg("endpoint disabled")
 }
@@ -0,0 +1,361 @@
+package delivery
+
+import (
+	"context"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/shohag/piperelay/internal/config"
+	"github.com/shohag/piperelay/internal/models"
+	"github.com/shohag/piperelay/internal/storage"
+)
+
+// newTestStore opens a migrated SQLite database that is removed with the
+// test.
+func newTestStore(t *testing.T) *storage.SQLiteStorage {
+	t.Helper()
+	store, err := storage.NewSQLite(filepath.Join(t.TempDir(), "piperelay.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	if err := store.Migrate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+// createEndpoint stores an active endpoint, and an application for it.
+func createEndpoint(t *testing.T, store storage.Storage) *models.Endpoint {
+	t.Helper()
+	ctx := context.Background()
+	now := time.Now().UTC()
+
+	app := &models.Application{ID: models.NewID("app"), Name: "test", APIKey: models.NewAPIKey(), Weight: 1, CreatedAt: now, UpdatedAt: now}
+	if err := store.CreateApplication(ctx, app); err != nil {
+		t.Fatal(err)
+	}
+	ep := &models.Endpoint{ID: models.NewID("ep"), AppID: app.ID, URL: "https://example.com/hook", Secret: models.NewSecret(), Active: true, CreatedAt: now, UpdatedAt: now}
+	if err := store.CreateEndpoint(ctx, ep); err != nil {
+		t.Fatal(err)
+	}
+	return ep
+}
+
+// newTestWorker builds a worker on store whose circuit breaker runs on the
+// returned clock. It never sends anything.
+func newTestWorker(store storage.Storage, cfg config.CircuitBreakerConfig, terminal ...int) (*Worker, *fakeClock) {
+	breaker, clock := newTestBreaker(cfg)
+	w := NewWorker(store, nil, breaker, NewBulkhead(config.BulkheadConfig{}, 1), NewRedirectWatch(0), NewNotifier(),
+		models.RetryPolicy{MaxAttempts: 5}, terminal, zerolog.Nop())
+	return w, clock
+}
+
+func TestWorkerJudge(t *testing.T) {
+	tests := []struct {
+		name   string
+		result SendResult
+		want   outcome
+		failed int // consecutive failures the breaker counts afterwards
+	}{
+		{"success", SendResult{StatusCode: 204}, outcome{succeeded: true}, 0},
+		{"server error", SendResult{StatusCode: 500}, outcome{}, 1},
+		{"transport error", SendResult{Error: "connection refused"}, outcome{}, 1},
+		{"gone", SendResult{StatusCode: 410}, outcome{gone: true}, 0},
+		{"terminal", SendResult{StatusCode: 422}, outcome{terminal: true}, 0},
+		{"error after a 2xx", SendResult{StatusCode: 200, Error: "reading response: EOF"}, outcome{}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newTestStore(t)
+			ep := createEndpoint(t, store)
+			w, _ := newTestWorker(store, config.CircuitBreakerConfig{FailureThreshold: 5}, 422)
+
+			if got := w.judge(context.Background(), ep, &tt.result); got != tt.want {
+				t.Fatalf("judge = %+v, want %+v", got, tt.want)
+			}
+			if got := w.breaker.Status(ep.ID).ConsecutiveFailures; got != tt.failed {
+				t.Fatalf("breaker counted %d failures, want %d", got, tt.failed)
+			}
+		})
+	}
+}
+
+func TestWorkerDisablesGoneEndpoint(t *testing.T) {
+	ctx := context.Background()
+	store := newTestStore(t)
+	ep := createEndpoint(t, store)
+	w, _ := newTestWorker(store, config.CircuitBreakerConfig{FailureThreshold: 1, Cooldown: time.Minute})
+
+	w.breaker.Failure(ep.ID)
+	w.judge(ctx, ep, &SendResult{StatusCode: 410})
+
+	got, err := store.GetEndpoint(ctx, ep.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Active || got.DisabledReason != "endpoint responded 410 Gone" || got.DisabledAt == nil {
+		t.Fatalf("endpoint active=%v reason=%q disabled_at=%v", got.Active, got.DisabledReason, got.DisabledAt)
+	}
+	if state := w.breaker.Status(ep.ID).State; state != CircuitClosed {
+		t.Fatalf("circuit %s after disabling, want it reset", state)
+	}
+}
+
+func TestWorkerDisablesAfterLongOutage(t *testing.T) {
+	ctx := context.Background()
+	store := newTestStore(t)
+	ep := createEndpoint(t, store)
+	w, clock := newTestWorker(store, config.CircuitBreakerConfig{
+		FailureThreshold: 2,
+		Cooldown:         time.Minute,
+		DisableAfter:     3 * time.Minute,
+	})
+	fail := &SendResult{StatusCode: 503}
+
+	active := func() bool {
+		t.Helper()
+		got, err := store.GetEndpoint(ctx, ep.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return got.Active
+	}
+
+	// Opens the circuit.
+	w.judge(ctx, ep, fail)
+	w.judge(ctx, ep, fail)
+
+	// Probes keep failing, but the outage is still shorter than
+	// disable_after.
+	for i := 0; i < 2; i++ {
+		clock.Advance(time.Minute)
+		if ok, _ := w.breaker.Allow(ep.ID); !ok {
+			t.Fatalf("probe %d was held", i+1)
+		}
+		w.judge(ctx, ep, fail)
+		if !active() {
+			t.Fatalf("endpoint disabled after a %s outage", time.Duration(i+1)*time.Minute)
+		}
+	}
+
+	clock.Advance(time.Minute)
+	w.breaker.Allow(ep.ID)
+	w.judge(ctx, ep, fail)
+
+	got, err := store.GetEndpoint(ctx, ep.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Active || got.DisabledReason != "circuit breaker open for 3m0s" {
+		t.Fatalf("endpoint active=%v reason=%q, want disabled after 3m", got.Active, got.DisabledReason)
+	}
+	if status := w.breaker.Status(ep.ID); status.State != CircuitClosed || status.ConsecutiveFailures != 0 {
+		t.Fatalf("circuit %s/%d after disabling, want it reset", status.State, status.ConsecutiveFailures)
+	}
+}
+
+func TestWorkerProbeSuccessKeepsEndpoint(t *testing.T) {
+	ctx := context.Background()
+	store := newTestStore(t)
+	ep := createEndpoint(t, store)
+	w, clock := newTestWorker(store, config.CircuitBreakerConfig{
+		FailureThreshold: 1,
+		Cooldown:         time.Minute,
+		DisableAfter:     2 * time.Minute,
+	})
+
+	w.judge(ctx, ep, &SendResult{StatusCode: 500})
+	clock.Advance(time.Minute)
+	w.breaker.Allow(ep.ID)
+	w.judge(ctx, ep, &SendResult{StatusCode: 200})
+
+	// A fresh outage starts counting from zero.
+	clock.Advance(time.Minute)
+	w.judge(ctx, ep, &SendResult{StatusCode: 500})
+	clock.Advance(time.Minute)
+	w.breaker.Allow(ep.ID)
+	w.judge(ctx, ep, &SendResult{StatusCode: 500})
+
+	got, err := store.GetEndpoint(ctx, ep.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Active {
+		t.Fatalf("endpoint disabled: %s", got.DisabledReason)
+	}
+}
+
+// createDelivery stores a message for ep with one pending delivery and
+// returns both. due is when the message became due.
+func createDelivery(t *testing.T, store storage.Storage, ep *models.Endpoint, due time.Time, policy *models.RetryPolicy) (*models.Message, models.Delivery) {
+	t.Helper()
+	msg := &models.Message{ID: models.NewID("msg"), AppID: ep.AppID, EventType: "test", Payload: []byte(`{}`), CreatedAt: due}
+	d := models.Delivery{ID: models.NewID("dlv"), MessageID: msg.ID, EndpointID: ep.ID, Status: models.DeliveryPending, RetryPolicy: policy, RankAt: due, CreatedAt: due, UpdatedAt: due}
+	if err := store.CreateMessageWithDeliveries(context.Background(), msg, []models.Delivery{d}); err != nil {
+		t.Fatal(err)
+	}
+	return msg, d
+}
+
+func TestWorkerFinishRetryPolicy(t *testing.T) {
+	hour := models.Duration(time.Hour)
+
+	tests := []struct {
+		name     string
+		policy   *models.RetryPolicy // recorded on the delivery
+		age      time.Duration       // how long ago the message became due
+		attempts int                 // made before this one
+		want     models.DeliveryStatus
+		wait     time.Duration // until the retry, if one is scheduled
+	}{
+		{"server policy when the delivery has none", nil, 0, 0, models.DeliveryRetrying, time.Minute},
+		{"server max attempts", nil, 0, 4, models.DeliveryFailed, 0},
+		{"delivery policy over the server's", &models.RetryPolicy{MaxAttempts: 2, Schedule: durations(time.Second)}, 0, 0, models.DeliveryRetrying, time.Second},
+		{"delivery max attempts over the server's", &models.RetryPolicy{MaxAttempts: 2, Schedule: durations(time.Second, time.Second)}, 0, 1, models.DeliveryFailed, 0},
+		{"retry within max age", &models.RetryPolicy{Schedule: durations(10 * time.Minute), MaxAge: hour}, 45 * time.Minute, 0, models.DeliveryRetrying, 10 * time.Minute},
+		{"retry past max age", &models.RetryPolicy{Schedule: durations(20 * time.Minute), MaxAge: hour}, 45 * time.Minute, 0, models.DeliveryFailed, 0},
+		{"max age already passed", &models.RetryPolicy{Schedule: durations(time.Second), MaxAge: hour}, 2 * time.Hour, 0, models.DeliveryFailed, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			store := newTestStore(t)
+			ep := createEndpoint(t, store)
+			w, _ := newTestWorker(store, config.CircuitBreakerConfig{})
+			w.policy = models.RetryPolicy{MaxAttempts: 5, Schedule: durations(time.Minute, time.Minute, time.Minute, time.Minute)}
+
+			msg, d := createDelivery(t, store, ep, time.Now().UTC().Add(-tt.age), tt.policy)
+			d.AttemptCount = tt.attempts
+			before := time.Now().UTC()
+			w.finish(ctx, d, msg, nil, &SendResult{StatusCode: 500}, outcome{})
+
+			got, err := store.GetDelivery(ctx, d.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Status != tt.want || got.AttemptCount != tt.attempts+1 {
+				t.Fatalf("delivery %s after %d attempts, want %s after %d", got.Status, got.AttemptCount, tt.want, tt.attempts+1)
+			}
+			if tt.wait == 0 {
+				if got.NextRetryAt != nil {
+					t.Fatalf("retry scheduled for %s", got.NextRetryAt)
+				}
+				return
+			}
+			if got.NextRetryAt == nil {
+				t.Fatal("no retry scheduled")
+			}
+			if wait := got.NextRetryAt.Sub(before); wait < tt.wait || wait > tt.wait+time.Second {
+				t.Fatalf("retry in %s, want %s", wait, tt.wait)
+			}
+		})
+	}
+}
+
+// MaxAge counts from when a scheduled message was due, not from when it
+// was created.
+func TestWorkerFinishMaxAgeFromDeliverAt(t *testing.T) {
+	ctx := context.Background()
+	store := newTestStore(t)
+	ep := createEndpoint(t, store)
+	w, _ := newTestWorker(store, config.CircuitBreakerConfig{})
+
+	now := time.Now().UTC()
+	msg, d := createDelivery(t, store, ep, now.Add(-3*time.Hour), &models.RetryPolicy{Schedule: durations(10 * time.Minute), MaxAge: models.Duration(time.Hour)})
+	deliverAt := now.Add(-10 * time.Minute)
+	msg.DeliverAt = &deliverAt
+
+	w.finish(ctx, d, msg, nil, &SendResult{StatusCode: 503}, outcome{})
+
+	got, err := store.GetDelivery(ctx, d.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Status != models.DeliveryRetrying {
+		t.Fatalf("delivery %s, want it retrying within an hour of deliver_at", got.Status)
+	}
+}
+
+func TestWorkerFinishRetryAfter(t *testing.T) {
+	ctx := context.Background()
+	store := newTestStore(t)
+	ep := createEndpoint(t, store)
+	w, _ := newTestWorker(store, config.CircuitBreakerConfig{})
+
+	msg, d := createDelivery(t, store, ep, time.Now().UTC(), &models.RetryPolicy{Schedule: durations(time.Second), MaxAge: models.Duration(time.Minute)})
+	header := http.Header{"Retry-After": []string{"300"}}
+	w.finish(ctx, d, msg, nil, &SendResult{StatusCode: 429, Header: header}, outcome{})
+
+	got, err := store.GetDelivery(ctx, d.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Retry-After stretches the wait, and the max age still applies to it.
+	if got.Status != models.DeliveryFailed {
+		t.Fatalf("delivery %s, want failed: Retry-After pushes it past max age", got.Status)
+	}
+}
+
+func TestWorkerThrottleRecordsAttempt(t *testing.T) {
+	ctx := context.Background()
+	store := newTestStore(t)
+	ep := createEndpoint(t, store)
+	ep.RateLimit = 1
+	w, _ := newTestWorker(store, config.CircuitBreakerConfig{})
+
+	_, first := createDelivery(t, store, ep, time.Now().UTC(), nil)
+	_, second := createDelivery(t, store, ep, time.Now().UTC(), nil)
+	if !w.admit(ctx, ep, []models.Delivery{first}) {
+		t.Fatal("first delivery was not admitted")
+	}
+	if w.admit(ctx, ep, []models.Delivery{second}) {
+		t.Fatal("second delivery within a second was admitted at 1/s")
+	}
+
+	got, err := store.GetDelivery(ctx, second.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ThrottledCount != 1 || got.AttemptCount != 0 || got.NextRetryAt == nil || !got.NextRetryAt.After(time.Now()) {
+		t.Fatalf("delivery throttled %d times, %d attempts, next at %v", got.ThrottledCount, got.AttemptCount, got.NextRetryAt)
+	}
+	attempts, err := store.GetAttemptsByDelivery(ctx, second.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(attempts) != 1 || !attempts[0].Throttled || attempts[0].AttemptNumber != 1 || !strings.Contains(attempts[0].Error, "rate limit") {
+		t.Fatalf("attempts = %+v, want one throttled attempt", attempts)
+	}
+}
+
+func TestRedact(t *testing.T) {
+	h := http.Header{
+		"Authorization":         {"Bearer token"},
+		"Proxy-Authorization":   {"Basic dXNlcjpwYXNz"},
+		"Cookie":                {"a=1", "b=2"},
+		"Set-Cookie":            {"session=abc"},
+		"X-Piperelay-Signature": {"v1,abc"},
+		"X-Request-Id":          {"req_1"},
+	}
+	got := redact(h)
+	for key := range h {
+		want := "[redacted]"
+		if key == "X-Request-Id" {
+			want = "req_1"
+		}
+		if v := got[key]; len(v) != 1 || v[0] != want {
+			t.Errorf("%s = %q, want [%q]", key, v, want)
+		}
+	}
+	if h.Get("Authorization") != "Bearer token" {
+		t.Fatal("redact changed the header it was given")
+	}
+	if redact(nil) != nil {
+		t.Fatal("redact(nil) is not nil")
+	}
+}
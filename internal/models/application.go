@@ -2,10 +2,18 @@ package models
 
 import "time"
 
+// Application is a tenant. EventPriorities maps event types, or patterns
+// such as "payment.*", to the priority their messages get unless they set
+// one. ResponseBodyLimit is how many bytes of each response body attempts
+// keep; zero uses the server default.
 type Application struct {
-	ID        string    `json:"id"`
-	Name      string    `json:"name"`
-	APIKey    string    `json:"api_key,omitempty"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
+	ID                string              `json:"id"`
+	Name              string              `json:"name"`
+	APIKey            string              `json:"api_key,omitempty"`
+	RetryPolicy       *RetryPolicy        `json:"retry_policy,omitempty"`
+	Weight            int                 `json:"weight"`
+	EventPriorities   map[string]Priority `json:"event_priorities,omitempty"`
+	ResponseBodyLimit int                 `json:"response_body_limit,omitempty"`
+	CreatedAt         time.Time           `json:"created_at"`
+	UpdatedAt         time.Time           `json:"updated_at"`
 }
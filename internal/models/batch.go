@@ -0,0 +1,10 @@
+package models
+
+// BatchPolicy makes an endpoint receive messages in batches, as one JSON
+// array per request. A batch holds up to MaxSize messages and MaxBytes of
+// payload; a message waits up to Linger for others to join it.
+type BatchPolicy struct {
+	MaxSize  int      `json:"max_size"`
+	MaxBytes int      `json:"max_bytes,omitempty"`
+	Linger   Duration `json:"linger,omitempty"`
+}
@@ -1,6 +1,9 @@
 package models
 
-import "time"
+import (
+	"net/http"
+	"time"
+)
 
 type DeliveryStatus string
 
@@ -9,26 +12,68 @@ const (
 	DeliverySuccess  DeliveryStatus = "success"
 	DeliveryRetrying DeliveryStatus = "retrying"
 	DeliveryFailed   DeliveryStatus = "failed"
+	// DeliveryCancelled marks a scheduled delivery withdrawn before it fired.
+	DeliveryCancelled DeliveryStatus = "cancelled"
+	// DeliveryExpired marks a delivery dropped because its message expired
+	// before it could be delivered.
+	DeliveryExpired DeliveryStatus = "expired"
 )
 
+// Delivery is one message on its way to one endpoint. Due deliveries are
+// sent in RankAt order: when the delivery became due, moved earlier for
+// higher priorities. A delivery with an OrderingKey is not sent while an
+// earlier one with the same key to the same endpoint is still unsettled.
 type Delivery struct {
-	ID           string         `json:"id"`
-	MessageID    string         `json:"message_id"`
-	EndpointID   string         `json:"endpoint_id"`
-	Status       DeliveryStatus `json:"status"`
-	AttemptCount int            `json:"attempt_count"`
-	NextRetryAt  *time.Time     `json:"next_retry_at,omitempty"`
-	CreatedAt    time.Time      `json:"created_at"`
-	UpdatedAt    time.Time      `json:"updated_at"`
+	ID             string         `json:"id"`
+	MessageID      string         `json:"message_id"`
+	EndpointID     string         `json:"endpoint_id"`
+	Status         DeliveryStatus `json:"status"`
+	AttemptCount   int            `json:"attempt_count"`
+	ThrottledCount int            `json:"throttled_count"`
+	RetryPolicy    *RetryPolicy   `json:"retry_policy,omitempty"`
+	Priority       Priority       `json:"priority"`
+	OrderingKey    string         `json:"ordering_key,omitempty"`
+	RankAt         time.Time      `json:"-"`
+	NextRetryAt    *time.Time     `json:"next_retry_at,omitempty"`
+	// LingerUntil is when a delivery waiting to be batched with others
+	// goes out on its own. A batch claim may take it earlier.
+	LingerUntil *time.Time `json:"linger_until,omitempty"`
+	LockedBy    string     `json:"-"`
+	LockedUntil *time.Time `json:"-"`
+	LeaseToken  string     `json:"-"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
 }
 
+// Attempt is one request made for a delivery. A Throttled attempt records a
+// send that the endpoint's rate limit held back instead; its AttemptNumber
+// is that of the attempt it delayed, which does not count towards
+// max_attempts.
 type Attempt struct {
-	ID           string  `json:"id"`
-	DeliveryID   string  `json:"delivery_id"`
-	AttemptNumber int    `json:"attempt_number"`
-	StatusCode   int     `json:"status_code"`
-	ResponseBody string  `json:"response_body"`
-	LatencyMs    int64   `json:"latency_ms"`
-	Error        string  `json:"error,omitempty"`
-	CreatedAt    string  `json:"created_at"`
+	ID              string         `json:"id"`
+	DeliveryID      string         `json:"delivery_id"`
+	AttemptNumber   int            `json:"attempt_number"`
+	StatusCode      int            `json:"status_code"`
+	RequestHeaders  http.Header    `json:"request_headers,omitempty"`
+	ResponseHeaders http.Header    `json:"response_headers,omitempty"`
+	ResponseBody    string         `json:"response_body"`
+	LatencyMs       int64          `json:"latency_ms"`
+	Timing          *AttemptTiming `json:"timing,omitempty"`
+	Error           string         `json:"error,omitempty"`
+	FinalURL        string         `json:"final_url,omitempty"`
+	Redirects       []Redirect     `json:"redirects,omitempty"`
+	Throttled       bool           `json:"throttled,omitempty"`
+	CreatedAt       string         `json:"created_at"`
+}
+
+// AttemptTiming breaks an attempt down by phase, in milliseconds: DNS
+// lookup, TCP connect, TLS handshake, time to the first response byte and
+// in total. Phases a reused connection skipped are zero; after a redirect
+// they add up over every request.
+type AttemptTiming struct {
+	DNSMs       int64 `json:"dns_ms"`
+	ConnectMs   int64 `json:"connect_ms"`
+	TLSMs       int64 `json:"tls_ms"`
+	FirstByteMs int64 `json:"first_byte_ms"`
+	TotalMs     int64 `json:"total_ms"`
 }
@@ -3,15 +3,24 @@ package models
 import "time"
 
 type Endpoint struct {
-	ID          string            `json:"id"`
-	AppID       string            `json:"app_id"`
-	URL         string            `json:"url"`
-	Description string            `json:"description"`
-	Secret      string            `json:"secret,omitempty"`
-	EventTypes  []string          `json:"event_types"`
-	RateLimit   int               `json:"rate_limit,omitempty"`
-	Metadata    map[string]string `json:"metadata,omitempty"`
-	Active      bool              `json:"active"`
-	CreatedAt   time.Time         `json:"created_at"`
-	UpdatedAt   time.Time         `json:"updated_at"`
+	ID             string            `json:"id"`
+	AppID          string            `json:"app_id"`
+	URL            string            `json:"url"`
+	Description    string            `json:"description"`
+	Secret         string            `json:"secret,omitempty"`
+	EventTypes     []string          `json:"event_types"`
+	RateLimit      int               `json:"rate_limit,omitempty"`
+	MessageTTL     Duration          `json:"message_ttl,omitempty"`
+	RetryPolicy    *RetryPolicy      `json:"retry_policy,omitempty"`
+	MaxConcurrency int               `json:"max_concurrency,omitempty"`
+	FIFO           bool              `json:"fifo"`
+	Batch          *BatchPolicy      `json:"batch,omitempty"`
+	RedirectPolicy RedirectPolicy    `json:"redirect_policy,omitempty"`
+	SuggestedURL   string            `json:"suggested_url,omitempty"`
+	Metadata       map[string]string `json:"metadata,omitempty"`
+	Active         bool              `json:"active"`
+	DisabledReason string            `json:"disabled_reason,omitempty"`
+	DisabledAt     *time.Time        `json:"disabled_at,omitempty"`
+	CreatedAt      time.Time         `json:"created_at"`
+	UpdatedAt      time.Time         `json:"updated_at"`
 }
@@ -6,9 +6,12 @@ import (
 )
 
 type Message struct {
-	ID        string          `json:"id"`
-	AppID     string          `json:"app_id"`
-	EventType string          `json:"event_type"`
-	Payload   json.RawMessage `json:"payload"`
-	CreatedAt time.Time       `json:"created_at"`
+	ID          string          `json:"id"`
+	AppID       string          `json:"app_id"`
+	EventType   string          `json:"event_type"`
+	Payload     json.RawMessage `json:"payload"`
+	DeliverAt   *time.Time      `json:"deliver_at,omitempty"`
+	ExpiresAt   *time.Time      `json:"expires_at,omitempty"`
+	OrderingKey string          `json:"ordering_key,omitempty"`
+	CreatedAt   time.Time       `json:"created_at"`
 }
@@ -0,0 +1,75 @@
+package models
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Priority orders due deliveries to the same endpoint: higher priorities
+// are sent first. It reads and writes JSON as "high", "normal" or "low".
+type Priority int
+
+const (
+	PriorityLow    Priority = -1
+	PriorityNormal Priority = 0
+	PriorityHigh   Priority = 1
+)
+
+func (p Priority) String() string {
+	switch p {
+	case PriorityHigh:
+		return "high"
+	case PriorityLow:
+		return "low"
+	}
+	return "normal"
+}
+
+func (p Priority) MarshalText() ([]byte, error) {
+	return []byte(p.String()), nil
+}
+
+func (p *Priority) UnmarshalText(b []byte) error {
+	v, err := ParsePriority(string(b))
+	if err != nil {
+		return err
+	}
+	*p = v
+	return nil
+}
+
+// ParsePriority parses "high", "normal" or "low".
+func ParsePriority(s string) (Priority, error) {
+	switch s {
+	case "high":
+		return PriorityHigh, nil
+	case "normal":
+		return PriorityNormal, nil
+	case "low":
+		return PriorityLow, nil
+	}
+	return PriorityNormal, fmt.Errorf("priority must be \"high\", \"normal\" or \"low\"")
+}
+
+// PriorityFor returns the default priority of eventType in the application:
+// the EventPriorities entry for the event type itself, else the longest
+// matching "prefix.*" pattern, else "*", else normal.
+func (a *Application) PriorityFor(eventType string) Priority {
+	if p, ok := a.EventPriorities[eventType]; ok {
+		return p
+	}
+
+	best, priority := -1, PriorityNormal
+	for pattern, p := range a.EventPriorities {
+		prefix, ok := strings.CutSuffix(pattern, ".*")
+		if ok && strings.HasPrefix(eventType, prefix+".") && len(prefix) > best {
+			best, priority = len(prefix), p
+		}
+	}
+	if best < 0 {
+		if p, ok := a.EventPriorities["*"]; ok {
+			return p
+		}
+	}
+	return priority
+}
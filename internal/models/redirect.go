@@ -0,0 +1,36 @@
+package models
+
+import "net/http"
+
+// RedirectPolicy decides which redirects a delivery follows. The empty
+// policy uses the server default.
+type RedirectPolicy string
+
+const (
+	RedirectFollow   RedirectPolicy = "follow"
+	RedirectNoFollow RedirectPolicy = "no-follow"
+	RedirectSameHost RedirectPolicy = "same-host"
+)
+
+// Valid reports whether p is empty or a known policy.
+func (p RedirectPolicy) Valid() bool {
+	switch p {
+	case "", RedirectFollow, RedirectNoFollow, RedirectSameHost:
+		return true
+	}
+	return false
+}
+
+// Redirect is one redirect response an attempt received: its status code,
+// the URL it pointed to and whether the attempt went there. Only the last
+// redirect in a chain can be one that was not followed.
+type Redirect struct {
+	StatusCode  int    `json:"status_code"`
+	Location    string `json:"location"`
+	NotFollowed bool   `json:"not_followed,omitempty"`
+}
+
+// Permanent reports whether r says the resource has moved for good.
+func (r Redirect) Permanent() bool {
+	return r.StatusCode == http.StatusMovedPermanently || r.StatusCode == http.StatusPermanentRedirect
+}
@@ -0,0 +1,16 @@
+package models
+
+// RetryPolicy controls how often and for how long a delivery is retried.
+// Backoff is either an explicit Schedule of delays or exponential: Base
+// doubled per attempt up to Cap, shortened by up to Jitter (a fraction
+// between 0 and 1). MaxAge bounds how long after a message is due it may
+// still be retried. Zero fields inherit from the next policy down: endpoint,
+// then application, then the server configuration.
+type RetryPolicy struct {
+	MaxAttempts int        `json:"max_attempts,omitempty"`
+	Schedule    []Duration `json:"schedule,omitempty"`
+	Base        Duration   `json:"base,omitempty"`
+	Cap         Duration   `json:"cap,omitempty"`
+	Jitter      float64    `json:"jitter,omitempty"`
+	MaxAge      Duration   `json:"max_age,omitempty"`
+}
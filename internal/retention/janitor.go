@@ -0,0 +1,181 @@
+package retention
+
+import (
+	"context"
+	"expvar"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/shohag/piperelay/internal/config"
+	"github.com/shohag/piperelay/internal/storage"
+)
+
+// Totals since process start, published on /debug/vars.
+var (
+	attemptsPurged = expvar.NewInt("retention_attempts_purged")
+	messagesPurged = expvar.NewInt("retention_messages_purged")
+	keysPurged     = expvar.NewInt("retention_idempotency_keys_purged")
+	lastRun        = expvar.NewString("retention_last_run")
+)
+
+// Result reports how many rows a run removed, or would remove on a dry run.
+type Result struct {
+	Attempts        int64 `json:"attempts"`
+	Messages        int64 `json:"messages"`
+	IdempotencyKeys int64 `json:"idempotency_keys"`
+}
+
+// Janitor periodically deletes attempts older than AttemptTTL and messages
+// older than MessageTTL. A zero TTL disables purging for that kind of row.
+// Messages with pending or retrying deliveries are always kept. Idempotency
+// keys are dropped once they fall outside the idempotency window.
+type Janitor struct {
+	store     storage.Storage
+	cfg       config.RetentionConfig
+	keyTTL    time.Duration
+	batchSize int
+	log       zerolog.Logger
+	stop      chan struct{}
+	wg        sync.WaitGroup
+}
+
+func NewJanitor(cfg config.RetentionConfig, idempotencyWindow time.Duration, store storage.Storage, log zerolog.Logger) *Janitor {
+	batchSize := cfg.BatchSize
+	if batchSize <= 0 {
+		batchSize = 1000
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = time.Hour
+	}
+
+	return &Janitor{
+		store:     store,
+		cfg:       cfg,
+		keyTTL:    idempotencyWindow,
+		batchSize: batchSize,
+		log:       log.With().Str("component", "retention").Logger(),
+		stop:      make(chan struct{}),
+	}
+}
+
+func (j *Janitor) Start(ctx context.Context) {
+	j.log.Info().
+		Dur("message_ttl", j.cfg.MessageTTL).
+		Dur("attempt_ttl", j.cfg.AttemptTTL).
+		Dur("interval", j.cfg.Interval).
+		Msg("starting retention janitor")
+
+	j.wg.Add(1)
+	go func() {
+		defer j.wg.Done()
+		j.loop(ctx)
+	}()
+}
+
+func (j *Janitor) Stop() {
+	close(j.stop)
+	j.wg.Wait()
+}
+
+func (j *Janitor) loop(ctx context.Context) {
+	ticker := time.NewTicker(j.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := j.Run(ctx, false); err != nil && ctx.Err() == nil {
+			j.log.Error().Err(err).Msg("retention run failed")
+		}
+
+		select {
+		case <-j.stop:
+			return
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Run performs a single purge pass. With dryRun set nothing is deleted and
+// the result holds the number of attempts and messages that would be.
+func (j *Janitor) Run(ctx context.Context, dryRun bool) (Result, error) {
+	now := time.Now().UTC()
+	attemptsBefore, messagesBefore := j.cutoff(now, j.cfg.AttemptTTL), j.cutoff(now, j.cfg.MessageTTL)
+
+	if dryRun {
+		attempts, messages, err := j.store.CountPurgeable(ctx, attemptsBefore, messagesBefore)
+		return Result{Attempts: attempts, Messages: messages}, err
+	}
+
+	var res Result
+	var err error
+
+	// Attempts first: messages cascade to their own attempts, and doing the
+	// cheaper, larger table first keeps each message delete small.
+	res.Attempts, err = j.purge(ctx, attemptsBefore, j.store.PurgeAttempts)
+	attemptsPurged.Add(res.Attempts)
+	if err != nil {
+		return res, err
+	}
+
+	res.Messages, err = j.purge(ctx, messagesBefore, j.store.PurgeMessages)
+	messagesPurged.Add(res.Messages)
+	if err != nil {
+		return res, err
+	}
+
+	res.IdempotencyKeys, err = j.purge(ctx, j.cutoff(now, j.keyTTL), j.store.PurgeIdempotencyKeys)
+	keysPurged.Add(res.IdempotencyKeys)
+	if err != nil {
+		return res, err
+	}
+
+	lastRun.Set(now.Format(time.RFC3339))
+	if res.Attempts > 0 || res.Messages > 0 || res.IdempotencyKeys > 0 {
+		j.log.Info().
+			Int64("attempts", res.Attempts).
+			Int64("messages", res.Messages).
+			Int64("idempotency_keys", res.IdempotencyKeys).
+			Dur("took", time.Since(now)).
+			Msg("retention purge completed")
+	}
+	return res, nil
+}
+
+// cutoff returns the creation time before which rows are expired. A zero TTL
+// yields the zero time, which matches nothing.
+func (j *Janitor) cutoff(now time.Time, ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return now.Add(-ttl)
+}
+
+// purge deletes in batches until a batch comes back short, so no single
+// statement holds the database for long.
+func (j *Janitor) purge(ctx context.Context, before time.Time, fn func(context.Context, time.Time, int) (int64, error)) (int64, error) {
+	if before.IsZero() {
+		return 0, nil
+	}
+
+	var total int64
+	for {
+		n, err := fn(ctx, before, j.batchSize)
+		total += n
+		if err != nil {
+			return total, err
+		}
+		if n < int64(j.batchSize) {
+			return total, nil
+		}
+
+		select {
+		case <-j.stop:
+			return total, nil
+		case <-ctx.Done():
+			return total, ctx.Err()
+		default:
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Migration is one numbered schema change. Up and Down may hold several
+// statements; each runs in its own transaction together with the
+// schema_migrations bookkeeping, so a migration is applied fully or not at all.
+//
+// Present, if set, is a query returning one boolean: whether the schema
+// already has the migration's changes, made before migrations were tracked.
+// If it does, the migration is recorded as applied without running Up.
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+	Present string
+}
+
+type MigrationStatus struct {
+	Version   int        `json:"version"`
+	Name      string     `json:"name"`
+	Applied   bool       `json:"applied"`
+	AppliedAt *time.Time `json:"applied_at,omitempty"`
+}
+
+// Migrator applies and rolls back a driver's migrations, recording progress
+// in the schema_migrations table. Drivers differ only in their migration list,
+// placeholder style and, for servers shared by several replicas, the lock that
+// keeps two of them from migrating at once.
+type Migrator struct {
+	db         *sql.DB
+	migrations []Migration
+	numbered   bool // $1-style placeholders instead of ?
+
+	// lock and unlock, if set, take and release a session-level lock. Up and
+	// Down hold it from before they read the applied versions until they
+	// finish, so concurrent migrators run one after another.
+	lock, unlock string
+}
+
+func NewMigrator(db *sql.DB, migrations []Migration, numberedPlaceholders bool) *Migrator {
+	sorted := append([]Migration(nil), migrations...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Version < sorted[j].Version })
+	return &Migrator{db: db, migrations: sorted, numbered: numberedPlaceholders}
+}
+
+func (m *Migrator) arg(n int) string {
+	if m.numbered {
+		return fmt.Sprintf("$%d", n)
+	}
+	return "?"
+}
+
+// acquire takes the migration lock on a connection of its own and returns a
+// func that releases it. Without a lock statement it does nothing.
+func (m *Migrator) acquire(ctx context.Context) (func(), error) {
+	if m.lock == "" {
+		return func() {}, nil
+	}
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.ExecContext(ctx, m.lock); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("migration lock: %w", err)
+	}
+	return func() {
+		conn.ExecContext(context.Background(), m.unlock)
+		conn.Close()
+	}, nil
+}
+
+func (m *Migrator) ensureTable(ctx context.Context) error {
+	_, err := m.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_at TIMESTAMP NOT NULL
+	)`)
+	return err
+}
+
+func (m *Migrator) applied(ctx context.Context) (map[int]time.Time, error) {
+	if err := m.ensureTable(ctx); err != nil {
+		return nil, err
+	}
+
+	rows, err := m.db.QueryContext(ctx, `SELECT version, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var at time.Time
+		if err := rows.Scan(&version, &at); err != nil {
+			return nil, err
+		}
+		applied[version] = at
+	}
+	return applied, rows.Err()
+}
+
+// Status lists every known migration and whether it has been applied.
+func (m *Migrator) Status(ctx context.Context) ([]MigrationStatus, error) {
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]MigrationStatus, 0, len(m.migrations))
+	for _, mig := range m.migrations {
+		st := MigrationStatus{Version: mig.Version, Name: mig.Name}
+		if at, ok := applied[mig.Version]; ok {
+			st.Applied = true
+			st.AppliedAt = &at
+		}
+		statuses = append(statuses, st)
+	}
+	return statuses, nil
+}
+
+// Up applies all pending migrations in ascending order and returns them. With
+// dryRun set nothing is executed; the returned list is what would run.
+func (m *Migrator) Up(ctx context.Context, dryRun bool) ([]Migration, error) {
+	release, err := m.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var pending []Migration
+	for _, mig := range m.migrations {
+		if _, ok := applied[mig.Version]; !ok {
+			pending = append(pending, mig)
+		}
+	}
+	if dryRun {
+		return pending, nil
+	}
+
+	for i, mig := range pending {
+		up := mig.Up
+		if mig.Present != "" {
+			var present bool
+			if err := m.db.QueryRowContext(ctx, mig.Present).Scan(&present); err != nil {
+				return pending[:i], fmt.Errorf("migration %d (%s): %w", mig.Version, mig.Name, err)
+			}
+			if present {
+				up = ""
+			}
+		}
+		err := m.inTx(ctx, up,
+			`INSERT INTO schema_migrations (version, name, applied_at) VALUES (`+m.arg(1)+`, `+m.arg(2)+`, `+m.arg(3)+`)`,
+			mig.Version, mig.Name, time.Now().UTC())
+		if err != nil {
+			return pending[:i], fmt.Errorf("migration %d (%s): %w", mig.Version, mig.Name, err)
+		}
+	}
+	return pending, nil
+}
+
+// Down rolls back applied migrations newer than version, newest first, and
+// returns them. With dryRun set nothing is executed.
+func (m *Migrator) Down(ctx context.Context, version int, dryRun bool) ([]Migration, error) {
+	release, err := m.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var rollback []Migration
+	for i := len(m.migrations) - 1; i >= 0; i-- {
+		mig := m.migrations[i]
+		if _, ok := applied[mig.Version]; ok && mig.Version > version {
+			rollback = append(rollback, mig)
+		}
+	}
+	if dryRun {
+		return rollback, nil
+	}
+
+	for i, mig := range rollback {
+		err := m.inTx(ctx, mig.Down,
+			`DELETE FROM schema_migrations WHERE version = `+m.arg(1),
+			mig.Version)
+		if err != nil {
+			return rollback[:i], fmt.Errorf("rollback %d (%s): %w", mig.Version, mig.Name, err)
+		}
+	}
+	return rollback, nil
+}
+
+func (m *Migrator) inTx(ctx context.Context, schema, bookkeeping string, args ...interface{}) error {
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if schema != "" {
+		if _, err := tx.ExecContext(ctx, schema); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, bookkeeping, args...); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,87 @@
+package storage
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+)
+
+func newTestSQLite(t *testing.T) *SQLiteStorage {
+	t.Helper()
+	store, err := NewSQLite(filepath.Join(t.TempDir(), "piperelay.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func TestSQLiteMigrationsRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	store := newTestSQLite(t)
+	m := store.Migrator()
+
+	for i := 0; i < 2; i++ {
+		applied, err := m.Up(ctx, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(applied) != len(sqliteMigrations) {
+			t.Fatalf("applied %d migrations, want %d", len(applied), len(sqliteMigrations))
+		}
+		if _, err := m.Down(ctx, 0, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Databases created before schema_migrations existed got the columns of
+// migrations 2-4 from ad-hoc ALTER TABLE statements.
+func TestSQLiteAdoptsUntrackedSchema(t *testing.T) {
+	ctx := context.Background()
+	store := newTestSQLite(t)
+
+	untracked := sqliteMigrations[0].Up + `
+		ALTER TABLE deliveries ADD COLUMN locked_by TEXT NOT NULL DEFAULT '';
+		ALTER TABLE deliveries ADD COLUMN locked_until DATETIME;
+		ALTER TABLE deliveries ADD COLUMN throttled_count INTEGER NOT NULL DEFAULT 0;
+		ALTER TABLE endpoints ADD COLUMN disabled_reason TEXT NOT NULL DEFAULT '';
+		ALTER TABLE endpoints ADD COLUMN disabled_at DATETIME;`
+	if _, err := store.db.ExecContext(ctx, untracked); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.Migrate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	status, err := store.Migrator().Status(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, st := range status {
+		if !st.Applied {
+			t.Fatalf("migration %d (%s) not applied", st.Version, st.Name)
+		}
+	}
+}
+
+// A database that has only some of a migration's columns is left for the
+// operator to repair rather than half-adopted.
+func TestSQLiteRejectsPartialUntrackedSchema(t *testing.T) {
+	ctx := context.Background()
+	store := newTestSQLite(t)
+
+	partial := sqliteMigrations[0].Up + `
+		ALTER TABLE deliveries ADD COLUMN locked_by TEXT NOT NULL DEFAULT '';`
+	if _, err := store.db.ExecContext(ctx, partial); err != nil {
+		t.Fatal(err)
+	}
+
+	applied, err := store.Migrator().Up(ctx, false)
+	if err == nil {
+		t.Fatal("migrating a partial schema succeeded")
+	}
+	if len(applied) != 1 {
+		t.Fatalf("applied %d migrations before failing, want 1", len(applied))
+	}
+}
@@ -0,0 +1,259 @@
+package storage
+
+// postgresMigrations mirrors sqliteMigrations version for version so that
+// `piperelay migrate status` reads the same on either driver.
+var postgresMigrations = []Migration{
+	{
+		Version: 1,
+		Name:    "initial_schema",
+		Up: `
+			CREATE TABLE IF NOT EXISTS applications (
+				id TEXT PRIMARY KEY,
+				name TEXT NOT NULL,
+				api_key TEXT NOT NULL UNIQUE,
+				created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+				updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+			);
+			CREATE TABLE IF NOT EXISTS endpoints (
+				id TEXT PRIMARY KEY,
+				app_id TEXT NOT NULL REFERENCES applications(id) ON DELETE CASCADE,
+				url TEXT NOT NULL,
+				description TEXT NOT NULL DEFAULT '',
+				secret TEXT NOT NULL,
+				event_types JSONB NOT NULL DEFAULT '[]',
+				rate_limit INTEGER NOT NULL DEFAULT 0,
+				metadata JSONB NOT NULL DEFAULT '{}',
+				active BOOLEAN NOT NULL DEFAULT TRUE,
+				created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+				updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+			);
+			CREATE TABLE IF NOT EXISTS messages (
+				id TEXT PRIMARY KEY,
+				app_id TEXT NOT NULL REFERENCES applications(id) ON DELETE CASCADE,
+				event_type TEXT NOT NULL,
+				payload TEXT NOT NULL,
+				created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+			);
+			CREATE TABLE IF NOT EXISTS deliveries (
+				id TEXT PRIMARY KEY,
+				message_id TEXT NOT NULL REFERENCES messages(id) ON DELETE CASCADE,
+				endpoint_id TEXT NOT NULL REFERENCES endpoints(id) ON DELETE CASCADE,
+				status TEXT NOT NULL DEFAULT 'pending',
+				attempt_count INTEGER NOT NULL DEFAULT 0,
+				next_retry_at TIMESTAMPTZ,
+				created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+				updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+			);
+			CREATE TABLE IF NOT EXISTS attempts (
+				id TEXT PRIMARY KEY,
+				delivery_id TEXT NOT NULL REFERENCES deliveries(id) ON DELETE CASCADE,
+				attempt_number INTEGER NOT NULL,
+				status_code INTEGER NOT NULL DEFAULT 0,
+				response_body TEXT NOT NULL DEFAULT '',
+				latency_ms BIGINT NOT NULL DEFAULT 0,
+				error TEXT NOT NULL DEFAULT '',
+				created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+			);
+			CREATE INDEX IF NOT EXISTS idx_endpoints_app ON endpoints(app_id);
+			CREATE INDEX IF NOT EXISTS idx_messages_app ON messages(app_id);
+			CREATE INDEX IF NOT EXISTS idx_deliveries_message ON deliveries(message_id);
+			CREATE INDEX IF NOT EXISTS idx_deliveries_endpoint ON deliveries(endpoint_id);
+			CREATE INDEX IF NOT EXISTS idx_deliveries_pending ON deliveries(status, next_retry_at) WHERE status IN ('pending', 'retrying');
+			CREATE INDEX IF NOT EXISTS idx_attempts_delivery ON attempts(delivery_id);`,
+		Down: `
+			DROP TABLE IF EXISTS attempts;
+			DROP TABLE IF EXISTS deliveries;
+			DROP TABLE IF EXISTS messages;
+			DROP TABLE IF EXISTS endpoints;
+			DROP TABLE IF EXISTS applications;`,
+	},
+	{
+		Version: 2,
+		Name:    "delivery_leases",
+		Up: `
+			ALTER TABLE deliveries ADD COLUMN IF NOT EXISTS locked_by TEXT NOT NULL DEFAULT '';
+			ALTER TABLE deliveries ADD COLUMN IF NOT EXISTS locked_until TIMESTAMPTZ;`,
+		Down: `
+			ALTER TABLE deliveries DROP COLUMN IF EXISTS locked_until;
+			ALTER TABLE deliveries DROP COLUMN IF EXISTS locked_by;`,
+	},
+	{
+		Version: 3,
+		Name:    "delivery_throttled_count",
+		Up:      `ALTER TABLE deliveries ADD COLUMN IF NOT EXISTS throttled_count INTEGER NOT NULL DEFAULT 0;`,
+		Down:    `ALTER TABLE deliveries DROP COLUMN IF EXISTS throttled_count;`,
+	},
+	{
+		Version: 4,
+		Name:    "endpoint_disabled_reason",
+		Up: `
+			ALTER TABLE endpoints ADD COLUMN IF NOT EXISTS disabled_reason TEXT NOT NULL DEFAULT '';
+			ALTER TABLE endpoints ADD COLUMN IF NOT EXISTS disabled_at TIMESTAMPTZ;`,
+		Down: `
+			ALTER TABLE endpoints DROP COLUMN IF EXISTS disabled_at;
+			ALTER TABLE endpoints DROP COLUMN IF EXISTS disabled_reason;`,
+	},
+	{
+		Version: 5,
+		Name:    "idempotency_keys",
+		Up: `
+			CREATE TABLE IF NOT EXISTS idempotency_keys (
+				app_id TEXT NOT NULL REFERENCES applications(id) ON DELETE CASCADE,
+				idempotency_key TEXT NOT NULL,
+				message_id TEXT NOT NULL,
+				created_at TIMESTAMPTZ NOT NULL,
+				PRIMARY KEY (app_id, idempotency_key)
+			);
+			CREATE INDEX IF NOT EXISTS idx_idempotency_keys_created ON idempotency_keys(created_at);`,
+		Down: `DROP TABLE IF EXISTS idempotency_keys;`,
+	},
+	{
+		Version: 6,
+		Name:    "message_deliver_at",
+		Up: `
+			ALTER TABLE messages ADD COLUMN IF NOT EXISTS deliver_at TIMESTAMPTZ;
+			CREATE INDEX IF NOT EXISTS idx_messages_deliver_at ON messages(app_id, deliver_at);`,
+		Down: `
+			DROP INDEX IF EXISTS idx_messages_deliver_at;
+			ALTER TABLE messages DROP COLUMN IF EXISTS deliver_at;`,
+	},
+	{
+		Version: 7,
+		Name:    "message_expiration",
+		Up: `
+			ALTER TABLE messages ADD COLUMN IF NOT EXISTS expires_at TIMESTAMPTZ;
+			ALTER TABLE endpoints ADD COLUMN IF NOT EXISTS message_ttl_ms BIGINT NOT NULL DEFAULT 0;`,
+		Down: `
+			ALTER TABLE endpoints DROP COLUMN IF EXISTS message_ttl_ms;
+			ALTER TABLE messages DROP COLUMN IF EXISTS expires_at;`,
+	},
+	{
+		Version: 8,
+		Name:    "retry_policies",
+		Up: `
+			ALTER TABLE applications ADD COLUMN IF NOT EXISTS retry_policy JSONB;
+			ALTER TABLE endpoints ADD COLUMN IF NOT EXISTS retry_policy JSONB;
+			ALTER TABLE deliveries ADD COLUMN IF NOT EXISTS retry_policy JSONB;`,
+		Down: `
+			ALTER TABLE deliveries DROP COLUMN IF EXISTS retry_policy;
+			ALTER TABLE endpoints DROP COLUMN IF EXISTS retry_policy;
+			ALTER TABLE applications DROP COLUMN IF EXISTS retry_policy;`,
+	},
+	{
+		Version: 9,
+		Name:    "fair_scheduling",
+		Up: `
+			ALTER TABLE applications ADD COLUMN IF NOT EXISTS weight INTEGER NOT NULL DEFAULT 1;
+			ALTER TABLE endpoints ADD COLUMN IF NOT EXISTS max_concurrency INTEGER NOT NULL DEFAULT 0;
+			CREATE INDEX IF NOT EXISTS idx_deliveries_endpoint_pending ON deliveries(endpoint_id, created_at) WHERE status IN ('pending', 'retrying');
+			CREATE INDEX IF NOT EXISTS idx_deliveries_leased ON deliveries(endpoint_id, locked_until) WHERE locked_until IS NOT NULL;`,
+		Down: `
+			DROP INDEX IF EXISTS idx_deliveries_leased;
+			DROP INDEX IF EXISTS idx_deliveries_endpoint_pending;
+			ALTER TABLE endpoints DROP COLUMN IF EXISTS max_concurrency;
+			ALTER TABLE applications DROP COLUMN IF EXISTS weight;`,
+	},
+	{
+		Version: 10,
+		Name:    "message_priority",
+		Up: `
+			ALTER TABLE applications ADD COLUMN IF NOT EXISTS event_priorities JSONB;
+			ALTER TABLE deliveries ADD COLUMN IF NOT EXISTS priority INTEGER NOT NULL DEFAULT 0;
+			ALTER TABLE deliveries ADD COLUMN IF NOT EXISTS rank_at TIMESTAMPTZ;
+			UPDATE deliveries SET rank_at = COALESCE(next_retry_at, created_at) WHERE rank_at IS NULL;
+			DROP INDEX IF EXISTS idx_deliveries_endpoint_pending;
+			CREATE INDEX IF NOT EXISTS idx_deliveries_endpoint_pending ON deliveries(endpoint_id, rank_at) WHERE status IN ('pending', 'retrying');`,
+		Down: `
+			DROP INDEX IF EXISTS idx_deliveries_endpoint_pending;
+			CREATE INDEX IF NOT EXISTS idx_deliveries_endpoint_pending ON deliveries(endpoint_id, created_at) WHERE status IN ('pending', 'retrying');
+			ALTER TABLE deliveries DROP COLUMN IF EXISTS rank_at;
+			ALTER TABLE deliveries DROP COLUMN IF EXISTS priority;
+			ALTER TABLE applications DROP COLUMN IF EXISTS event_priorities;`,
+	},
+	{
+		Version: 11,
+		Name:    "ordered_delivery",
+		Up: `
+			ALTER TABLE messages ADD COLUMN IF NOT EXISTS ordering_key TEXT NOT NULL DEFAULT '';
+			ALTER TABLE deliveries ADD COLUMN IF NOT EXISTS ordering_key TEXT NOT NULL DEFAULT '';
+			ALTER TABLE endpoints ADD COLUMN IF NOT EXISTS fifo BOOLEAN NOT NULL DEFAULT FALSE;
+			CREATE INDEX IF NOT EXISTS idx_deliveries_ordering ON deliveries(endpoint_id, ordering_key, created_at) WHERE ordering_key <> '' AND status IN ('pending', 'retrying');`,
+		Down: `
+			DROP INDEX IF EXISTS idx_deliveries_ordering;
+			ALTER TABLE endpoints DROP COLUMN IF EXISTS fifo;
+			ALTER TABLE deliveries DROP COLUMN IF EXISTS ordering_key;
+			ALTER TABLE messages DROP COLUMN IF EXISTS ordering_key;`,
+	},
+	{
+		Version: 12,
+		Name:    "endpoint_batching",
+		Up:      `ALTER TABLE endpoints ADD COLUMN IF NOT EXISTS batch JSONB;`,
+		Down:    `ALTER TABLE endpoints DROP COLUMN IF EXISTS batch;`,
+	},
+	{
+		Version: 13,
+		Name:    "redirect_policy",
+		Up: `
+			ALTER TABLE endpoints ADD COLUMN IF NOT EXISTS redirect_policy TEXT NOT NULL DEFAULT '';
+			ALTER TABLE endpoints ADD COLUMN IF NOT EXISTS suggested_url TEXT NOT NULL DEFAULT '';
+			ALTER TABLE attempts ADD COLUMN IF NOT EXISTS final_url TEXT NOT NULL DEFAULT '';
+			ALTER TABLE attempts ADD COLUMN IF NOT EXISTS redirects JSONB;`,
+		Down: `
+			ALTER TABLE attempts DROP COLUMN IF EXISTS redirects;
+			ALTER TABLE attempts DROP COLUMN IF EXISTS final_url;
+			ALTER TABLE endpoints DROP COLUMN IF EXISTS suggested_url;
+			ALTER TABLE endpoints DROP COLUMN IF EXISTS redirect_policy;`,
+	},
+	{
+		Version: 14,
+		Name:    "attempt_details",
+		Up: `
+			ALTER TABLE attempts ADD COLUMN IF NOT EXISTS request_headers JSONB;
+			ALTER TABLE attempts ADD COLUMN IF NOT EXISTS response_headers JSONB;
+			ALTER TABLE attempts ADD COLUMN IF NOT EXISTS timing JSONB;
+			ALTER TABLE applications ADD COLUMN IF NOT EXISTS response_body_limit INTEGER NOT NULL DEFAULT 0;`,
+		Down: `
+			ALTER TABLE applications DROP COLUMN IF EXISTS response_body_limit;
+			ALTER TABLE attempts DROP COLUMN IF EXISTS timing;
+			ALTER TABLE attempts DROP COLUMN IF EXISTS response_headers;
+			ALTER TABLE attempts DROP COLUMN IF EXISTS request_headers;`,
+	},
+	{
+		Version: 15,
+		Name:    "delivery_lease_token",
+		Up:      `ALTER TABLE deliveries ADD COLUMN IF NOT EXISTS lease_token TEXT NOT NULL DEFAULT '';`,
+		Down:    `ALTER TABLE deliveries DROP COLUMN IF EXISTS lease_token;`,
+	},
+	{
+		Version: 16,
+		Name:    "throttled_attempts",
+		Up:      `ALTER TABLE attempts ADD COLUMN IF NOT EXISTS throttled BOOLEAN NOT NULL DEFAULT FALSE;`,
+		Down:    `ALTER TABLE attempts DROP COLUMN IF EXISTS throttled;`,
+	},
+	{
+		Version: 17,
+		Name:    "delivery_seq",
+		Up: `
+			ALTER TABLE deliveries ADD COLUMN IF NOT EXISTS seq BIGSERIAL;
+			UPDATE deliveries d SET seq = o.n
+			  FROM (SELECT id, ROW_NUMBER() OVER (ORDER BY created_at, id) AS n FROM deliveries) o
+			 WHERE o.id = d.id;
+			SELECT setval(pg_get_serial_sequence('deliveries', 'seq'), COALESCE(MAX(seq), 0) + 1, false) FROM deliveries;
+			DROP INDEX IF EXISTS idx_deliveries_endpoint_pending;
+			CREATE INDEX IF NOT EXISTS idx_deliveries_endpoint_pending ON deliveries(endpoint_id, rank_at, seq) WHERE status IN ('pending', 'retrying');
+			DROP INDEX IF EXISTS idx_deliveries_ordering;
+			CREATE INDEX IF NOT EXISTS idx_deliveries_ordering ON deliveries(endpoint_id, ordering_key, seq) WHERE ordering_key <> '' AND status IN ('pending', 'retrying');`,
+		Down: `
+			DROP INDEX IF EXISTS idx_deliveries_ordering;
+			CREATE INDEX IF NOT EXISTS idx_deliveries_ordering ON deliveries(endpoint_id, ordering_key, created_at) WHERE ordering_key <> '' AND status IN ('pending', 'retrying');
+			DROP INDEX IF EXISTS idx_deliveries_endpoint_pending;
+			CREATE INDEX IF NOT EXISTS idx_deliveries_endpoint_pending ON deliveries(endpoint_id, rank_at) WHERE status IN ('pending', 'retrying');
+			ALTER TABLE deliveries DROP COLUMN IF EXISTS seq;`,
+	},
+	{
+		Version: 18,
+		Name:    "delivery_linger_until",
+		Up:      `ALTER TABLE deliveries ADD COLUMN IF NOT EXISTS linger_until TIMESTAMPTZ;`,
+		Down:    `ALTER TABLE deliveries DROP COLUMN IF EXISTS linger_until;`,
+	},
+}
@@ -0,0 +1,265 @@
+package storage
+
+var sqliteMigrations = []Migration{
+	{
+		Version: 1,
+		Name:    "initial_schema",
+		// IF NOT EXISTS lets databases created before schema_migrations
+		// existed adopt this migration without changes.
+		Up: `
+			CREATE TABLE IF NOT EXISTS applications (
+				id TEXT PRIMARY KEY,
+				name TEXT NOT NULL,
+				api_key TEXT NOT NULL UNIQUE,
+				created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+				updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+			);
+			CREATE TABLE IF NOT EXISTS endpoints (
+				id TEXT PRIMARY KEY,
+				app_id TEXT NOT NULL REFERENCES applications(id) ON DELETE CASCADE,
+				url TEXT NOT NULL,
+				description TEXT NOT NULL DEFAULT '',
+				secret TEXT NOT NULL,
+				event_types TEXT NOT NULL DEFAULT '[]',
+				rate_limit INTEGER NOT NULL DEFAULT 0,
+				metadata TEXT NOT NULL DEFAULT '{}',
+				active INTEGER NOT NULL DEFAULT 1,
+				created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+				updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+			);
+			CREATE TABLE IF NOT EXISTS messages (
+				id TEXT PRIMARY KEY,
+				app_id TEXT NOT NULL REFERENCES applications(id) ON DELETE CASCADE,
+				event_type TEXT NOT NULL,
+				payload TEXT NOT NULL,
+				created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+			);
+			CREATE TABLE IF NOT EXISTS deliveries (
+				id TEXT PRIMARY KEY,
+				message_id TEXT NOT NULL REFERENCES messages(id) ON DELETE CASCADE,
+				endpoint_id TEXT NOT NULL REFERENCES endpoints(id) ON DELETE CASCADE,
+				status TEXT NOT NULL DEFAULT 'pending',
+				attempt_count INTEGER NOT NULL DEFAULT 0,
+				next_retry_at DATETIME,
+				created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+				updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+			);
+			CREATE TABLE IF NOT EXISTS attempts (
+				id TEXT PRIMARY KEY,
+				delivery_id TEXT NOT NULL REFERENCES deliveries(id) ON DELETE CASCADE,
+				attempt_number INTEGER NOT NULL,
+				status_code INTEGER NOT NULL DEFAULT 0,
+				response_body TEXT NOT NULL DEFAULT '',
+				latency_ms INTEGER NOT NULL DEFAULT 0,
+				error TEXT NOT NULL DEFAULT '',
+				created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+			);
+			CREATE INDEX IF NOT EXISTS idx_applications_api_key ON applications(api_key);
+			CREATE INDEX IF NOT EXISTS idx_endpoints_app ON endpoints(app_id);
+			CREATE INDEX IF NOT EXISTS idx_messages_app ON messages(app_id);
+			CREATE INDEX IF NOT EXISTS idx_deliveries_message ON deliveries(message_id);
+			CREATE INDEX IF NOT EXISTS idx_deliveries_endpoint ON deliveries(endpoint_id);
+			CREATE INDEX IF NOT EXISTS idx_deliveries_pending ON deliveries(status, next_retry_at) WHERE status IN ('pending', 'retrying');
+			CREATE INDEX IF NOT EXISTS idx_attempts_delivery ON attempts(delivery_id);`,
+		Down: `
+			DROP TABLE IF EXISTS attempts;
+			DROP TABLE IF EXISTS deliveries;
+			DROP TABLE IF EXISTS messages;
+			DROP TABLE IF EXISTS endpoints;
+			DROP TABLE IF EXISTS applications;`,
+	},
+	// Releases before schema_migrations added the columns of migrations
+	// 2-4 by hand, so those databases adopt them as they are. SQLite has no
+	// ADD COLUMN IF NOT EXISTS.
+	{
+		Version: 2,
+		Name:    "delivery_leases",
+		Present: `SELECT COUNT(*) = 2 FROM pragma_table_info('deliveries') WHERE name IN ('locked_by', 'locked_until')`,
+		Up: `
+			ALTER TABLE deliveries ADD COLUMN locked_by TEXT NOT NULL DEFAULT '';
+			ALTER TABLE deliveries ADD COLUMN locked_until DATETIME;`,
+		Down: `
+			ALTER TABLE deliveries DROP COLUMN locked_until;
+			ALTER TABLE deliveries DROP COLUMN locked_by;`,
+	},
+	{
+		Version: 3,
+		Name:    "delivery_throttled_count",
+		Present: `SELECT COUNT(*) = 1 FROM pragma_table_info('deliveries') WHERE name = 'throttled_count'`,
+		Up:      `ALTER TABLE deliveries ADD COLUMN throttled_count INTEGER NOT NULL DEFAULT 0;`,
+		Down:    `ALTER TABLE deliveries DROP COLUMN throttled_count;`,
+	},
+	{
+		Version: 4,
+		Name:    "endpoint_disabled_reason",
+		Present: `SELECT COUNT(*) = 2 FROM pragma_table_info('endpoints') WHERE name IN ('disabled_reason', 'disabled_at')`,
+		Up: `
+			ALTER TABLE endpoints ADD COLUMN disabled_reason TEXT NOT NULL DEFAULT '';
+			ALTER TABLE endpoints ADD COLUMN disabled_at DATETIME;`,
+		Down: `
+			ALTER TABLE endpoints DROP COLUMN disabled_at;
+			ALTER TABLE endpoints DROP COLUMN disabled_reason;`,
+	},
+	{
+		Version: 5,
+		Name:    "idempotency_keys",
+		Up: `
+			CREATE TABLE idempotency_keys (
+				app_id TEXT NOT NULL REFERENCES applications(id) ON DELETE CASCADE,
+				idempotency_key TEXT NOT NULL,
+				message_id TEXT NOT NULL,
+				created_at DATETIME NOT NULL,
+				PRIMARY KEY (app_id, idempotency_key)
+			);
+			CREATE INDEX idx_idempotency_keys_created ON idempotency_keys(created_at);`,
+		Down: `DROP TABLE idempotency_keys;`,
+	},
+	{
+		Version: 6,
+		Name:    "message_deliver_at",
+		Up: `
+			ALTER TABLE messages ADD COLUMN deliver_at DATETIME;
+			CREATE INDEX idx_messages_deliver_at ON messages(app_id, deliver_at);`,
+		Down: `
+			DROP INDEX idx_messages_deliver_at;
+			ALTER TABLE messages DROP COLUMN deliver_at;`,
+	},
+	{
+		Version: 7,
+		Name:    "message_expiration",
+		Up: `
+			ALTER TABLE messages ADD COLUMN expires_at DATETIME;
+			ALTER TABLE endpoints ADD COLUMN message_ttl_ms INTEGER NOT NULL DEFAULT 0;`,
+		Down: `
+			ALTER TABLE endpoints DROP COLUMN message_ttl_ms;
+			ALTER TABLE messages DROP COLUMN expires_at;`,
+	},
+	{
+		Version: 8,
+		Name:    "retry_policies",
+		Up: `
+			ALTER TABLE applications ADD COLUMN retry_policy TEXT;
+			ALTER TABLE endpoints ADD COLUMN retry_policy TEXT;
+			ALTER TABLE deliveries ADD COLUMN retry_policy TEXT;`,
+		Down: `
+			ALTER TABLE deliveries DROP COLUMN retry_policy;
+			ALTER TABLE endpoints DROP COLUMN retry_policy;
+			ALTER TABLE applications DROP COLUMN retry_policy;`,
+	},
+	{
+		Version: 9,
+		Name:    "fair_scheduling",
+		Up: `
+			ALTER TABLE applications ADD COLUMN weight INTEGER NOT NULL DEFAULT 1;
+			ALTER TABLE endpoints ADD COLUMN max_concurrency INTEGER NOT NULL DEFAULT 0;
+			CREATE INDEX idx_deliveries_endpoint_pending ON deliveries(endpoint_id, created_at) WHERE status IN ('pending', 'retrying');
+			CREATE INDEX idx_deliveries_leased ON deliveries(endpoint_id, locked_until) WHERE locked_until IS NOT NULL;`,
+		Down: `
+			DROP INDEX idx_deliveries_leased;
+			DROP INDEX idx_deliveries_endpoint_pending;
+			ALTER TABLE endpoints DROP COLUMN max_concurrency;
+			ALTER TABLE applications DROP COLUMN weight;`,
+	},
+	{
+		Version: 10,
+		Name:    "message_priority",
+		Up: `
+			ALTER TABLE applications ADD COLUMN event_priorities TEXT;
+			ALTER TABLE deliveries ADD COLUMN priority INTEGER NOT NULL DEFAULT 0;
+			ALTER TABLE deliveries ADD COLUMN rank_at DATETIME;
+			UPDATE deliveries SET rank_at = COALESCE(next_retry_at, created_at) WHERE rank_at IS NULL;
+			DROP INDEX idx_deliveries_endpoint_pending;
+			CREATE INDEX idx_deliveries_endpoint_pending ON deliveries(endpoint_id, rank_at) WHERE status IN ('pending', 'retrying');`,
+		Down: `
+			DROP INDEX idx_deliveries_endpoint_pending;
+			CREATE INDEX idx_deliveries_endpoint_pending ON deliveries(endpoint_id, created_at) WHERE status IN ('pending', 'retrying');
+			ALTER TABLE deliveries DROP COLUMN rank_at;
+			ALTER TABLE deliveries DROP COLUMN priority;
+			ALTER TABLE applications DROP COLUMN event_priorities;`,
+	},
+	{
+		Version: 11,
+		Name:    "ordered_delivery",
+		Up: `
+			ALTER TABLE messages ADD COLUMN ordering_key TEXT NOT NULL DEFAULT '';
+			ALTER TABLE deliveries ADD COLUMN ordering_key TEXT NOT NULL DEFAULT '';
+			ALTER TABLE endpoints ADD COLUMN fifo INTEGER NOT NULL DEFAULT 0;
+			CREATE INDEX idx_deliveries_ordering ON deliveries(endpoint_id, ordering_key, created_at) WHERE ordering_key <> '' AND status IN ('pending', 'retrying');`,
+		Down: `
+			DROP INDEX idx_deliveries_ordering;
+			ALTER TABLE endpoints DROP COLUMN fifo;
+			ALTER TABLE deliveries DROP COLUMN ordering_key;
+			ALTER TABLE messages DROP COLUMN ordering_key;`,
+	},
+	{
+		Version: 12,
+		Name:    "endpoint_batching",
+		Up:      `ALTER TABLE endpoints ADD COLUMN batch TEXT;`,
+		Down:    `ALTER TABLE endpoints DROP COLUMN batch;`,
+	},
+	{
+		Version: 13,
+		Name:    "redirect_policy",
+		Up: `
+			ALTER TABLE endpoints ADD COLUMN redirect_policy TEXT NOT NULL DEFAULT '';
+			ALTER TABLE endpoints ADD COLUMN suggested_url TEXT NOT NULL DEFAULT '';
+			ALTER TABLE attempts ADD COLUMN final_url TEXT NOT NULL DEFAULT '';
+			ALTER TABLE attempts ADD COLUMN redirects TEXT;`,
+		Down: `
+			ALTER TABLE attempts DROP COLUMN redirects;
+			ALTER TABLE attempts DROP COLUMN final_url;
+			ALTER TABLE endpoints DROP COLUMN suggested_url;
+			ALTER TABLE endpoints DROP COLUMN redirect_policy;`,
+	},
+	{
+		Version: 14,
+		Name:    "attempt_details",
+		Up: `
+			ALTER TABLE attempts ADD COLUMN request_headers TEXT;
+			ALTER TABLE attempts ADD COLUMN response_headers TEXT;
+			ALTER TABLE attempts ADD COLUMN timing TEXT;
+			ALTER TABLE applications ADD COLUMN response_body_limit INTEGER NOT NULL DEFAULT 0;`,
+		Down: `
+			ALTER TABLE applications DROP COLUMN response_body_limit;
+			ALTER TABLE attempts DROP COLUMN timing;
+			ALTER TABLE attempts DROP COLUMN response_headers;
+			ALTER TABLE attempts DROP COLUMN request_headers;`,
+	},
+	{
+		Version: 15,
+		Name:    "delivery_lease_token",
+		Up:      `ALTER TABLE deliveries ADD COLUMN lease_token TEXT NOT NULL DEFAULT '';`,
+		Down:    `ALTER TABLE deliveries DROP COLUMN lease_token;`,
+	},
+	{
+		Version: 16,
+		Name:    "throttled_attempts",
+		Up:      `ALTER TABLE attempts ADD COLUMN throttled INTEGER NOT NULL DEFAULT 0;`,
+		Down:    `ALTER TABLE attempts DROP COLUMN throttled;`,
+	},
+	{
+		Version: 17,
+		Name:    "delivery_seq",
+		Up: `
+			ALTER TABLE deliveries ADD COLUMN seq INTEGER NOT NULL DEFAULT 0;
+			UPDATE deliveries SET seq = rowid;
+			CREATE UNIQUE INDEX idx_deliveries_seq ON deliveries(seq);
+			DROP INDEX idx_deliveries_endpoint_pending;
+			CREATE INDEX idx_deliveries_endpoint_pending ON deliveries(endpoint_id, rank_at, seq) WHERE status IN ('pending', 'retrying');
+			DROP INDEX idx_deliveries_ordering;
+			CREATE INDEX idx_deliveries_ordering ON deliveries(endpoint_id, ordering_key, seq) WHERE ordering_key <> '' AND status IN ('pending', 'retrying');`,
+		Down: `
+			DROP INDEX idx_deliveries_ordering;
+			CREATE INDEX idx_deliveries_ordering ON deliveries(endpoint_id, ordering_key, created_at) WHERE ordering_key <> '' AND status IN ('pending', 'retrying');
+			DROP INDEX idx_deliveries_endpoint_pending;
+			CREATE INDEX idx_deliveries_endpoint_pending ON deliveries(endpoint_id, rank_at) WHERE status IN ('pending', 'retrying');
+			DROP INDEX idx_deliveries_seq;
+			ALTER TABLE deliveries DROP COLUMN seq;`,
+	},
+	{
+		Version: 18,
+		Name:    "delivery_linger_until",
+		Up:      `ALTER TABLE deliveries ADD COLUMN linger_until DATETIME;`,
+		Down:    `ALTER TABLE deliveries DROP COLUMN linger_until;`,
+	},
+}
@@ -0,0 +1,666 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/jackc/pgx/v5/stdlib"
+	"github.com/shohag/piperelay/internal/config"
+	"github.com/shohag/piperelay/internal/models"
+)
+
+// PostgresStorage is a Storage backed by PostgreSQL. Unlike SQLite it allows
+// several PipeRelay processes to share one database: deliveries are claimed
+// with FOR UPDATE SKIP LOCKED, so concurrent pollers never pick the same row.
+type PostgresStorage struct {
+	db *sql.DB
+}
+
+func NewPostgres(cfg config.PostgresConfig) (*PostgresStorage, error) {
+	db, err := sql.Open("pgx", cfg.DSN)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(cfg.MaxOpenConns)
+	db.SetMaxIdleConns(cfg.MaxIdleConns)
+	db.SetConnMaxLifetime(cfg.ConnMaxLifetime)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &PostgresStorage{db: db}, nil
+}
+
+func (s *PostgresStorage) Migrate(ctx context.Context) error {
+	_, err := s.Migrator().Up(ctx, false)
+	return err
+}
+
+// pgMigrationLock is the advisory lock key replicas take before migrating.
+// Any fixed number works as long as nothing else in the database uses it.
+const pgMigrationLock = `7118202512917033`
+
+func (s *PostgresStorage) Migrator() *Migrator {
+	m := NewMigrator(s.db, postgresMigrations, true)
+	m.lock = `SELECT pg_advisory_lock(` + pgMigrationLock + `)`
+	m.unlock = `SELECT pg_advisory_unlock(` + pgMigrationLock + `)`
+	return m
+}
+
+func (s *PostgresStorage) Close() error {
+	return s.db.Close()
+}
+
+// --- Applications ---
+
+func (s *PostgresStorage) CreateApplication(ctx context.Context, app *models.Application) error {
+	_, err := s.db.ExecContext(ctx,
+		`INSERT INTO applications (`+applicationColumns+`) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+		app.ID, app.Name, app.APIKey, policyValue(app.RetryPolicy), app.Weight, prioritiesValue(app.EventPriorities), app.ResponseBodyLimit, app.CreatedAt, app.UpdatedAt,
+	)
+	return err
+}
+
+func (s *PostgresStorage) GetApplication(ctx context.Context, id string) (*models.Application, error) {
+	app, err := scanApplication(s.db.QueryRowContext(ctx,
+		`SELECT `+applicationColumns+` FROM applications WHERE id = $1`, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return app, err
+}
+
+func (s *PostgresStorage) GetApplicationByAPIKey(ctx context.Context, apiKey string) (*models.Application, error) {
+	app, err := scanApplication(s.db.QueryRowContext(ctx,
+		`SELECT `+applicationColumns+` FROM applications WHERE api_key = $1`, apiKey))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return app, err
+}
+
+func (s *PostgresStorage) ListApplications(ctx context.Context) ([]models.Application, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+applicationColumns+` FROM applications ORDER BY created_at DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var apps []models.Application
+	for rows.Next() {
+		app, err := scanApplication(rows)
+		if err != nil {
+			return nil, err
+		}
+		apps = append(apps, *app)
+	}
+	return apps, rows.Err()
+}
+
+func (s *PostgresStorage) UpdateApplication(ctx context.Context, app *models.Application) error {
+	_, err := s.db.ExecContext(ctx,
+		`UPDATE applications SET name = $1, retry_policy = $2, weight = $3, event_priorities = $4, response_body_limit = $5, updated_at = $6 WHERE id = $7`,
+		app.Name, policyValue(app.RetryPolicy), app.Weight, prioritiesValue(app.EventPriorities), app.ResponseBodyLimit, time.Now().UTC(), app.ID,
+	)
+	return err
+}
+
+func (s *PostgresStorage) DeleteApplication(ctx context.Context, id string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM applications WHERE id = $1`, id)
+	return err
+}
+
+func (s *PostgresStorage) UpdateApplicationAPIKey(ctx context.Context, id, newKey string) error {
+	_, err := s.db.ExecContext(ctx,
+		`UPDATE applications SET api_key = $1, updated_at = $2 WHERE id = $3`,
+		newKey, time.Now().UTC(), id,
+	)
+	return err
+}
+
+// --- Endpoints ---
+
+func (s *PostgresStorage) CreateEndpoint(ctx context.Context, ep *models.Endpoint) error {
+	eventTypes, _ := json.Marshal(ep.EventTypes)
+	metadata, _ := json.Marshal(ep.Metadata)
+	_, err := s.db.ExecContext(ctx,
+		`INSERT INTO endpoints (id, app_id, url, description, secret, event_types, rate_limit, message_ttl_ms, retry_policy, max_concurrency, fifo, batch, redirect_policy, metadata, active, created_at, updated_at)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17)`,
+		ep.ID, ep.AppID, ep.URL, ep.Description, ep.Secret, string(eventTypes), ep.RateLimit, durationMs(ep.MessageTTL), policyValue(ep.RetryPolicy), ep.MaxConcurrency, ep.FIFO, batchValue(ep.Batch), ep.RedirectPolicy, string(metadata), ep.Active, ep.CreatedAt, ep.UpdatedAt,
+	)
+	return err
+}
+
+func (s *PostgresStorage) scanEndpoint(row interface{ Scan(...interface{}) error }) (*models.Endpoint, error) {
+	var ep models.Endpoint
+	var eventTypes, metadata string
+	var messageTTL int64
+	var policy, batch sql.NullString
+	err := row.Scan(&ep.ID, &ep.AppID, &ep.URL, &ep.Description, &ep.Secret, &eventTypes, &ep.RateLimit, &messageTTL, &policy, &ep.MaxConcurrency, &ep.FIFO, &batch, &ep.RedirectPolicy, &ep.SuggestedURL, &metadata, &ep.Active, &ep.DisabledReason, &ep.DisabledAt, &ep.CreatedAt, &ep.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	json.Unmarshal([]byte(eventTypes), &ep.EventTypes)
+	json.Unmarshal([]byte(metadata), &ep.Metadata)
+	ep.MessageTTL = models.Duration(time.Duration(messageTTL) * time.Millisecond)
+	ep.RetryPolicy = parsePolicy(policy)
+	ep.Batch = parseBatch(batch)
+	return &ep, nil
+}
+
+func (s *PostgresStorage) GetEndpoint(ctx context.Context, id string) (*models.Endpoint, error) {
+	row := s.db.QueryRowContext(ctx,
+		`SELECT `+endpointColumns+` FROM endpoints WHERE id = $1`, id)
+	ep, err := s.scanEndpoint(row)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return ep, err
+}
+
+func (s *PostgresStorage) ListEndpoints(ctx context.Context, appID string) ([]models.Endpoint, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT `+endpointColumns+` FROM endpoints WHERE app_id = $1 ORDER BY created_at DESC`, appID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var endpoints []models.Endpoint
+	for rows.Next() {
+		ep, err := s.scanEndpoint(rows)
+		if err != nil {
+			return nil, err
+		}
+		endpoints = append(endpoints, *ep)
+	}
+	return endpoints, rows.Err()
+}
+
+func (s *PostgresStorage) UpdateEndpoint(ctx context.Context, ep *models.Endpoint) error {
+	eventTypes, _ := json.Marshal(ep.EventTypes)
+	metadata, _ := json.Marshal(ep.Metadata)
+	_, err := s.db.ExecContext(ctx,
+		`UPDATE endpoints SET url = $1, description = $2, event_types = $3, rate_limit = $4, message_ttl_ms = $5, retry_policy = $6, max_concurrency = $7, fifo = $8, batch = $9, redirect_policy = $10, suggested_url = $11, metadata = $12, active = $13, updated_at = $14 WHERE id = $15`,
+		ep.URL, ep.Description, string(eventTypes), ep.RateLimit, durationMs(ep.MessageTTL), policyValue(ep.RetryPolicy), ep.MaxConcurrency, ep.FIFO, batchValue(ep.Batch), ep.RedirectPolicy, ep.SuggestedURL, string(metadata), ep.Active, time.Now().UTC(), ep.ID,
+	)
+	return err
+}
+
+func (s *PostgresStorage) DeleteEndpoint(ctx context.Context, id string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM endpoints WHERE id = $1`, id)
+	return err
+}
+
+func (s *PostgresStorage) ToggleEndpoint(ctx context.Context, id string, active bool) error {
+	_, err := s.db.ExecContext(ctx,
+		`UPDATE endpoints SET active = $1, disabled_reason = '', disabled_at = NULL, updated_at = $2 WHERE id = $3`,
+		active, time.Now().UTC(), id,
+	)
+	return err
+}
+
+func (s *PostgresStorage) DisableEndpoint(ctx context.Context, id, reason string) error {
+	now := time.Now().UTC()
+	_, err := s.db.ExecContext(ctx,
+		`UPDATE endpoints SET active = FALSE, disabled_reason = $1, disabled_at = $2, updated_at = $2 WHERE id = $3`,
+		reason, now, id,
+	)
+	return err
+}
+
+func (s *PostgresStorage) SuggestEndpointURL(ctx context.Context, id, url string) error {
+	_, err := s.db.ExecContext(ctx,
+		`UPDATE endpoints SET suggested_url = $1, updated_at = $2 WHERE id = $3`,
+		url, time.Now().UTC(), id,
+	)
+	return err
+}
+
+func (s *PostgresStorage) GetEndpointsByEventType(ctx context.Context, appID, eventType string) ([]models.Endpoint, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT `+endpointColumns+`
+		 FROM endpoints WHERE app_id = $1 AND active ORDER BY created_at DESC`, appID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var endpoints []models.Endpoint
+	for rows.Next() {
+		ep, err := s.scanEndpoint(rows)
+		if err != nil {
+			return nil, err
+		}
+		if matchesEventType(ep.EventTypes, eventType) {
+			endpoints = append(endpoints, *ep)
+		}
+	}
+	return endpoints, rows.Err()
+}
+
+// --- Messages ---
+
+const pgInsertMessage = `INSERT INTO messages (` + messageColumns + `) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`
+
+func (s *PostgresStorage) CreateMessage(ctx context.Context, msg *models.Message) error {
+	_, err := s.db.ExecContext(ctx, pgInsertMessage, messageValues(msg)...)
+	return err
+}
+
+func (s *PostgresStorage) CreateMessageWithDeliveries(ctx context.Context, msg *models.Message, deliveries []models.Delivery) error {
+	return s.CreateMessagesWithDeliveries(ctx, []MessageWithDeliveries{{Message: msg, Deliveries: deliveries}})
+}
+
+func (s *PostgresStorage) CreateMessagesWithDeliveries(ctx context.Context, batch []MessageWithDeliveries) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := insertMessages(ctx, tx, pgInsertMessage, pgInsertDelivery, pgKeyStatements, batch); err != nil {
+		return err
+	}
+	// Postgres delivers the notification on commit, so listeners never
+	// look for deliveries they cannot see yet.
+	if dueNow(batch) {
+		if _, err := tx.ExecContext(ctx, `NOTIFY `+pgDeliveriesChannel); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// A transaction binding a key that another one has just bound blocks in
+// bind until that one commits or rolls back, then sees its outcome, so
+// concurrent requests with one key never both store their message.
+var pgKeyStatements = keyStatements{
+	drop:  `DELETE FROM idempotency_keys WHERE app_id = $1 AND idempotency_key = $2 AND created_at < $3`,
+	bind:  `INSERT INTO idempotency_keys (app_id, idempotency_key, message_id, created_at) VALUES ($1, $2, $3, $4) ON CONFLICT (app_id, idempotency_key) DO NOTHING`,
+	bound: `SELECT message_id FROM idempotency_keys WHERE app_id = $1 AND idempotency_key = $2`,
+}
+
+// pgDeliveriesChannel is the LISTEN/NOTIFY channel announcing deliveries
+// that are due now.
+const pgDeliveriesChannel = "piperelay_deliveries"
+
+func dueNow(batch []MessageWithDeliveries) bool {
+	for _, m := range batch {
+		if m.ReplayOf != "" {
+			continue
+		}
+		for _, d := range m.Deliveries {
+			if d.NextRetryAt == nil && d.LingerUntil == nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ListenDeliveries holds one connection from the pool for as long as it
+// runs, and calls fn for every notification on pgDeliveriesChannel.
+func (s *PostgresStorage) ListenDeliveries(ctx context.Context, fn func()) error {
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	return conn.Raw(func(driverConn interface{}) error {
+		pc := driverConn.(*stdlib.Conn).Conn()
+		if _, err := pc.Exec(ctx, `LISTEN `+pgDeliveriesChannel); err != nil {
+			return err
+		}
+		defer pc.Exec(context.Background(), `UNLISTEN `+pgDeliveriesChannel)
+
+		for {
+			if _, err := pc.WaitForNotification(ctx); err != nil {
+				return err
+			}
+			fn()
+		}
+	})
+}
+
+func (s *PostgresStorage) GetMessage(ctx context.Context, id string) (*models.Message, error) {
+	msg, err := scanMessage(s.db.QueryRowContext(ctx, `SELECT `+messageColumns+` FROM messages WHERE id = $1`, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return msg, err
+}
+
+func (s *PostgresStorage) ListMessages(ctx context.Context, appID string, limit, offset int) ([]models.Message, error) {
+	if limit <= 0 {
+		limit = 50
+	}
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT `+messageColumns+` FROM messages WHERE app_id = $1 ORDER BY created_at DESC LIMIT $2 OFFSET $3`,
+		appID, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	return scanMessages(rows)
+}
+
+func (s *PostgresStorage) ListScheduledMessages(ctx context.Context, appID string, limit, offset int) ([]models.Message, error) {
+	if limit <= 0 {
+		limit = 50
+	}
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT `+messageColumns+` FROM messages m
+		 WHERE m.app_id = $1 AND m.deliver_at > $2
+		   AND EXISTS (SELECT 1 FROM deliveries d WHERE d.message_id = m.id AND d.status = 'pending')
+		 ORDER BY m.deliver_at LIMIT $3 OFFSET $4`,
+		appID, time.Now().UTC(), limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	return scanMessages(rows)
+}
+
+func (s *PostgresStorage) CancelScheduledDeliveries(ctx context.Context, messageID string) (int64, error) {
+	now := time.Now().UTC()
+	res, err := s.db.ExecContext(ctx,
+		`UPDATE deliveries SET status = $1, next_retry_at = NULL, locked_by = '', locked_until = NULL, lease_token = '', updated_at = $2
+		 WHERE message_id = $3 AND status = $4 AND next_retry_at > $2
+		   AND (locked_until IS NULL OR locked_until <= $2)`,
+		models.DeliveryCancelled, now, messageID, models.DeliveryPending)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// --- Deliveries ---
+
+const pgInsertDelivery = `INSERT INTO deliveries (id, message_id, endpoint_id, status, attempt_count, retry_policy, priority, ordering_key, rank_at, next_retry_at, linger_until, created_at, updated_at)
+	 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)`
+
+func (s *PostgresStorage) CreateDelivery(ctx context.Context, d *models.Delivery) error {
+	_, err := s.db.ExecContext(ctx, pgInsertDelivery,
+		d.ID, d.MessageID, d.EndpointID, d.Status, d.AttemptCount, policyValue(d.RetryPolicy), d.Priority, d.OrderingKey, d.RankAt, d.NextRetryAt, d.LingerUntil, d.CreatedAt, d.UpdatedAt,
+	)
+	return err
+}
+
+func (s *PostgresStorage) GetDelivery(ctx context.Context, id string) (*models.Delivery, error) {
+	row := s.db.QueryRowContext(ctx, `SELECT `+deliveryColumns+` FROM deliveries WHERE id = $1`, id)
+	d, err := scanDelivery(row)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return d, err
+}
+
+func (s *PostgresStorage) GetDeliveriesByMessage(ctx context.Context, messageID string) ([]models.Delivery, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT `+deliveryColumns+` FROM deliveries WHERE message_id = $1 ORDER BY created_at`, messageID)
+	if err != nil {
+		return nil, err
+	}
+	return scanDeliveries(rows)
+}
+
+func (s *PostgresStorage) UpdateDeliveryStatus(ctx context.Context, id string, status models.DeliveryStatus, nextRetryAt *interface{}) error {
+	_, err := s.db.ExecContext(ctx,
+		`UPDATE deliveries SET status = $1, updated_at = $2 WHERE id = $3`,
+		status, time.Now().UTC(), id,
+	)
+	return err
+}
+
+// UpdateDelivery persists the outcome of an attempt and releases the lease
+// d.LeaseToken was claimed with.
+func (s *PostgresStorage) UpdateDelivery(ctx context.Context, d *models.Delivery) error {
+	res, err := s.db.ExecContext(ctx,
+		`UPDATE deliveries SET status = $1, attempt_count = $2, throttled_count = $3, next_retry_at = $4, locked_by = '', locked_until = NULL, lease_token = '', updated_at = $5 WHERE id = $6 AND lease_token = $7`,
+		d.Status, d.AttemptCount, d.ThrottledCount, d.NextRetryAt, time.Now().UTC(), d.ID, d.LeaseToken,
+	)
+	return leaseHeld(res, err)
+}
+
+// pgPendingDeliveriesWhere matches deliveries that are due, not leased by a
+// live worker and not held back by inOrderWhere. $1 is the current time and
+// $2 the time lingering deliveries must be due by, as in sqliteDueWhere.
+const pgPendingDeliveriesWhere = `status IN ('pending', 'retrying')
+	   AND (next_retry_at IS NULL OR next_retry_at <= $1)
+	   AND (linger_until IS NULL OR linger_until <= $2)
+	   AND (locked_until IS NULL OR locked_until <= $1)
+	   AND ` + inOrderWhere
+
+// pgEndpointDue matches endpoint e's due deliveries, aliased d, as
+// pgPendingDeliveriesWhere does. $1 is the current time.
+const pgEndpointDue = `d.endpoint_id = e.id AND d.status IN ('pending', 'retrying')
+	   AND (d.next_retry_at IS NULL OR d.next_retry_at <= $1)
+	   AND (d.linger_until IS NULL OR d.linger_until <= $1)
+	   AND (d.locked_until IS NULL OR d.locked_until <= $1)
+	   AND ` + inOrderWhere
+
+// DueEndpoints skips inactive endpoints; their deliveries wait, unclaimed,
+// until the endpoint is enabled again. The join on each endpoint's first
+// due delivery drops endpoints with nothing due.
+func (s *PostgresStorage) DueEndpoints(ctx context.Context, limit int) ([]EndpointBacklog, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT e.id, e.app_id, a.weight, e.max_concurrency, e.batch, h.rank_at,
+			(SELECT COUNT(*) FROM (
+				SELECT 1 FROM deliveries d WHERE `+pgEndpointDue+` LIMIT $2) due_rows) AS due,
+			(SELECT COUNT(*) FROM deliveries l WHERE l.endpoint_id = e.id AND l.locked_until > $1) AS in_flight
+		 FROM endpoints e
+		 JOIN applications a ON a.id = e.app_id
+		 JOIN deliveries h ON h.id = (
+			SELECT d.id FROM deliveries d WHERE `+pgEndpointDue+` ORDER BY d.rank_at, d.seq LIMIT 1)
+		 WHERE e.active`,
+		time.Now().UTC(), limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanBacklog(rows)
+}
+
+// ClaimDeliveries selects and leases each endpoint's share in one statement
+// per endpoint. SKIP LOCKED makes concurrent claimers on other replicas pass
+// over rows this claim is about to lease instead of blocking on or
+// double-claiming them.
+func (s *PostgresStorage) ClaimDeliveries(ctx context.Context, opts ClaimOptions) ([]models.Delivery, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	token := models.NewID("lease")
+	var claimed []models.Delivery
+
+	for endpointID, n := range opts.PerEndpoint {
+		rows, err := tx.QueryContext(ctx,
+			`UPDATE deliveries SET locked_by = $3, locked_until = $4, lease_token = $7, updated_at = $1
+			 WHERE id IN (
+				SELECT id FROM deliveries d
+				WHERE endpoint_id = $5 AND `+pgPendingDeliveriesWhere+`
+				ORDER BY rank_at, seq LIMIT $6
+				FOR UPDATE SKIP LOCKED
+			 )
+			 RETURNING `+deliveryColumns,
+			now, now.Add(opts.Linger[endpointID]), opts.WorkerID, now.Add(opts.Lease), endpointID, n, token)
+		if err != nil {
+			return nil, err
+		}
+		deliveries, err := scanDeliveries(rows)
+		if err != nil {
+			return nil, err
+		}
+		claimed = append(claimed, deliveries...)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return claimed, nil
+}
+
+func (s *PostgresStorage) ReleaseFullBatch(ctx context.Context, endpointID string, size int, linger time.Duration) (bool, error) {
+	now := time.Now().UTC()
+	res, err := s.db.ExecContext(ctx,
+		`UPDATE deliveries SET linger_until = NULL, updated_at = $1
+		 WHERE id = (
+			SELECT d.id FROM deliveries d
+			 WHERE endpoint_id = $3 AND `+pgPendingDeliveriesWhere+`
+			 ORDER BY rank_at, seq LIMIT 1)
+		   AND (SELECT COUNT(*) FROM (
+			SELECT 1 FROM deliveries d
+			 WHERE endpoint_id = $3 AND `+pgPendingDeliveriesWhere+`
+			 LIMIT $4) batch) >= $4`,
+		now, now.Add(linger), endpointID, size)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// --- Attempts ---
+
+func (s *PostgresStorage) CreateAttempt(ctx context.Context, a *models.Attempt) error {
+	createdAt, err := time.Parse(time.RFC3339, a.CreatedAt)
+	if err != nil {
+		createdAt = time.Now().UTC()
+	}
+	_, err = s.db.ExecContext(ctx,
+		`INSERT INTO attempts (id, delivery_id, attempt_number, status_code, request_headers, response_headers, response_body, latency_ms, timing, error, final_url, redirects, throttled, created_at)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)`,
+		a.ID, a.DeliveryID, a.AttemptNumber, a.StatusCode, headersValue(a.RequestHeaders), headersValue(a.ResponseHeaders), a.ResponseBody, a.LatencyMs, timingValue(a.Timing), a.Error, a.FinalURL, redirectsValue(a.Redirects), a.Throttled, createdAt,
+	)
+	return err
+}
+
+func (s *PostgresStorage) GetAttemptsByDelivery(ctx context.Context, deliveryID string) ([]models.Attempt, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT id, delivery_id, attempt_number, status_code, request_headers, response_headers, response_body, latency_ms, timing, error, final_url, redirects, throttled, created_at FROM attempts WHERE delivery_id = $1 ORDER BY attempt_number, throttled DESC, created_at, id`, deliveryID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var attempts []models.Attempt
+	for rows.Next() {
+		var a models.Attempt
+		var requestHeaders, responseHeaders, timing, redirects sql.NullString
+		var createdAt time.Time
+		if err := rows.Scan(&a.ID, &a.DeliveryID, &a.AttemptNumber, &a.StatusCode, &requestHeaders, &responseHeaders, &a.ResponseBody, &a.LatencyMs, &timing, &a.Error, &a.FinalURL, &redirects, &a.Throttled, &createdAt); err != nil {
+			return nil, err
+		}
+		a.CreatedAt = createdAt.UTC().Format(time.RFC3339)
+		a.RequestHeaders = parseHeaders(requestHeaders)
+		a.ResponseHeaders = parseHeaders(responseHeaders)
+		a.Timing = parseTiming(timing)
+		a.Redirects = parseRedirects(redirects)
+		attempts = append(attempts, a)
+	}
+	return attempts, rows.Err()
+}
+
+// --- Retention ---
+
+const pgPurgeableMessages = `SELECT id FROM messages m
+	 WHERE m.created_at < $1
+	   AND NOT EXISTS (
+		SELECT 1 FROM deliveries d WHERE d.message_id = m.id AND d.status IN ('pending', 'retrying')
+	   )`
+
+func (s *PostgresStorage) PurgeAttempts(ctx context.Context, before time.Time, limit int) (int64, error) {
+	res, err := s.db.ExecContext(ctx,
+		`DELETE FROM attempts WHERE id IN (SELECT id FROM attempts WHERE created_at < $1 LIMIT $2)`,
+		before.UTC(), limit)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (s *PostgresStorage) PurgeMessages(ctx context.Context, before time.Time, limit int) (int64, error) {
+	res, err := s.db.ExecContext(ctx,
+		`DELETE FROM messages WHERE id IN (`+pgPurgeableMessages+` LIMIT $2)`,
+		before.UTC(), limit)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (s *PostgresStorage) CountPurgeable(ctx context.Context, attemptsBefore, messagesBefore time.Time) (int64, int64, error) {
+	var attempts, messages int64
+	if err := s.db.QueryRowContext(ctx,
+		`SELECT COUNT(*) FROM attempts WHERE created_at < $1`, attemptsBefore.UTC(),
+	).Scan(&attempts); err != nil {
+		return 0, 0, err
+	}
+	if err := s.db.QueryRowContext(ctx,
+		`SELECT COUNT(*) FROM (`+pgPurgeableMessages+`) purgeable`, messagesBefore.UTC(),
+	).Scan(&messages); err != nil {
+		return 0, 0, err
+	}
+	return attempts, messages, nil
+}
+
+func (s *PostgresStorage) PurgeIdempotencyKeys(ctx context.Context, before time.Time, limit int) (int64, error) {
+	res, err := s.db.ExecContext(ctx,
+		`DELETE FROM idempotency_keys WHERE ctid IN (SELECT ctid FROM idempotency_keys WHERE created_at < $1 LIMIT $2)`,
+		before.UTC(), limit)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// --- Stats ---
+
+func (s *PostgresStorage) GetStats(ctx context.Context, appID string) (*Stats, error) {
+	stats := &Stats{}
+
+	err := s.db.QueryRowContext(ctx,
+		`SELECT
+			COUNT(*),
+			COUNT(*) FILTER (WHERE d.status = 'success'),
+			COUNT(*) FILTER (WHERE d.status = 'failed'),
+			COUNT(*) FILTER (WHERE d.status IN ('pending', 'retrying')),
+			COUNT(*) FILTER (WHERE d.status = 'expired'),
+			COALESCE(SUM(d.throttled_count), 0)
+		 FROM deliveries d JOIN messages m ON d.message_id = m.id WHERE m.app_id = $1`, appID,
+	).Scan(&stats.TotalDeliveries, &stats.SuccessCount, &stats.FailedCount, &stats.PendingCount, &stats.ExpiredCount, &stats.ThrottledCount)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM messages WHERE app_id = $1`, appID).Scan(&stats.TotalMessages); err != nil {
+		return nil, err
+	}
+	if err := s.db.QueryRowContext(ctx,
+		`SELECT COUNT(*), COUNT(*) FILTER (WHERE active) FROM endpoints WHERE app_id = $1`, appID,
+	).Scan(&stats.TotalEndpoints, &stats.ActiveEndpoints); err != nil {
+		return nil, err
+	}
+
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT d.priority, COUNT(*) FROM deliveries d JOIN messages m ON d.message_id = m.id
+		 WHERE m.app_id = $1 AND d.status IN ('pending', 'retrying') GROUP BY d.priority`, appID)
+	if err != nil {
+		return nil, err
+	}
+	if stats.Backlog, err = scanPriorityCounts(rows); err != nil {
+		return nil, err
+	}
+
+	if stats.TotalDeliveries > 0 {
+		stats.SuccessRate = float64(stats.SuccessCount) / float64(stats.TotalDeliveries) * 100
+	}
+
+	return stats, nil
+}
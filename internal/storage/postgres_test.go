@@ -0,0 +1,386 @@
+//go:build integration
+
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/shohag/piperelay/internal/config"
+	"github.com/shohag/piperelay/internal/models"
+)
+
+// These tests need a PostgreSQL server. Point PIPERELAY_TEST_POSTGRES_DSN at
+// one, or run `make test-postgres` to start the postgres service from
+// docker-compose.yml. Each test works in a schema of its own, dropped
+// afterwards.
+const postgresDSNEnv = "PIPERELAY_TEST_POSTGRES_DSN"
+
+func newTestPostgres(t *testing.T) *PostgresStorage {
+	t.Helper()
+	dsn := os.Getenv(postgresDSNEnv)
+	if dsn == "" {
+		t.Skipf("%s is not set", postgresDSNEnv)
+	}
+
+	admin, err := sql.Open("pgx", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { admin.Close() })
+
+	schema := strings.ToLower(models.NewID("test"))
+	if _, err := admin.Exec(`CREATE SCHEMA ` + schema); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { admin.Exec(`DROP SCHEMA ` + schema + ` CASCADE`) })
+
+	sep := " "
+	if strings.Contains(dsn, "://") {
+		sep = "?"
+		if strings.Contains(dsn, "?") {
+			sep = "&"
+		}
+	}
+	store, err := NewPostgres(config.PostgresConfig{
+		DSN:          dsn + sep + "search_path=" + schema,
+		MaxOpenConns: 20,
+		MaxIdleConns: 20,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func TestPostgresMigrations(t *testing.T) {
+	ctx := context.Background()
+	store := newTestPostgres(t)
+	m := store.Migrator()
+
+	applied, err := m.Up(ctx, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != len(postgresMigrations) {
+		t.Fatalf("applied %d migrations, want %d", len(applied), len(postgresMigrations))
+	}
+	if pending, err := m.Up(ctx, true); err != nil || len(pending) != 0 {
+		t.Fatalf("pending after up = %d (%v), want none", len(pending), err)
+	}
+
+	status, err := m.Status(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, st := range status {
+		if !st.Applied {
+			t.Fatalf("migration %d (%s) not applied", st.Version, st.Name)
+		}
+	}
+
+	// Every version must roll back cleanly and apply again on top of the
+	// one below it.
+	for i := len(postgresMigrations) - 1; i >= 0; i-- {
+		below := 0
+		if i > 0 {
+			below = postgresMigrations[i-1].Version
+		}
+		if _, err := m.Down(ctx, below, false); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := m.Up(ctx, false); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := m.Down(ctx, below, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var tables int
+	if err := store.db.QueryRowContext(ctx,
+		`SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = current_schema() AND table_name <> 'schema_migrations'`,
+	).Scan(&tables); err != nil {
+		t.Fatal(err)
+	}
+	if tables != 0 {
+		t.Fatalf("%d tables left after rolling everything back", tables)
+	}
+
+	if _, err := m.Up(ctx, false); err != nil {
+		t.Fatal(err)
+	}
+	testStoreRoundTrip(t, store)
+}
+
+// Replicas starting together all run Migrate; the advisory lock must make
+// them take turns so each migration is applied exactly once.
+func TestPostgresConcurrentMigrations(t *testing.T) {
+	ctx := context.Background()
+	store := newTestPostgres(t)
+
+	const migrators = 4
+	applied := make([][]Migration, migrators)
+	errs := make([]error, migrators)
+	var wg sync.WaitGroup
+	for i := 0; i < migrators; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			applied[i], errs[i] = store.Migrator().Up(ctx, false)
+		}(i)
+	}
+	wg.Wait()
+
+	total := 0
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("migrator %d: %v", i, err)
+		}
+		total += len(applied[i])
+	}
+	if total != len(postgresMigrations) {
+		t.Fatalf("migrators applied %d migrations between them, want %d", total, len(postgresMigrations))
+	}
+
+	var recorded int
+	if err := store.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM schema_migrations`).Scan(&recorded); err != nil {
+		t.Fatal(err)
+	}
+	if recorded != len(postgresMigrations) {
+		t.Fatalf("schema_migrations has %d rows, want %d", recorded, len(postgresMigrations))
+	}
+}
+
+// testStoreRoundTrip checks the fully migrated schema against the columns
+// the driver reads and writes.
+func testStoreRoundTrip(t *testing.T, store *PostgresStorage) {
+	t.Helper()
+	ctx := context.Background()
+	ep := createTestEndpoint(t, store)
+	createTestDeliveries(t, store, ep, 1)
+
+	got, err := store.GetEndpoint(ctx, ep.ID)
+	if err != nil || got == nil {
+		t.Fatalf("GetEndpoint = %v, %v", got, err)
+	}
+	backlog, err := store.DueEndpoints(ctx, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backlog) != 1 || backlog[0].EndpointID != ep.ID || backlog[0].Due != 1 {
+		t.Fatalf("DueEndpoints = %+v", backlog)
+	}
+	if _, err := store.GetStats(ctx, ep.AppID); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPostgresDueEndpoints(t *testing.T) {
+	store := newTestPostgres(t)
+	if err := store.Migrate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	testDueEndpoints(t, store)
+}
+
+func TestPostgresConcurrentClaimsNeverOverlap(t *testing.T) {
+	ctx := context.Background()
+	store := newTestPostgres(t)
+	if err := store.Migrate(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	const total, claimers = 300, 8
+	ep := createTestEndpoint(t, store)
+	other := createTestEndpoint(t, store)
+	ids := createTestDeliveries(t, store, ep, total)
+	ids = append(ids, createTestDeliveries(t, store, other, total)...)
+
+	var mu sync.Mutex
+	claimedBy := make(map[string]string)
+	var wg sync.WaitGroup
+	errs := make(chan error, claimers)
+	for c := 0; c < claimers; c++ {
+		worker := fmt.Sprintf("worker-%d", c)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				ds, err := store.ClaimDeliveries(ctx, ClaimOptions{
+					WorkerID:    worker,
+					Lease:       time.Minute,
+					PerEndpoint: map[string]int{ep.ID: 7, other.ID: 5},
+				})
+				if err != nil {
+					errs <- err
+					return
+				}
+				if len(ds) == 0 {
+					return
+				}
+
+				mu.Lock()
+				for _, d := range ds {
+					if prev, ok := claimedBy[d.ID]; ok {
+						mu.Unlock()
+						errs <- fmt.Errorf("delivery %s claimed by %s and %s", d.ID, prev, worker)
+						return
+					}
+					if d.LockedBy != worker {
+						mu.Unlock()
+						errs <- fmt.Errorf("delivery %s returned locked by %q to %s", d.ID, d.LockedBy, worker)
+						return
+					}
+					claimedBy[d.ID] = worker
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	if len(claimedBy) != len(ids) {
+		t.Fatalf("claimed %d deliveries, want %d", len(claimedBy), len(ids))
+	}
+	workers := make(map[string]bool)
+	for _, w := range claimedBy {
+		workers[w] = true
+	}
+	t.Logf("%d deliveries claimed by %d workers", len(claimedBy), len(workers))
+}
+
+func TestPostgresExpiredLeaseIsReclaimed(t *testing.T) {
+	store := newTestPostgres(t)
+	if err := store.Migrate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	testExpiredLeaseIsReclaimed(t, store)
+}
+
+func TestPostgresCancelRespectsLeases(t *testing.T) {
+	store := newTestPostgres(t)
+	if err := store.Migrate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	testCancelRespectsLeases(t, store)
+}
+
+func TestPostgresKeyOrderFollowsInsertion(t *testing.T) {
+	store := newTestPostgres(t)
+	if err := store.Migrate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	testKeyOrderFollowsInsertion(t, store)
+}
+
+func TestPostgresLingerClaimsOnlyLingering(t *testing.T) {
+	store := newTestPostgres(t)
+	if err := store.Migrate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	testLingerClaimsOnlyLingering(t, store)
+}
+
+func TestPostgresIdempotencyKeys(t *testing.T) {
+	store := newTestPostgres(t)
+	if err := store.Migrate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	testIdempotencyKeys(t, store)
+}
+
+// Requests racing with one key must store a single message between them;
+// the others wait for it and replay it.
+func TestPostgresConcurrentIdempotencyKeys(t *testing.T) {
+	ctx := context.Background()
+	store := newTestPostgres(t)
+	if err := store.Migrate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	ep := createTestEndpoint(t, store)
+
+	const senders = 8
+	batches := make([][]MessageWithDeliveries, senders)
+	errs := make([]error, senders)
+	var wg sync.WaitGroup
+	for i := range batches {
+		batches[i] = []MessageWithDeliveries{keyedMessage(ep, "k", time.Now().UTC().Add(-time.Hour))}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = store.CreateMessagesWithDeliveries(ctx, batches[i])
+		}(i)
+	}
+	wg.Wait()
+
+	var stored []string
+	for i, b := range batches {
+		if errs[i] != nil {
+			t.Fatalf("sender %d: %v", i, errs[i])
+		}
+		if b[0].ReplayOf == "" {
+			stored = append(stored, b[0].Message.ID)
+		}
+	}
+	if len(stored) != 1 {
+		t.Fatalf("%d senders stored their message, want 1", len(stored))
+	}
+	for i, b := range batches {
+		if b[0].ReplayOf != "" && b[0].ReplayOf != stored[0] {
+			t.Fatalf("sender %d replayed %s, want %s", i, b[0].ReplayOf, stored[0])
+		}
+	}
+}
+
+func TestPostgresListenDeliveries(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	store := newTestPostgres(t)
+	if err := store.Migrate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	ep := createTestEndpoint(t, store)
+
+	notified := make(chan struct{}, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- store.ListenDeliveries(ctx, func() {
+			select {
+			case notified <- struct{}{}:
+			default:
+			}
+		})
+	}()
+
+	// LISTEN is issued asynchronously; keep queueing until it is heard.
+	tick := time.NewTicker(100 * time.Millisecond)
+	defer tick.Stop()
+	for {
+		createTestDeliveries(t, store, ep, 1)
+		select {
+		case <-notified:
+			cancel()
+			if err := <-done; err != nil && ctx.Err() == nil {
+				t.Fatal(err)
+			}
+			return
+		case err := <-done:
+			t.Fatalf("listener stopped: %v", err)
+		case <-ctx.Done():
+			t.Fatal("no notification for new deliveries")
+		case <-tick.C:
+		}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"net/http"
 	"strings"
 	"time"
 
@@ -25,69 +26,12 @@ func NewSQLite(path string) (*SQLiteStorage, error) {
 }
 
 func (s *SQLiteStorage) Migrate(ctx context.Context) error {
-	queries := []string{
-		`CREATE TABLE IF NOT EXISTS applications (
-			id TEXT PRIMARY KEY,
-			name TEXT NOT NULL,
-			api_key TEXT NOT NULL UNIQUE,
-			created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
-			updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
-		)`,
-		`CREATE TABLE IF NOT EXISTS endpoints (
-			id TEXT PRIMARY KEY,
-			app_id TEXT NOT NULL REFERENCES applications(id) ON DELETE CASCADE,
-			url TEXT NOT NULL,
-			description TEXT NOT NULL DEFAULT '',
-			secret TEXT NOT NULL,
-			event_types TEXT NOT NULL DEFAULT '[]',
-			rate_limit INTEGER NOT NULL DEFAULT 0,
-			metadata TEXT NOT NULL DEFAULT '{}',
-			active INTEGER NOT NULL DEFAULT 1,
-			created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
-			updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
-		)`,
-		`CREATE TABLE IF NOT EXISTS messages (
-			id TEXT PRIMARY KEY,
-			app_id TEXT NOT NULL REFERENCES applications(id) ON DELETE CASCADE,
-			event_type TEXT NOT NULL,
-			payload TEXT NOT NULL,
-			created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
-		)`,
-		`CREATE TABLE IF NOT EXISTS deliveries (
-			id TEXT PRIMARY KEY,
-			message_id TEXT NOT NULL REFERENCES messages(id) ON DELETE CASCADE,
-			endpoint_id TEXT NOT NULL REFERENCES endpoints(id) ON DELETE CASCADE,
-			status TEXT NOT NULL DEFAULT 'pending',
-			attempt_count INTEGER NOT NULL DEFAULT 0,
-			next_retry_at DATETIME,
-			created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
-			updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
-		)`,
-		`CREATE TABLE IF NOT EXISTS attempts (
-			id TEXT PRIMARY KEY,
-			delivery_id TEXT NOT NULL REFERENCES deliveries(id) ON DELETE CASCADE,
-			attempt_number INTEGER NOT NULL,
-			status_code INTEGER NOT NULL DEFAULT 0,
-			response_body TEXT NOT NULL DEFAULT '',
-			latency_ms INTEGER NOT NULL DEFAULT 0,
-			error TEXT NOT NULL DEFAULT '',
-			created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
-		)`,
-		`CREATE INDEX IF NOT EXISTS idx_applications_api_key ON applications(api_key)`,
-		`CREATE INDEX IF NOT EXISTS idx_endpoints_app ON endpoints(app_id)`,
-		`CREATE INDEX IF NOT EXISTS idx_messages_app ON messages(app_id)`,
-		`CREATE INDEX IF NOT EXISTS idx_deliveries_message ON deliveries(message_id)`,
-		`CREATE INDEX IF NOT EXISTS idx_deliveries_endpoint ON deliveries(endpoint_id)`,
-		`CREATE INDEX IF NOT EXISTS idx_deliveries_pending ON deliveries(status, next_retry_at) WHERE status IN ('pending', 'retrying')`,
-		`CREATE INDEX IF NOT EXISTS idx_attempts_delivery ON attempts(delivery_id)`,
-	}
-
-	for _, q := range queries {
-		if _, err := s.db.ExecContext(ctx, q); err != nil {
-			return err
-		}
-	}
-	return nil
+	_, err := s.Migrator().Up(ctx, false)
+	return err
+}
+
+func (s *SQLiteStorage) Migrator() *Migrator {
+	return NewMigrator(s.db, sqliteMigrations, false)
 }
 
 func (s *SQLiteStorage) Close() error {
@@ -96,38 +40,78 @@ func (s *SQLiteStorage) Close() error {
 
 // --- Applications ---
 
+const applicationColumns = `id, name, api_key, retry_policy, weight, event_priorities, response_body_limit, created_at, updated_at`
+
+func scanApplication(row interface{ Scan(...interface{}) error }) (*models.Application, error) {
+	var app models.Application
+	var policy, priorities sql.NullString
+	if err := row.Scan(&app.ID, &app.Name, &app.APIKey, &policy, &app.Weight, &priorities, &app.ResponseBodyLimit, &app.CreatedAt, &app.UpdatedAt); err != nil {
+		return nil, err
+	}
+	app.RetryPolicy = parsePolicy(policy)
+	if priorities.Valid {
+		json.Unmarshal([]byte(priorities.String), &app.EventPriorities)
+	}
+	return &app, nil
+}
+
+// prioritiesValue encodes m for a nullable JSON column.
+func prioritiesValue(m map[string]models.Priority) interface{} {
+	if len(m) == 0 {
+		return nil
+	}
+	b, _ := json.Marshal(m)
+	return string(b)
+}
+
+// policyValue encodes p for a nullable JSON column.
+func policyValue(p *models.RetryPolicy) interface{} {
+	if p == nil {
+		return nil
+	}
+	b, _ := json.Marshal(p)
+	return string(b)
+}
+
+func parsePolicy(s sql.NullString) *models.RetryPolicy {
+	if !s.Valid || s.String == "" {
+		return nil
+	}
+	var p models.RetryPolicy
+	if err := json.Unmarshal([]byte(s.String), &p); err != nil {
+		return nil
+	}
+	return &p
+}
+
 func (s *SQLiteStorage) CreateApplication(ctx context.Context, app *models.Application) error {
 	_, err := s.db.ExecContext(ctx,
-		`INSERT INTO applications (id, name, api_key, created_at, updated_at) VALUES (?, ?, ?, ?, ?)`,
-		app.ID, app.Name, app.APIKey, app.CreatedAt, app.UpdatedAt,
+		`INSERT INTO applications (`+applicationColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		app.ID, app.Name, app.APIKey, policyValue(app.RetryPolicy), app.Weight, prioritiesValue(app.EventPriorities), app.ResponseBodyLimit, app.CreatedAt, app.UpdatedAt,
 	)
 	return err
 }
 
 func (s *SQLiteStorage) GetApplication(ctx context.Context, id string) (*models.Application, error) {
-	var app models.Application
-	err := s.db.QueryRowContext(ctx,
-		`SELECT id, name, api_key, created_at, updated_at FROM applications WHERE id = ?`, id,
-	).Scan(&app.ID, &app.Name, &app.APIKey, &app.CreatedAt, &app.UpdatedAt)
+	app, err := scanApplication(s.db.QueryRowContext(ctx,
+		`SELECT `+applicationColumns+` FROM applications WHERE id = ?`, id))
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
-	return &app, err
+	return app, err
 }
 
 func (s *SQLiteStorage) GetApplicationByAPIKey(ctx context.Context, apiKey string) (*models.Application, error) {
-	var app models.Application
-	err := s.db.QueryRowContext(ctx,
-		`SELECT id, name, api_key, created_at, updated_at FROM applications WHERE api_key = ?`, apiKey,
-	).Scan(&app.ID, &app.Name, &app.APIKey, &app.CreatedAt, &app.UpdatedAt)
+	app, err := scanApplication(s.db.QueryRowContext(ctx,
+		`SELECT `+applicationColumns+` FROM applications WHERE api_key = ?`, apiKey))
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
-	return &app, err
+	return app, err
 }
 
 func (s *SQLiteStorage) ListApplications(ctx context.Context) ([]models.Application, error) {
-	rows, err := s.db.QueryContext(ctx, `SELECT id, name, api_key, created_at, updated_at FROM applications ORDER BY created_at DESC`)
+	rows, err := s.db.QueryContext(ctx, `SELECT `+applicationColumns+` FROM applications ORDER BY created_at DESC`)
 	if err != nil {
 		return nil, err
 	}
@@ -135,15 +119,23 @@ func (s *SQLiteStorage) ListApplications(ctx context.Context) ([]models.Applicat
 
 	var apps []models.Application
 	for rows.Next() {
-		var app models.Application
-		if err := rows.Scan(&app.ID, &app.Name, &app.APIKey, &app.CreatedAt, &app.UpdatedAt); err != nil {
+		app, err := scanApplication(rows)
+		if err != nil {
 			return nil, err
 		}
-		apps = append(apps, app)
+		apps = append(apps, *app)
 	}
 	return apps, rows.Err()
 }
 
+func (s *SQLiteStorage) UpdateApplication(ctx context.Context, app *models.Application) error {
+	_, err := s.db.ExecContext(ctx,
+		`UPDATE applications SET name = ?, retry_policy = ?, weight = ?, event_priorities = ?, response_body_limit = ?, updated_at = ? WHERE id = ?`,
+		app.Name, policyValue(app.RetryPolicy), app.Weight, prioritiesValue(app.EventPriorities), app.ResponseBodyLimit, time.Now().UTC(), app.ID,
+	)
+	return err
+}
+
 func (s *SQLiteStorage) DeleteApplication(ctx context.Context, id string) error {
 	_, err := s.db.ExecContext(ctx, `DELETE FROM applications WHERE id = ?`, id)
 	return err
@@ -162,35 +154,128 @@ func (s *SQLiteStorage) UpdateApplicationAPIKey(ctx context.Context, id, newKey
 func (s *SQLiteStorage) CreateEndpoint(ctx context.Context, ep *models.Endpoint) error {
 	eventTypes, _ := json.Marshal(ep.EventTypes)
 	metadata, _ := json.Marshal(ep.Metadata)
-	active := 0
+	active, fifo := 0, 0
 	if ep.Active {
 		active = 1
 	}
+	if ep.FIFO {
+		fifo = 1
+	}
 	_, err := s.db.ExecContext(ctx,
-		`INSERT INTO endpoints (id, app_id, url, description, secret, event_types, rate_limit, metadata, active, created_at, updated_at)
-		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
-		ep.ID, ep.AppID, ep.URL, ep.Description, ep.Secret, string(eventTypes), ep.RateLimit, string(metadata), active, ep.CreatedAt, ep.UpdatedAt,
+		`INSERT INTO endpoints (id, app_id, url, description, secret, event_types, rate_limit, message_ttl_ms, retry_policy, max_concurrency, fifo, batch, redirect_policy, metadata, active, created_at, updated_at)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		ep.ID, ep.AppID, ep.URL, ep.Description, ep.Secret, string(eventTypes), ep.RateLimit, durationMs(ep.MessageTTL), policyValue(ep.RetryPolicy), ep.MaxConcurrency, fifo, batchValue(ep.Batch), ep.RedirectPolicy, string(metadata), active, ep.CreatedAt, ep.UpdatedAt,
 	)
 	return err
 }
 
+const endpointColumns = `id, app_id, url, description, secret, event_types, rate_limit, message_ttl_ms, retry_policy, max_concurrency, fifo, batch, redirect_policy, suggested_url, metadata, active, disabled_reason, disabled_at, created_at, updated_at`
+
 func (s *SQLiteStorage) scanEndpoint(row interface{ Scan(...interface{}) error }) (*models.Endpoint, error) {
 	var ep models.Endpoint
 	var eventTypes, metadata string
-	var active int
-	err := row.Scan(&ep.ID, &ep.AppID, &ep.URL, &ep.Description, &ep.Secret, &eventTypes, &ep.RateLimit, &metadata, &active, &ep.CreatedAt, &ep.UpdatedAt)
+	var messageTTL int64
+	var policy, batch sql.NullString
+	var active, fifo int
+	err := row.Scan(&ep.ID, &ep.AppID, &ep.URL, &ep.Description, &ep.Secret, &eventTypes, &ep.RateLimit, &messageTTL, &policy, &ep.MaxConcurrency, &fifo, &batch, &ep.RedirectPolicy, &ep.SuggestedURL, &metadata, &active, &ep.DisabledReason, &ep.DisabledAt, &ep.CreatedAt, &ep.UpdatedAt)
 	if err != nil {
 		return nil, err
 	}
 	json.Unmarshal([]byte(eventTypes), &ep.EventTypes)
 	json.Unmarshal([]byte(metadata), &ep.Metadata)
+	ep.MessageTTL = models.Duration(time.Duration(messageTTL) * time.Millisecond)
+	ep.RetryPolicy = parsePolicy(policy)
 	ep.Active = active == 1
+	ep.FIFO = fifo == 1
+	ep.Batch = parseBatch(batch)
 	return &ep, nil
 }
 
+// batchValue encodes b for a nullable JSON column.
+func batchValue(b *models.BatchPolicy) interface{} {
+	if b == nil {
+		return nil
+	}
+	v, _ := json.Marshal(b)
+	return string(v)
+}
+
+func parseBatch(s sql.NullString) *models.BatchPolicy {
+	if !s.Valid || s.String == "" {
+		return nil
+	}
+	var b models.BatchPolicy
+	if err := json.Unmarshal([]byte(s.String), &b); err != nil {
+		return nil
+	}
+	return &b
+}
+
+// redirectsValue encodes an attempt's redirect chain for a nullable JSON
+// column.
+func redirectsValue(r []models.Redirect) interface{} {
+	if len(r) == 0 {
+		return nil
+	}
+	v, _ := json.Marshal(r)
+	return string(v)
+}
+
+func parseRedirects(s sql.NullString) []models.Redirect {
+	if !s.Valid || s.String == "" {
+		return nil
+	}
+	var r []models.Redirect
+	json.Unmarshal([]byte(s.String), &r)
+	return r
+}
+
+// headersValue encodes h for a nullable JSON column.
+func headersValue(h http.Header) interface{} {
+	if len(h) == 0 {
+		return nil
+	}
+	v, _ := json.Marshal(h)
+	return string(v)
+}
+
+func parseHeaders(s sql.NullString) http.Header {
+	if !s.Valid || s.String == "" {
+		return nil
+	}
+	var h http.Header
+	json.Unmarshal([]byte(s.String), &h)
+	return h
+}
+
+// timingValue encodes t for a nullable JSON column.
+func timingValue(t *models.AttemptTiming) interface{} {
+	if t == nil {
+		return nil
+	}
+	v, _ := json.Marshal(t)
+	return string(v)
+}
+
+func parseTiming(s sql.NullString) *models.AttemptTiming {
+	if !s.Valid || s.String == "" {
+		return nil
+	}
+	var t models.AttemptTiming
+	if err := json.Unmarshal([]byte(s.String), &t); err != nil {
+		return nil
+	}
+	return &t
+}
+
+// durationMs converts d to the whole milliseconds stored in the database.
+func durationMs(d models.Duration) int64 {
+	return time.Duration(d).Milliseconds()
+}
+
 func (s *SQLiteStorage) GetEndpoint(ctx context.Context, id string) (*models.Endpoint, error) {
 	row := s.db.QueryRowContext(ctx,
-		`SELECT id, app_id, url, description, secret, event_types, rate_limit, metadata, active, created_at, updated_at FROM endpoints WHERE id = ?`, id)
+		`SELECT `+endpointColumns+` FROM endpoints WHERE id = ?`, id)
 	ep, err := s.scanEndpoint(row)
 	if err == sql.ErrNoRows {
 		return nil, nil
@@ -200,7 +285,7 @@ func (s *SQLiteStorage) GetEndpoint(ctx context.Context, id string) (*models.End
 
 func (s *SQLiteStorage) ListEndpoints(ctx context.Context, appID string) ([]models.Endpoint, error) {
 	rows, err := s.db.QueryContext(ctx,
-		`SELECT id, app_id, url, description, secret, event_types, rate_limit, metadata, active, created_at, updated_at FROM endpoints WHERE app_id = ? ORDER BY created_at DESC`, appID)
+		`SELECT `+endpointColumns+` FROM endpoints WHERE app_id = ? ORDER BY created_at DESC`, appID)
 	if err != nil {
 		return nil, err
 	}
@@ -220,13 +305,16 @@ func (s *SQLiteStorage) ListEndpoints(ctx context.Context, appID string) ([]mode
 func (s *SQLiteStorage) UpdateEndpoint(ctx context.Context, ep *models.Endpoint) error {
 	eventTypes, _ := json.Marshal(ep.EventTypes)
 	metadata, _ := json.Marshal(ep.Metadata)
-	active := 0
+	active, fifo := 0, 0
 	if ep.Active {
 		active = 1
 	}
+	if ep.FIFO {
+		fifo = 1
+	}
 	_, err := s.db.ExecContext(ctx,
-		`UPDATE endpoints SET url = ?, description = ?, event_types = ?, rate_limit = ?, metadata = ?, active = ?, updated_at = ? WHERE id = ?`,
-		ep.URL, ep.Description, string(eventTypes), ep.RateLimit, string(metadata), active, time.Now().UTC(), ep.ID,
+		`UPDATE endpoints SET url = ?, description = ?, event_types = ?, rate_limit = ?, message_ttl_ms = ?, retry_policy = ?, max_concurrency = ?, fifo = ?, batch = ?, redirect_policy = ?, suggested_url = ?, metadata = ?, active = ?, updated_at = ? WHERE id = ?`,
+		ep.URL, ep.Description, string(eventTypes), ep.RateLimit, durationMs(ep.MessageTTL), policyValue(ep.RetryPolicy), ep.MaxConcurrency, fifo, batchValue(ep.Batch), ep.RedirectPolicy, ep.SuggestedURL, string(metadata), active, time.Now().UTC(), ep.ID,
 	)
 	return err
 }
@@ -241,13 +329,33 @@ func (s *SQLiteStorage) ToggleEndpoint(ctx context.Context, id string, active bo
 	if active {
 		a = 1
 	}
-	_, err := s.db.ExecContext(ctx, `UPDATE endpoints SET active = ?, updated_at = ? WHERE id = ?`, a, time.Now().UTC(), id)
+	_, err := s.db.ExecContext(ctx,
+		`UPDATE endpoints SET active = ?, disabled_reason = '', disabled_at = NULL, updated_at = ? WHERE id = ?`,
+		a, time.Now().UTC(), id,
+	)
+	return err
+}
+
+func (s *SQLiteStorage) DisableEndpoint(ctx context.Context, id, reason string) error {
+	now := time.Now().UTC()
+	_, err := s.db.ExecContext(ctx,
+		`UPDATE endpoints SET active = 0, disabled_reason = ?, disabled_at = ?, updated_at = ? WHERE id = ?`,
+		reason, now, now, id,
+	)
+	return err
+}
+
+func (s *SQLiteStorage) SuggestEndpointURL(ctx context.Context, id, url string) error {
+	_, err := s.db.ExecContext(ctx,
+		`UPDATE endpoints SET suggested_url = ?, updated_at = ? WHERE id = ?`,
+		url, time.Now().UTC(), id,
+	)
 	return err
 }
 
 func (s *SQLiteStorage) GetEndpointsByEventType(ctx context.Context, appID, eventType string) ([]models.Endpoint, error) {
 	rows, err := s.db.QueryContext(ctx,
-		`SELECT id, app_id, url, description, secret, event_types, rate_limit, metadata, active, created_at, updated_at
+		`SELECT `+endpointColumns+`
 		 FROM endpoints WHERE app_id = ? AND active = 1 ORDER BY created_at DESC`, appID)
 	if err != nil {
 		return nil, err
@@ -291,25 +399,147 @@ func matchesEventType(subscribed []string, eventType string) bool {
 
 // --- Messages ---
 
+const messageColumns = `id, app_id, event_type, payload, deliver_at, expires_at, ordering_key, created_at`
+
+const sqliteInsertMessage = `INSERT INTO messages (` + messageColumns + `) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+
+// messageValues returns msg's fields in messageColumns order.
+func messageValues(msg *models.Message) []interface{} {
+	return []interface{}{msg.ID, msg.AppID, msg.EventType, string(msg.Payload), msg.DeliverAt, msg.ExpiresAt, msg.OrderingKey, msg.CreatedAt}
+}
+
+func scanMessage(row interface{ Scan(...interface{}) error }) (*models.Message, error) {
+	var msg models.Message
+	var payload string
+	if err := row.Scan(&msg.ID, &msg.AppID, &msg.EventType, &payload, &msg.DeliverAt, &msg.ExpiresAt, &msg.OrderingKey, &msg.CreatedAt); err != nil {
+		return nil, err
+	}
+	msg.Payload = json.RawMessage(payload)
+	return &msg, nil
+}
+
+func scanMessages(rows *sql.Rows) ([]models.Message, error) {
+	defer rows.Close()
+
+	var msgs []models.Message
+	for rows.Next() {
+		msg, err := scanMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, *msg)
+	}
+	return msgs, rows.Err()
+}
+
 func (s *SQLiteStorage) CreateMessage(ctx context.Context, msg *models.Message) error {
-	_, err := s.db.ExecContext(ctx,
-		`INSERT INTO messages (id, app_id, event_type, payload, created_at) VALUES (?, ?, ?, ?, ?)`,
-		msg.ID, msg.AppID, msg.EventType, string(msg.Payload), msg.CreatedAt,
-	)
+	_, err := s.db.ExecContext(ctx, sqliteInsertMessage, messageValues(msg)...)
 	return err
 }
 
+func (s *SQLiteStorage) CreateMessageWithDeliveries(ctx context.Context, msg *models.Message, deliveries []models.Delivery) error {
+	return s.CreateMessagesWithDeliveries(ctx, []MessageWithDeliveries{{Message: msg, Deliveries: deliveries}})
+}
+
+func (s *SQLiteStorage) CreateMessagesWithDeliveries(ctx context.Context, batch []MessageWithDeliveries) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := insertMessages(ctx, tx, sqliteInsertMessage, sqliteInsertDelivery, sqliteKeyStatements, batch); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+var sqliteKeyStatements = keyStatements{
+	drop:  `DELETE FROM idempotency_keys WHERE app_id = ? AND idempotency_key = ? AND created_at < ?`,
+	bind:  `INSERT INTO idempotency_keys (app_id, idempotency_key, message_id, created_at) VALUES (?, ?, ?, ?) ON CONFLICT (app_id, idempotency_key) DO NOTHING`,
+	bound: `SELECT message_id FROM idempotency_keys WHERE app_id = ? AND idempotency_key = ?`,
+}
+
+// keyStatements bind idempotency keys for insertMessages: drop removes an
+// expired binding, bind adds one unless the key is taken, and bound reads
+// the message a key is bound to.
+type keyStatements struct {
+	drop, bind, bound string
+}
+
+// insertMessages writes messages and their deliveries inside tx, preparing
+// each insert once for the whole batch. Shared by both drivers, which pass
+// their own statements. Binding a message's idempotency key in the same
+// transaction means a key is never bound to a message that was not stored.
+func insertMessages(ctx context.Context, tx *sql.Tx, insertMsg, insertDlv string, keys keyStatements, batch []MessageWithDeliveries) error {
+	msgStmt, err := tx.PrepareContext(ctx, insertMsg)
+	if err != nil {
+		return err
+	}
+	defer msgStmt.Close()
+
+	dlvStmt, err := tx.PrepareContext(ctx, insertDlv)
+	if err != nil {
+		return err
+	}
+	defer dlvStmt.Close()
+
+	for i := range batch {
+		m := &batch[i]
+		m.ReplayOf = ""
+		if m.IdempotencyKey != "" {
+			bound, err := bindKey(ctx, tx, keys, m)
+			if err != nil {
+				return err
+			}
+			if bound != m.Message.ID {
+				m.ReplayOf = bound
+				continue
+			}
+		}
+
+		if _, err := msgStmt.ExecContext(ctx, messageValues(m.Message)...); err != nil {
+			return err
+		}
+
+		for _, d := range m.Deliveries {
+			if _, err := dlvStmt.ExecContext(ctx,
+				d.ID, d.MessageID, d.EndpointID, d.Status, d.AttemptCount, policyValue(d.RetryPolicy), d.Priority, d.OrderingKey, d.RankAt, d.NextRetryAt, d.LingerUntil, d.CreatedAt, d.UpdatedAt,
+			); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// bindKey binds m's idempotency key to its message unless the key is
+// already bound since m.KeysSince, and returns the ID of the message the
+// key ends up bound to.
+func bindKey(ctx context.Context, tx *sql.Tx, keys keyStatements, m *MessageWithDeliveries) (string, error) {
+	appID := m.Message.AppID
+	if _, err := tx.ExecContext(ctx, keys.drop, appID, m.IdempotencyKey, m.KeysSince.UTC()); err != nil {
+		return "", err
+	}
+	res, err := tx.ExecContext(ctx, keys.bind, appID, m.IdempotencyKey, m.Message.ID, m.Message.CreatedAt.UTC())
+	if err != nil {
+		return "", err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 1 {
+		return m.Message.ID, err
+	}
+
+	var bound string
+	err = tx.QueryRowContext(ctx, keys.bound, appID, m.IdempotencyKey).Scan(&bound)
+	return bound, err
+}
+
 func (s *SQLiteStorage) GetMessage(ctx context.Context, id string) (*models.Message, error) {
-	var msg models.Message
-	var payload string
-	err := s.db.QueryRowContext(ctx,
-		`SELECT id, app_id, event_type, payload, created_at FROM messages WHERE id = ?`, id,
-	).Scan(&msg.ID, &msg.AppID, &msg.EventType, &payload, &msg.CreatedAt)
+	msg, err := scanMessage(s.db.QueryRowContext(ctx, `SELECT `+messageColumns+` FROM messages WHERE id = ?`, id))
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
-	msg.Payload = json.RawMessage(payload)
-	return &msg, err
+	return msg, err
 }
 
 func (s *SQLiteStorage) ListMessages(ctx context.Context, appID string, limit, offset int) ([]models.Message, error) {
@@ -317,65 +547,101 @@ func (s *SQLiteStorage) ListMessages(ctx context.Context, appID string, limit, o
 		limit = 50
 	}
 	rows, err := s.db.QueryContext(ctx,
-		`SELECT id, app_id, event_type, payload, created_at FROM messages WHERE app_id = ? ORDER BY created_at DESC LIMIT ? OFFSET ?`,
+		`SELECT `+messageColumns+` FROM messages WHERE app_id = ? ORDER BY created_at DESC LIMIT ? OFFSET ?`,
 		appID, limit, offset)
 	if err != nil {
 		return nil, err
 	}
+	return scanMessages(rows)
+}
+
+func (s *SQLiteStorage) ListScheduledMessages(ctx context.Context, appID string, limit, offset int) ([]models.Message, error) {
+	if limit <= 0 {
+		limit = 50
+	}
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT `+messageColumns+` FROM messages m
+		 WHERE m.app_id = ? AND m.deliver_at > ?
+		   AND EXISTS (SELECT 1 FROM deliveries d WHERE d.message_id = m.id AND d.status = 'pending')
+		 ORDER BY m.deliver_at LIMIT ? OFFSET ?`,
+		appID, time.Now().UTC(), limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	return scanMessages(rows)
+}
+
+func (s *SQLiteStorage) CancelScheduledDeliveries(ctx context.Context, messageID string) (int64, error) {
+	now := time.Now().UTC()
+	res, err := s.db.ExecContext(ctx,
+		`UPDATE deliveries SET status = ?, next_retry_at = NULL, locked_by = '', locked_until = NULL, lease_token = '', updated_at = ?
+		 WHERE message_id = ? AND status = ? AND next_retry_at > ?
+		   AND (locked_until IS NULL OR locked_until <= ?)`,
+		models.DeliveryCancelled, now, messageID, models.DeliveryPending, now, now)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// --- Deliveries ---
+
+const deliveryColumns = `id, message_id, endpoint_id, status, attempt_count, throttled_count, retry_policy, priority, ordering_key, rank_at, next_retry_at, linger_until, locked_by, locked_until, lease_token, created_at, updated_at`
+
+func scanDelivery(row interface{ Scan(...interface{}) error }) (*models.Delivery, error) {
+	var d models.Delivery
+	var policy sql.NullString
+	err := row.Scan(&d.ID, &d.MessageID, &d.EndpointID, &d.Status, &d.AttemptCount, &d.ThrottledCount, &policy, &d.Priority, &d.OrderingKey, &d.RankAt, &d.NextRetryAt, &d.LingerUntil, &d.LockedBy, &d.LockedUntil, &d.LeaseToken, &d.CreatedAt, &d.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	d.RetryPolicy = parsePolicy(policy)
+	return &d, nil
+}
+
+func scanDeliveries(rows *sql.Rows) ([]models.Delivery, error) {
 	defer rows.Close()
 
-	var msgs []models.Message
+	var deliveries []models.Delivery
 	for rows.Next() {
-		var msg models.Message
-		var payload string
-		if err := rows.Scan(&msg.ID, &msg.AppID, &msg.EventType, &payload, &msg.CreatedAt); err != nil {
+		d, err := scanDelivery(rows)
+		if err != nil {
 			return nil, err
 		}
-		msg.Payload = json.RawMessage(payload)
-		msgs = append(msgs, msg)
+		deliveries = append(deliveries, *d)
 	}
-	return msgs, rows.Err()
+	return deliveries, rows.Err()
 }
 
-// --- Deliveries ---
+// sqliteInsertDelivery numbers each delivery one past the highest seq.
+// SQLite runs one write transaction at a time, so seq follows the order
+// deliveries are stored in; PostgreSQL takes it from a sequence instead.
+const sqliteInsertDelivery = `INSERT INTO deliveries (id, message_id, endpoint_id, status, attempt_count, retry_policy, priority, ordering_key, rank_at, next_retry_at, linger_until, created_at, updated_at, seq)
+	 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, (SELECT COALESCE(MAX(seq), 0) + 1 FROM deliveries))`
 
 func (s *SQLiteStorage) CreateDelivery(ctx context.Context, d *models.Delivery) error {
-	_, err := s.db.ExecContext(ctx,
-		`INSERT INTO deliveries (id, message_id, endpoint_id, status, attempt_count, next_retry_at, created_at, updated_at)
-		 VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
-		d.ID, d.MessageID, d.EndpointID, d.Status, d.AttemptCount, d.NextRetryAt, d.CreatedAt, d.UpdatedAt,
+	_, err := s.db.ExecContext(ctx, sqliteInsertDelivery,
+		d.ID, d.MessageID, d.EndpointID, d.Status, d.AttemptCount, policyValue(d.RetryPolicy), d.Priority, d.OrderingKey, d.RankAt, d.NextRetryAt, d.LingerUntil, d.CreatedAt, d.UpdatedAt,
 	)
 	return err
 }
 
 func (s *SQLiteStorage) GetDelivery(ctx context.Context, id string) (*models.Delivery, error) {
-	var d models.Delivery
-	err := s.db.QueryRowContext(ctx,
-		`SELECT id, message_id, endpoint_id, status, attempt_count, next_retry_at, created_at, updated_at FROM deliveries WHERE id = ?`, id,
-	).Scan(&d.ID, &d.MessageID, &d.EndpointID, &d.Status, &d.AttemptCount, &d.NextRetryAt, &d.CreatedAt, &d.UpdatedAt)
+	row := s.db.QueryRowContext(ctx, `SELECT `+deliveryColumns+` FROM deliveries WHERE id = ?`, id)
+	d, err := scanDelivery(row)
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
-	return &d, err
+	return d, err
 }
 
 func (s *SQLiteStorage) GetDeliveriesByMessage(ctx context.Context, messageID string) ([]models.Delivery, error) {
 	rows, err := s.db.QueryContext(ctx,
-		`SELECT id, message_id, endpoint_id, status, attempt_count, next_retry_at, created_at, updated_at FROM deliveries WHERE message_id = ? ORDER BY created_at`, messageID)
+		`SELECT `+deliveryColumns+` FROM deliveries WHERE message_id = ? ORDER BY created_at`, messageID)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
-
-	var deliveries []models.Delivery
-	for rows.Next() {
-		var d models.Delivery
-		if err := rows.Scan(&d.ID, &d.MessageID, &d.EndpointID, &d.Status, &d.AttemptCount, &d.NextRetryAt, &d.CreatedAt, &d.UpdatedAt); err != nil {
-			return nil, err
-		}
-		deliveries = append(deliveries, d)
-	}
-	return deliveries, rows.Err()
+	return scanDeliveries(rows)
 }
 
 func (s *SQLiteStorage) UpdateDeliveryStatus(ctx context.Context, id string, status models.DeliveryStatus, nextRetryAt *interface{}) error {
@@ -386,51 +652,188 @@ func (s *SQLiteStorage) UpdateDeliveryStatus(ctx context.Context, id string, sta
 	return err
 }
 
+// UpdateDelivery persists the outcome of an attempt and releases the lease
+// d.LeaseToken was claimed with.
 func (s *SQLiteStorage) UpdateDelivery(ctx context.Context, d *models.Delivery) error {
-	_, err := s.db.ExecContext(ctx,
-		`UPDATE deliveries SET status = ?, attempt_count = ?, next_retry_at = ?, updated_at = ? WHERE id = ?`,
-		d.Status, d.AttemptCount, d.NextRetryAt, time.Now().UTC(), d.ID,
+	res, err := s.db.ExecContext(ctx,
+		`UPDATE deliveries SET status = ?, attempt_count = ?, throttled_count = ?, next_retry_at = ?, locked_by = '', locked_until = NULL, lease_token = '', updated_at = ? WHERE id = ? AND lease_token = ?`,
+		d.Status, d.AttemptCount, d.ThrottledCount, d.NextRetryAt, time.Now().UTC(), d.ID, d.LeaseToken,
 	)
-	return err
+	return leaseHeld(res, err)
 }
 
-func (s *SQLiteStorage) GetPendingDeliveries(ctx context.Context, limit int) ([]models.Delivery, error) {
-	rows, err := s.db.QueryContext(ctx,
-		`SELECT id, message_id, endpoint_id, status, attempt_count, next_retry_at, created_at, updated_at
-		 FROM deliveries
-		 WHERE status IN ('pending', 'retrying') AND (next_retry_at IS NULL OR next_retry_at <= ?)
-		 ORDER BY created_at ASC LIMIT ?`,
-		time.Now().UTC(), limit)
+// leaseHeld turns an UPDATE that matched no row into ErrLeaseLost. Shared
+// by both drivers.
+func leaseHeld(res sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrLeaseLost
+	}
+	return nil
+}
+
+// inOrderWhere holds back a delivery with an ordering key while an earlier
+// delivery with the same key to the same endpoint is still pending or
+// retrying, leased or not. Earlier means stored earlier, by seq: messages of
+// one batch share a created_at, and their IDs need not sort in the order
+// they were sent. The outer deliveries row must be aliased d.
+const inOrderWhere = `(d.ordering_key = '' OR NOT EXISTS (
+			SELECT 1 FROM deliveries o
+			 WHERE o.endpoint_id = d.endpoint_id AND o.ordering_key = d.ordering_key
+			   AND o.status IN ('pending', 'retrying')
+			   AND o.seq < d.seq))`
+
+// sqliteDueWhere matches deliveries that are due, not leased by a live
+// worker and not waiting behind an earlier one with the same ordering key.
+// Expired leases are treated as free so work held by a crashed worker is
+// picked up again. The first and third placeholders take the current time,
+// the second the time lingering deliveries must be due by: now, or for a
+// batch claim now plus the endpoint's linger, so the batch fills with them.
+// Only linger_until is moved forward; a delivery that is waiting for a
+// retry or its deliver_at is never claimed early.
+const sqliteDueWhere = `status IN ('pending', 'retrying')
+	   AND (next_retry_at IS NULL OR next_retry_at <= ?)
+	   AND (linger_until IS NULL OR linger_until <= ?)
+	   AND (locked_until IS NULL OR locked_until <= ?)
+	   AND ` + inOrderWhere
+
+// sqliteEndpointDue matches endpoint e's due deliveries, aliased d, as
+// sqliteDueWhere does. All placeholders take the current time.
+const sqliteEndpointDue = `d.endpoint_id = e.id AND d.status IN ('pending', 'retrying')
+	   AND (d.next_retry_at IS NULL OR d.next_retry_at <= ?)
+	   AND (d.linger_until IS NULL OR d.linger_until <= ?)
+	   AND (d.locked_until IS NULL OR d.locked_until <= ?)
+	   AND ` + inOrderWhere
+
+// sqliteDueEndpoints probes each active endpoint through
+// idx_deliveries_endpoint_pending and idx_deliveries_leased, so a large
+// backlog on one endpoint costs no more than limit rows. The join on the
+// endpoint's first due delivery drops endpoints with nothing due and, being
+// a plain column, keeps its rank_at typed as a time. Deliveries to an
+// inactive endpoint wait, unclaimed, until it is enabled again.
+const sqliteDueEndpoints = `SELECT e.id, e.app_id, a.weight, e.max_concurrency, e.batch, h.rank_at,
+		(SELECT COUNT(*) FROM (
+			SELECT 1 FROM deliveries d WHERE ` + sqliteEndpointDue + ` LIMIT ?)) AS due,
+		(SELECT COUNT(*) FROM deliveries l WHERE l.endpoint_id = e.id AND l.locked_until > ?) AS in_flight
+	FROM endpoints e
+	JOIN applications a ON a.id = e.app_id
+	JOIN deliveries h ON h.id = (
+		SELECT d.id FROM deliveries d WHERE ` + sqliteEndpointDue + ` ORDER BY d.rank_at, d.seq LIMIT 1)
+	WHERE e.active = 1`
+
+func (s *SQLiteStorage) DueEndpoints(ctx context.Context, limit int) ([]EndpointBacklog, error) {
+	now := time.Now().UTC()
+	rows, err := s.db.QueryContext(ctx, sqliteDueEndpoints, now, now, now, limit, now, now, now, now)
 	if err != nil {
 		return nil, err
 	}
+	return scanBacklog(rows)
+}
+
+func scanBacklog(rows *sql.Rows) ([]EndpointBacklog, error) {
 	defer rows.Close()
 
-	var deliveries []models.Delivery
+	var backlog []EndpointBacklog
 	for rows.Next() {
-		var d models.Delivery
-		if err := rows.Scan(&d.ID, &d.MessageID, &d.EndpointID, &d.Status, &d.AttemptCount, &d.NextRetryAt, &d.CreatedAt, &d.UpdatedAt); err != nil {
+		var b EndpointBacklog
+		var batch sql.NullString
+		if err := rows.Scan(&b.EndpointID, &b.AppID, &b.AppWeight, &b.MaxConcurrency, &batch, &b.RankAt, &b.Due, &b.InFlight); err != nil {
 			return nil, err
 		}
-		deliveries = append(deliveries, d)
+		b.Batch = parseBatch(batch)
+		backlog = append(backlog, b)
 	}
-	return deliveries, rows.Err()
+	return backlog, rows.Err()
+}
+
+func (s *SQLiteStorage) ClaimDeliveries(ctx context.Context, opts ClaimOptions) ([]models.Delivery, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	lockedUntil := now.Add(opts.Lease)
+	token := models.NewID("lease")
+	var claimed []models.Delivery
+
+	for endpointID, n := range opts.PerEndpoint {
+		rows, err := tx.QueryContext(ctx,
+			`SELECT `+deliveryColumns+` FROM deliveries d
+			 WHERE endpoint_id = ? AND `+sqliteDueWhere+`
+			 ORDER BY rank_at, seq LIMIT ?`,
+			endpointID, now, now.Add(opts.Linger[endpointID]), now, n)
+		if err != nil {
+			return nil, err
+		}
+		deliveries, err := scanDeliveries(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		for i := range deliveries {
+			if _, err := tx.ExecContext(ctx,
+				`UPDATE deliveries SET locked_by = ?, locked_until = ?, lease_token = ?, updated_at = ? WHERE id = ?`,
+				opts.WorkerID, lockedUntil, token, now, deliveries[i].ID,
+			); err != nil {
+				return nil, err
+			}
+			deliveries[i].LockedBy = opts.WorkerID
+			deliveries[i].LockedUntil = &lockedUntil
+			deliveries[i].LeaseToken = token
+		}
+		claimed = append(claimed, deliveries...)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return claimed, nil
+}
+
+func (s *SQLiteStorage) ReleaseFullBatch(ctx context.Context, endpointID string, size int, linger time.Duration) (bool, error) {
+	now := time.Now().UTC()
+	res, err := s.db.ExecContext(ctx,
+		`UPDATE deliveries SET linger_until = NULL, updated_at = ?
+		 WHERE id = (
+			SELECT d.id FROM deliveries d
+			 WHERE endpoint_id = ? AND `+sqliteDueWhere+`
+			 ORDER BY rank_at, seq LIMIT 1)
+		   AND (SELECT COUNT(*) FROM (
+			SELECT 1 FROM deliveries d
+			 WHERE endpoint_id = ? AND `+sqliteDueWhere+`
+			 LIMIT ?)) >= ?`,
+		now,
+		endpointID, now, now.Add(linger), now,
+		endpointID, now, now.Add(linger), now, size, size)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
 }
 
 // --- Attempts ---
 
 func (s *SQLiteStorage) CreateAttempt(ctx context.Context, a *models.Attempt) error {
 	_, err := s.db.ExecContext(ctx,
-		`INSERT INTO attempts (id, delivery_id, attempt_number, status_code, response_body, latency_ms, error, created_at)
-		 VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
-		a.ID, a.DeliveryID, a.AttemptNumber, a.StatusCode, a.ResponseBody, a.LatencyMs, a.Error, a.CreatedAt,
+		`INSERT INTO attempts (id, delivery_id, attempt_number, status_code, request_headers, response_headers, response_body, latency_ms, timing, error, final_url, redirects, throttled, created_at)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		a.ID, a.DeliveryID, a.AttemptNumber, a.StatusCode, headersValue(a.RequestHeaders), headersValue(a.ResponseHeaders), a.ResponseBody, a.LatencyMs, timingValue(a.Timing), a.Error, a.FinalURL, redirectsValue(a.Redirects), a.Throttled, a.CreatedAt,
 	)
 	return err
 }
 
 func (s *SQLiteStorage) GetAttemptsByDelivery(ctx context.Context, deliveryID string) ([]models.Attempt, error) {
 	rows, err := s.db.QueryContext(ctx,
-		`SELECT id, delivery_id, attempt_number, status_code, response_body, latency_ms, error, created_at FROM attempts WHERE delivery_id = ? ORDER BY attempt_number`, deliveryID)
+		`SELECT id, delivery_id, attempt_number, status_code, request_headers, response_headers, response_body, latency_ms, timing, error, final_url, redirects, throttled, created_at FROM attempts WHERE delivery_id = ? ORDER BY attempt_number, throttled DESC, created_at, id`, deliveryID)
 	if err != nil {
 		return nil, err
 	}
@@ -439,14 +842,75 @@ func (s *SQLiteStorage) GetAttemptsByDelivery(ctx context.Context, deliveryID st
 	var attempts []models.Attempt
 	for rows.Next() {
 		var a models.Attempt
-		if err := rows.Scan(&a.ID, &a.DeliveryID, &a.AttemptNumber, &a.StatusCode, &a.ResponseBody, &a.LatencyMs, &a.Error, &a.CreatedAt); err != nil {
+		var requestHeaders, responseHeaders, timing, redirects sql.NullString
+		if err := rows.Scan(&a.ID, &a.DeliveryID, &a.AttemptNumber, &a.StatusCode, &requestHeaders, &responseHeaders, &a.ResponseBody, &a.LatencyMs, &timing, &a.Error, &a.FinalURL, &redirects, &a.Throttled, &a.CreatedAt); err != nil {
 			return nil, err
 		}
+		a.RequestHeaders = parseHeaders(requestHeaders)
+		a.ResponseHeaders = parseHeaders(responseHeaders)
+		a.Timing = parseTiming(timing)
+		a.Redirects = parseRedirects(redirects)
 		attempts = append(attempts, a)
 	}
 	return attempts, rows.Err()
 }
 
+// --- Retention ---
+
+// Attempt timestamps are stored as RFC 3339 strings, so cutoffs are compared
+// in the same format rather than as bound time.Time values.
+
+const sqlitePurgeableMessages = `SELECT id FROM messages m
+	 WHERE m.created_at < ?
+	   AND NOT EXISTS (
+		SELECT 1 FROM deliveries d WHERE d.message_id = m.id AND d.status IN ('pending', 'retrying')
+	   )`
+
+func (s *SQLiteStorage) PurgeAttempts(ctx context.Context, before time.Time, limit int) (int64, error) {
+	res, err := s.db.ExecContext(ctx,
+		`DELETE FROM attempts WHERE id IN (SELECT id FROM attempts WHERE created_at < ? LIMIT ?)`,
+		before.UTC().Format(time.RFC3339), limit)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (s *SQLiteStorage) PurgeMessages(ctx context.Context, before time.Time, limit int) (int64, error) {
+	res, err := s.db.ExecContext(ctx,
+		`DELETE FROM messages WHERE id IN (`+sqlitePurgeableMessages+` LIMIT ?)`,
+		before.UTC(), limit)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (s *SQLiteStorage) CountPurgeable(ctx context.Context, attemptsBefore, messagesBefore time.Time) (int64, int64, error) {
+	var attempts, messages int64
+	if err := s.db.QueryRowContext(ctx,
+		`SELECT COUNT(*) FROM attempts WHERE created_at < ?`, attemptsBefore.UTC().Format(time.RFC3339),
+	).Scan(&attempts); err != nil {
+		return 0, 0, err
+	}
+	if err := s.db.QueryRowContext(ctx,
+		`SELECT COUNT(*) FROM (`+sqlitePurgeableMessages+`)`, messagesBefore.UTC(),
+	).Scan(&messages); err != nil {
+		return 0, 0, err
+	}
+	return attempts, messages, nil
+}
+
+func (s *SQLiteStorage) PurgeIdempotencyKeys(ctx context.Context, before time.Time, limit int) (int64, error) {
+	res, err := s.db.ExecContext(ctx,
+		`DELETE FROM idempotency_keys WHERE rowid IN (SELECT rowid FROM idempotency_keys WHERE created_at < ? LIMIT ?)`,
+		before.UTC(), limit)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
 // --- Stats ---
 
 func (s *SQLiteStorage) GetStats(ctx context.Context, appID string) (*Stats, error) {
@@ -461,12 +925,47 @@ func (s *SQLiteStorage) GetStats(ctx context.Context, appID string) (*Stats, err
 		`SELECT COUNT(*) FROM deliveries d JOIN messages m ON d.message_id = m.id WHERE m.app_id = ? AND d.status = 'failed'`, appID).Scan(&stats.FailedCount)
 	s.db.QueryRowContext(ctx,
 		`SELECT COUNT(*) FROM deliveries d JOIN messages m ON d.message_id = m.id WHERE m.app_id = ? AND d.status IN ('pending', 'retrying')`, appID).Scan(&stats.PendingCount)
+	s.db.QueryRowContext(ctx,
+		`SELECT COUNT(*) FROM deliveries d JOIN messages m ON d.message_id = m.id WHERE m.app_id = ? AND d.status = 'expired'`, appID).Scan(&stats.ExpiredCount)
+	s.db.QueryRowContext(ctx,
+		`SELECT COALESCE(SUM(d.throttled_count), 0) FROM deliveries d JOIN messages m ON d.message_id = m.id WHERE m.app_id = ?`, appID).Scan(&stats.ThrottledCount)
 	s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM endpoints WHERE app_id = ?`, appID).Scan(&stats.TotalEndpoints)
 	s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM endpoints WHERE app_id = ? AND active = 1`, appID).Scan(&stats.ActiveEndpoints)
 
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT d.priority, COUNT(*) FROM deliveries d JOIN messages m ON d.message_id = m.id
+		 WHERE m.app_id = ? AND d.status IN ('pending', 'retrying') GROUP BY d.priority`, appID)
+	if err != nil {
+		return nil, err
+	}
+	if stats.Backlog, err = scanPriorityCounts(rows); err != nil {
+		return nil, err
+	}
+
 	if stats.TotalDeliveries > 0 {
 		stats.SuccessRate = float64(stats.SuccessCount) / float64(stats.TotalDeliveries) * 100
 	}
 
 	return stats, nil
 }
+
+// scanPriorityCounts reads (priority, count) rows, reporting every priority
+// level even when it has none.
+func scanPriorityCounts(rows *sql.Rows) (map[models.Priority]int64, error) {
+	defer rows.Close()
+
+	counts := map[models.Priority]int64{
+		models.PriorityHigh:   0,
+		models.PriorityNormal: 0,
+		models.PriorityLow:    0,
+	}
+	for rows.Next() {
+		var p models.Priority
+		var n int64
+		if err := rows.Scan(&p, &n); err != nil {
+			return nil, err
+		}
+		counts[p] += n
+	}
+	return counts, rows.Err()
+}
@@ -2,16 +2,23 @@ package storage
 
 import (
 	"context"
+	"errors"
+	"time"
 
 	"github.com/shohag/piperelay/internal/models"
 )
 
+// ErrLeaseLost is returned by UpdateDelivery when the delivery is no longer
+// held by the caller: another worker has claimed it since, or it was deleted.
+var ErrLeaseLost = errors.New("delivery lease lost")
+
 type Storage interface {
 	// Applications
 	CreateApplication(ctx context.Context, app *models.Application) error
 	GetApplication(ctx context.Context, id string) (*models.Application, error)
 	GetApplicationByAPIKey(ctx context.Context, apiKey string) (*models.Application, error)
 	ListApplications(ctx context.Context) ([]models.Application, error)
+	UpdateApplication(ctx context.Context, app *models.Application) error
 	DeleteApplication(ctx context.Context, id string) error
 	UpdateApplicationAPIKey(ctx context.Context, id, newKey string) error
 
@@ -22,40 +29,141 @@ type Storage interface {
 	UpdateEndpoint(ctx context.Context, ep *models.Endpoint) error
 	DeleteEndpoint(ctx context.Context, id string) error
 	ToggleEndpoint(ctx context.Context, id string, active bool) error
+	// DisableEndpoint deactivates an endpoint on PipeRelay's own initiative and
+	// records why. ToggleEndpoint clears the reason.
+	DisableEndpoint(ctx context.Context, id, reason string) error
+	// SuggestEndpointURL records a URL the endpoint keeps permanently
+	// redirecting to. UpdateEndpoint overwrites it.
+	SuggestEndpointURL(ctx context.Context, id, url string) error
 	GetEndpointsByEventType(ctx context.Context, appID, eventType string) ([]models.Endpoint, error)
 
 	// Messages
 	CreateMessage(ctx context.Context, msg *models.Message) error
 	GetMessage(ctx context.Context, id string) (*models.Message, error)
 	ListMessages(ctx context.Context, appID string, limit, offset int) ([]models.Message, error)
+	// CreateMessageWithDeliveries stores a message and its deliveries in one
+	// transaction: either all of them are persisted or none are.
+	CreateMessageWithDeliveries(ctx context.Context, msg *models.Message, deliveries []models.Delivery) error
+	// CreateMessagesWithDeliveries does the same for a whole batch in one
+	// transaction, binding each message's IdempotencyKey in it too. A
+	// message whose key is already bound is not stored; its ReplayOf is set
+	// to the message the key is bound to instead.
+	CreateMessagesWithDeliveries(ctx context.Context, batch []MessageWithDeliveries) error
+	// ListScheduledMessages returns messages whose deliver_at is still in the
+	// future and that have deliveries waiting for it, soonest first.
+	ListScheduledMessages(ctx context.Context, appID string, limit, offset int) ([]models.Message, error)
+	// CancelScheduledDeliveries cancels a message's deliveries that are still
+	// waiting for their scheduled time and returns how many it cancelled.
+	// A delivery a worker holds a live lease on is left alone; cancelling one
+	// whose lease expired revokes it, so the late worker gets ErrLeaseLost.
+	CancelScheduledDeliveries(ctx context.Context, messageID string) (int64, error)
 
 	// Deliveries
 	CreateDelivery(ctx context.Context, d *models.Delivery) error
 	GetDelivery(ctx context.Context, id string) (*models.Delivery, error)
 	GetDeliveriesByMessage(ctx context.Context, messageID string) ([]models.Delivery, error)
 	UpdateDeliveryStatus(ctx context.Context, id string, status models.DeliveryStatus, nextRetryAt *interface{}) error
+	// UpdateDelivery saves d and releases its lease. It only applies while
+	// the claim that handed out d.LeaseToken still holds the delivery, so a
+	// worker whose lease expired mid-send cannot overwrite the result of the
+	// claim that took it over, even one by the same process; it gets
+	// ErrLeaseLost instead.
 	UpdateDelivery(ctx context.Context, d *models.Delivery) error
-	GetPendingDeliveries(ctx context.Context, limit int) ([]models.Delivery, error)
+	// DueEndpoints reports, for every active endpoint with due and
+	// unleased deliveries, how many are due (counting at most limit), the
+	// rank of the one it would send first and how many are leased right now.
+	DueEndpoints(ctx context.Context, limit int) ([]EndpointBacklog, error)
+	// ClaimDeliveries atomically leases due deliveries as opts describes.
+	// Deliveries whose lease has expired are claimable again.
+	ClaimDeliveries(ctx context.Context, opts ClaimOptions) ([]models.Delivery, error)
+	// ReleaseFullBatch ends the linger of the first of endpointID's
+	// deliveries if a claim lingering that long would sweep up at least size
+	// of them, so a full batch goes out without waiting. It reports whether
+	// it did.
+	ReleaseFullBatch(ctx context.Context, endpointID string, size int, linger time.Duration) (bool, error)
 
 	// Attempts
 	CreateAttempt(ctx context.Context, a *models.Attempt) error
 	GetAttemptsByDelivery(ctx context.Context, deliveryID string) ([]models.Attempt, error)
 
+	// Retention. Purge methods delete at most limit rows per call and return
+	// how many were removed; callers loop until fewer than limit come back.
+	PurgeAttempts(ctx context.Context, before time.Time, limit int) (int64, error)
+	// PurgeMessages skips messages that still have pending or retrying
+	// deliveries. Their deliveries and attempts are removed with them.
+	PurgeMessages(ctx context.Context, before time.Time, limit int) (int64, error)
+	CountPurgeable(ctx context.Context, attemptsBefore, messagesBefore time.Time) (attempts, messages int64, err error)
+	PurgeIdempotencyKeys(ctx context.Context, before time.Time, limit int) (int64, error)
+
 	// Stats
 	GetStats(ctx context.Context, appID string) (*Stats, error)
 
 	// Lifecycle
 	Migrate(ctx context.Context) error
+	Migrator() *Migrator
 	Close() error
 }
 
+// DeliveryListener is implemented by stores that announce new due
+// deliveries to every process sharing the database.
+type DeliveryListener interface {
+	// ListenDeliveries calls fn whenever deliveries become due, until ctx is
+	// done or the connection fails.
+	ListenDeliveries(ctx context.Context, fn func()) error
+}
+
+// EndpointBacklog is the due work waiting for one endpoint. Batch is the
+// endpoint's batch policy, nil unless it receives messages in batches.
+// RankAt is the earliest RankAt among its due deliveries, so it reflects
+// both the highest priority waiting and how long lower ones have aged.
+type EndpointBacklog struct {
+	EndpointID     string
+	AppID          string
+	AppWeight      int
+	MaxConcurrency int
+	Batch          *models.BatchPolicy
+	RankAt         time.Time
+	Due            int
+	InFlight       int
+}
+
+// ClaimOptions describes one claim: PerEndpoint maps endpoint IDs to how
+// many of their due deliveries to lease, oldest first, to WorkerID until
+// now+Lease. For endpoints in Linger, deliveries whose LingerUntil falls
+// within that long are claimed too, so a batch sweeps up messages still
+// waiting to join one. Deliveries waiting for a retry or their deliver_at
+// are never claimed early. Every claim leases its deliveries under a fresh LeaseToken.
+type ClaimOptions struct {
+	WorkerID    string
+	Lease       time.Duration
+	PerEndpoint map[string]int
+	Linger      map[string]time.Duration
+}
+
+// MessageWithDeliveries is a message together with its fan-out.
+type MessageWithDeliveries struct {
+	Message    *models.Message
+	Deliveries []models.Delivery
+	// IdempotencyKey, if set, is bound to Message for its application.
+	// Bindings made before KeysSince have expired and are replaced.
+	IdempotencyKey string
+	KeysSince      time.Time
+	// ReplayOf is set when storing finds IdempotencyKey already bound: it
+	// is the ID of that message, and this one was not stored.
+	ReplayOf string
+}
+
 type Stats struct {
-	TotalMessages    int64   `json:"total_messages"`
-	TotalDeliveries  int64   `json:"total_deliveries"`
-	SuccessCount     int64   `json:"success_count"`
-	FailedCount      int64   `json:"failed_count"`
-	PendingCount     int64   `json:"pending_count"`
-	SuccessRate      float64 `json:"success_rate"`
-	TotalEndpoints   int64   `json:"total_endpoints"`
-	ActiveEndpoints  int64   `json:"active_endpoints"`
+	TotalMessages   int64   `json:"total_messages"`
+	TotalDeliveries int64   `json:"total_deliveries"`
+	SuccessCount    int64   `json:"success_count"`
+	FailedCount     int64   `json:"failed_count"`
+	PendingCount    int64   `json:"pending_count"`
+	ExpiredCount    int64   `json:"expired_count"`
+	ThrottledCount  int64   `json:"throttled_count"`
+	SuccessRate     float64 `json:"success_rate"`
+	TotalEndpoints  int64   `json:"total_endpoints"`
+	ActiveEndpoints int64   `json:"active_endpoints"`
+	// Backlog counts pending and retrying deliveries by priority.
+	Backlog map[models.Priority]int64 `json:"backlog"`
 }
@@ -0,0 +1,419 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/shohag/piperelay/internal/models"
+)
+
+func createTestEndpoint(t *testing.T, store Storage) *models.Endpoint {
+	t.Helper()
+	ctx := context.Background()
+	now := time.Now().UTC()
+
+	app := &models.Application{ID: models.NewID("app"), Name: "test", APIKey: models.NewAPIKey(), Weight: 1, CreatedAt: now, UpdatedAt: now}
+	if err := store.CreateApplication(ctx, app); err != nil {
+		t.Fatal(err)
+	}
+	ep := &models.Endpoint{ID: models.NewID("ep"), AppID: app.ID, URL: "https://example.com/hook", Secret: models.NewSecret(), EventTypes: []string{}, Active: true, CreatedAt: now, UpdatedAt: now}
+	if err := store.CreateEndpoint(ctx, ep); err != nil {
+		t.Fatal(err)
+	}
+	return ep
+}
+
+// createTestDeliveries queues n due messages for ep and returns their
+// delivery IDs.
+func createTestDeliveries(t *testing.T, store Storage, ep *models.Endpoint, n int) []string {
+	t.Helper()
+	now := time.Now().UTC()
+
+	var batch []MessageWithDeliveries
+	var ids []string
+	for i := 0; i < n; i++ {
+		msg := &models.Message{ID: models.NewID("msg"), AppID: ep.AppID, EventType: "test", Payload: []byte(fmt.Sprintf(`{"n":%d}`, i)), CreatedAt: now}
+		d := models.Delivery{ID: models.NewID("dlv"), MessageID: msg.ID, EndpointID: ep.ID, Status: models.DeliveryPending, Priority: models.PriorityNormal, RankAt: now, CreatedAt: now, UpdatedAt: now}
+		batch = append(batch, MessageWithDeliveries{Message: msg, Deliveries: []models.Delivery{d}})
+		ids = append(ids, d.ID)
+	}
+	if err := store.CreateMessagesWithDeliveries(context.Background(), batch); err != nil {
+		t.Fatal(err)
+	}
+	return ids
+}
+
+// queueTestDelivery queues one message for ep ranked at rankAt and due at
+// nextRetryAt, nil for now, and returns its delivery ID.
+func queueTestDelivery(t *testing.T, store Storage, ep *models.Endpoint, rankAt time.Time, nextRetryAt *time.Time) string {
+	t.Helper()
+	now := time.Now().UTC()
+	msg := &models.Message{ID: models.NewID("msg"), AppID: ep.AppID, EventType: "test", Payload: []byte(`{}`), CreatedAt: now}
+	d := models.Delivery{ID: models.NewID("dlv"), MessageID: msg.ID, EndpointID: ep.ID, Status: models.DeliveryPending, RankAt: rankAt, NextRetryAt: nextRetryAt, CreatedAt: now, UpdatedAt: now}
+	if err := store.CreateMessageWithDeliveries(context.Background(), msg, []models.Delivery{d}); err != nil {
+		t.Fatal(err)
+	}
+	return d.ID
+}
+
+// testDueEndpoints checks DueEndpoints against either backend.
+func testDueEndpoints(t *testing.T, store Storage) {
+	ctx := context.Background()
+	// PostgreSQL keeps microseconds.
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	later := now.Add(time.Hour)
+
+	// The high-priority delivery is ranked as if due 5m earlier.
+	mixed := createTestEndpoint(t, store)
+	queueTestDelivery(t, store, mixed, now, nil)
+	queueTestDelivery(t, store, mixed, now.Add(-5*time.Minute), nil)
+
+	// Work that is not due yet or already leased does not set the rank.
+	partly := createTestEndpoint(t, store)
+	queueTestDelivery(t, store, partly, now.Add(-time.Hour), &later)
+	queueTestDelivery(t, store, partly, now.Add(-30*time.Minute), nil)
+	queueTestDelivery(t, store, partly, now.Add(-time.Minute), nil)
+	if _, err := store.ClaimDeliveries(ctx, ClaimOptions{WorkerID: "w", Lease: time.Minute, PerEndpoint: map[string]int{partly.ID: 1}}); err != nil {
+		t.Fatal(err)
+	}
+
+	leased := createTestEndpoint(t, store)
+	queueTestDelivery(t, store, leased, now, nil)
+	if _, err := store.ClaimDeliveries(ctx, ClaimOptions{WorkerID: "w", Lease: time.Minute, PerEndpoint: map[string]int{leased.ID: 1}}); err != nil {
+		t.Fatal(err)
+	}
+
+	inactive := createTestEndpoint(t, store)
+	queueTestDelivery(t, store, inactive, now, nil)
+	inactive.Active = false
+	if err := store.UpdateEndpoint(ctx, inactive); err != nil {
+		t.Fatal(err)
+	}
+
+	backlog, err := store.DueEndpoints(ctx, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]EndpointBacklog)
+	for _, b := range backlog {
+		got[b.EndpointID] = b
+	}
+	if len(got) != 2 {
+		t.Fatalf("DueEndpoints = %+v, want only the mixed and partly leased endpoints", backlog)
+	}
+
+	tests := []struct {
+		ep       *models.Endpoint
+		rankAt   time.Time
+		due      int
+		inFlight int
+	}{
+		{mixed, now.Add(-5 * time.Minute), 2, 0},
+		{partly, now.Add(-time.Minute), 1, 1},
+	}
+	for _, tt := range tests {
+		b := got[tt.ep.ID]
+		if !b.RankAt.Equal(tt.rankAt) || b.Due != tt.due || b.InFlight != tt.inFlight || b.AppID != tt.ep.AppID || b.AppWeight != 1 {
+			t.Errorf("backlog for %s = %+v, want rank %v, %d due and %d in flight", tt.ep.ID, b, tt.rankAt, tt.due, tt.inFlight)
+		}
+	}
+}
+
+func TestSQLiteDueEndpoints(t *testing.T) {
+	store := newTestSQLite(t)
+	if err := store.Migrate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	testDueEndpoints(t, store)
+}
+
+// testExpiredLeaseIsReclaimed has the same worker reclaim its own expired
+// lease, as a process does when a send outlives the lease.
+func testExpiredLeaseIsReclaimed(t *testing.T, store Storage) {
+	ctx := context.Background()
+	ep := createTestEndpoint(t, store)
+	createTestDeliveries(t, store, ep, 1)
+
+	first, err := store.ClaimDeliveries(ctx, ClaimOptions{WorkerID: "w", Lease: -time.Second, PerEndpoint: map[string]int{ep.ID: 1}})
+	if err != nil || len(first) != 1 {
+		t.Fatalf("first claim = %d, %v", len(first), err)
+	}
+	second, err := store.ClaimDeliveries(ctx, ClaimOptions{WorkerID: "w", Lease: time.Minute, PerEndpoint: map[string]int{ep.ID: 1}})
+	if err != nil || len(second) != 1 || second[0].ID != first[0].ID {
+		t.Fatalf("second claim = %+v, %v; want the expired delivery", second, err)
+	}
+	if second[0].LeaseToken == first[0].LeaseToken {
+		t.Fatal("both claims got the same lease token")
+	}
+
+	// The claim that lost the lease cannot overwrite the new holder's
+	// result.
+	stale := first[0]
+	stale.Status = models.DeliveryFailed
+	if err := store.UpdateDelivery(ctx, &stale); err != ErrLeaseLost {
+		t.Fatalf("stale update = %v, want ErrLeaseLost", err)
+	}
+	current := second[0]
+	current.Status = models.DeliverySuccess
+	if err := store.UpdateDelivery(ctx, &current); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.UpdateDelivery(ctx, &current); err != ErrLeaseLost {
+		t.Fatalf("second update = %v, want ErrLeaseLost once the lease is released", err)
+	}
+
+	got, err := store.GetDelivery(ctx, current.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Status != models.DeliverySuccess || got.LockedBy != "" || got.LockedUntil != nil || got.LeaseToken != "" {
+		t.Fatalf("delivery = %s locked by %q until %v", got.Status, got.LockedBy, got.LockedUntil)
+	}
+}
+
+func TestSQLiteExpiredLeaseIsReclaimed(t *testing.T) {
+	store := newTestSQLite(t)
+	if err := store.Migrate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	testExpiredLeaseIsReclaimed(t, store)
+}
+
+// keyedMessage builds a message for ep bound to an idempotency key.
+func keyedMessage(ep *models.Endpoint, key string, since time.Time) MessageWithDeliveries {
+	now := time.Now().UTC()
+	msg := &models.Message{ID: models.NewID("msg"), AppID: ep.AppID, EventType: "test", Payload: []byte(`{}`), CreatedAt: now}
+	d := models.Delivery{ID: models.NewID("dlv"), MessageID: msg.ID, EndpointID: ep.ID, Status: models.DeliveryPending, RankAt: now, CreatedAt: now, UpdatedAt: now}
+	return MessageWithDeliveries{Message: msg, Deliveries: []models.Delivery{d}, IdempotencyKey: key, KeysSince: since}
+}
+
+// testIdempotencyKeys checks that keys are bound together with their
+// messages.
+func testIdempotencyKeys(t *testing.T, store Storage) {
+	ctx := context.Background()
+	ep := createTestEndpoint(t, store)
+	window := time.Now().UTC().Add(-time.Hour)
+
+	// A transaction that fails leaves the key unbound.
+	failed := keyedMessage(ep, "k", window)
+	clash := keyedMessage(ep, "", window)
+	clash.Deliveries[0].ID = failed.Deliveries[0].ID
+	if err := store.CreateMessagesWithDeliveries(ctx, []MessageWithDeliveries{failed, clash}); err == nil {
+		t.Fatal("storing two deliveries with one ID succeeded")
+	}
+
+	first := []MessageWithDeliveries{keyedMessage(ep, "k", window)}
+	if err := store.CreateMessagesWithDeliveries(ctx, first); err != nil {
+		t.Fatal(err)
+	}
+	if first[0].ReplayOf != "" {
+		t.Fatalf("retry after a failed store replayed %s", first[0].ReplayOf)
+	}
+
+	repeat := []MessageWithDeliveries{keyedMessage(ep, "k", window)}
+	if err := store.CreateMessagesWithDeliveries(ctx, repeat); err != nil {
+		t.Fatal(err)
+	}
+	if repeat[0].ReplayOf != first[0].Message.ID {
+		t.Fatalf("repeat replayed %q, want %s", repeat[0].ReplayOf, first[0].Message.ID)
+	}
+	if msg, err := store.GetMessage(ctx, repeat[0].Message.ID); err != nil || msg != nil {
+		t.Fatalf("replayed message was stored: %v, %v", msg, err)
+	}
+
+	// Once the first binding falls out of the window the key is free.
+	expired := []MessageWithDeliveries{keyedMessage(ep, "k", time.Now().UTC().Add(time.Minute))}
+	if err := store.CreateMessagesWithDeliveries(ctx, expired); err != nil {
+		t.Fatal(err)
+	}
+	if expired[0].ReplayOf != "" {
+		t.Fatalf("expired key replayed %s", expired[0].ReplayOf)
+	}
+}
+
+func TestSQLiteIdempotencyKeys(t *testing.T) {
+	store := newTestSQLite(t)
+	if err := store.Migrate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	testIdempotencyKeys(t, store)
+}
+
+// testCancelRespectsLeases races a cancel against claims of a scheduled
+// delivery. Claims here never take it before its time, so the claim is made
+// the way a replica whose clock runs ahead would make it.
+func testCancelRespectsLeases(t *testing.T, store Storage) {
+	ctx := context.Background()
+	later := time.Now().UTC().Add(30 * time.Minute)
+
+	claim := func(ep *models.Endpoint, lease time.Duration) (models.Delivery, string) {
+		t.Helper()
+		id := queueTestDelivery(t, store, ep, time.Now().UTC(), &later)
+		d := leaseEarly(t, store, id, lease)
+		return d, d.MessageID
+	}
+	status := func(id string) models.DeliveryStatus {
+		t.Helper()
+		d, err := store.GetDelivery(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d.Status
+	}
+
+	// The claim wins: a live lease keeps the delivery from being cancelled
+	// and its worker's result stands.
+	held, msgID := claim(createTestEndpoint(t, store), time.Minute)
+	if n, err := store.CancelScheduledDeliveries(ctx, msgID); err != nil || n != 0 {
+		t.Fatalf("cancel of a leased delivery = %d, %v; want 0", n, err)
+	}
+	held.Status = models.DeliverySuccess
+	if err := store.UpdateDelivery(ctx, &held); err != nil {
+		t.Fatal(err)
+	}
+	if got := status(held.ID); got != models.DeliverySuccess {
+		t.Fatalf("status = %s, want success", got)
+	}
+
+	// The cancel wins once the lease has expired, and the late worker
+	// cannot overwrite it.
+	stale, msgID := claim(createTestEndpoint(t, store), -time.Second)
+	if n, err := store.CancelScheduledDeliveries(ctx, msgID); err != nil || n != 1 {
+		t.Fatalf("cancel after the lease expired = %d, %v; want 1", n, err)
+	}
+	stale.Status = models.DeliveryFailed
+	if err := store.UpdateDelivery(ctx, &stale); err != ErrLeaseLost {
+		t.Fatalf("late update = %v, want ErrLeaseLost", err)
+	}
+	if got := status(stale.ID); got != models.DeliveryCancelled {
+		t.Fatalf("status = %s, want cancelled", got)
+	}
+}
+
+func TestSQLiteCancelRespectsLeases(t *testing.T) {
+	store := newTestSQLite(t)
+	if err := store.Migrate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	testCancelRespectsLeases(t, store)
+}
+
+// testKeyOrderFollowsInsertion stores same-key deliveries that share a
+// created_at, with IDs sorting the opposite way, and claims them one by one.
+func testKeyOrderFollowsInsertion(t *testing.T, store Storage) {
+	ctx := context.Background()
+	ep := createTestEndpoint(t, store)
+	now := time.Now().UTC().Truncate(time.Millisecond)
+
+	const n = 10
+	ids := make([]string, n)
+	for i := range ids {
+		ids[i] = models.NewID("dlv")
+	}
+	var batch []MessageWithDeliveries
+	var want []string
+	for i := 0; i < n; i++ {
+		msg := &models.Message{ID: models.NewID("msg"), AppID: ep.AppID, EventType: "test", Payload: []byte(`{}`), OrderingKey: "k", CreatedAt: now}
+		d := models.Delivery{ID: ids[n-1-i], MessageID: msg.ID, EndpointID: ep.ID, Status: models.DeliveryPending, OrderingKey: "k", RankAt: now, CreatedAt: now, UpdatedAt: now}
+		batch = append(batch, MessageWithDeliveries{Message: msg, Deliveries: []models.Delivery{d}})
+		want = append(want, d.ID)
+	}
+	if err := store.CreateMessagesWithDeliveries(ctx, batch); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, id := range want {
+		ds, err := store.ClaimDeliveries(ctx, ClaimOptions{WorkerID: "w", Lease: time.Minute, PerEndpoint: map[string]int{ep.ID: n}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ds) != 1 || ds[0].ID != id {
+			t.Fatalf("claim %d = %d deliveries, first %v; want only %s", i, len(ds), ds, id)
+		}
+		ds[0].Status = models.DeliverySuccess
+		if err := store.UpdateDelivery(ctx, &ds[0]); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSQLiteKeyOrderFollowsInsertion(t *testing.T) {
+	store := newTestSQLite(t)
+	if err := store.Migrate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	testKeyOrderFollowsInsertion(t, store)
+}
+
+// leaseEarly leases delivery id to worker "w" whether it is due or not and
+// returns it.
+func leaseEarly(t *testing.T, store Storage, id string, lease time.Duration) models.Delivery {
+	t.Helper()
+	var db *sql.DB
+	switch s := store.(type) {
+	case *SQLiteStorage:
+		db = s.db
+	case *PostgresStorage:
+		db = s.db
+	}
+	if _, err := db.Exec(`UPDATE deliveries SET locked_by = 'w', locked_until = $1, lease_token = $2 WHERE id = $3`,
+		time.Now().UTC().Add(lease), models.NewID("lease"), id); err != nil {
+		t.Fatal(err)
+	}
+	d, err := store.GetDelivery(context.Background(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return *d
+}
+
+// testLingerClaimsOnlyLingering checks that a batch claim takes lingering
+// deliveries early but leaves ones that wait for another reason.
+func testLingerClaimsOnlyLingering(t *testing.T, store Storage) {
+	ctx := context.Background()
+	ep := createTestEndpoint(t, store)
+	now := time.Now().UTC()
+	soon, past := now.Add(10*time.Second), now.Add(-time.Second)
+
+	queue := func(nextRetryAt, lingerUntil *time.Time) string {
+		msg := &models.Message{ID: models.NewID("msg"), AppID: ep.AppID, EventType: "test", Payload: []byte(`{}`), CreatedAt: now}
+		d := models.Delivery{ID: models.NewID("dlv"), MessageID: msg.ID, EndpointID: ep.ID, Status: models.DeliveryPending, RankAt: now, NextRetryAt: nextRetryAt, LingerUntil: lingerUntil, CreatedAt: now, UpdatedAt: now}
+		if err := store.CreateMessageWithDeliveries(ctx, msg, []models.Delivery{d}); err != nil {
+			t.Fatal(err)
+		}
+		return d.ID
+	}
+	lingeredOut := queue(nil, &past)
+	lingering := queue(nil, &soon)
+	queue(&soon, nil)   // waiting for a retry
+	queue(&soon, &soon) // scheduled, then lingering
+	queue(&soon, &past) // retrying after its batch failed
+
+	ds, err := store.ClaimDeliveries(ctx, ClaimOptions{
+		WorkerID:    "w",
+		Lease:       time.Minute,
+		PerEndpoint: map[string]int{ep.ID: 10},
+		Linger:      map[string]time.Duration{ep.ID: time.Minute},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]bool)
+	for _, d := range ds {
+		got[d.ID] = true
+	}
+	if len(ds) != 2 || !got[lingeredOut] || !got[lingering] {
+		t.Fatalf("claimed %v, want only %s and %s", got, lingeredOut, lingering)
+	}
+}
+
+func TestSQLiteLingerClaimsOnlyLingering(t *testing.T) {
+	store := newTestSQLite(t)
+	if err := store.Migrate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	testLingerClaimsOnlyLingering(t, store)
+}